@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// accessLogMiddleware 在每个请求结束后记录一行访问日志: 方法、路由模板、状态码、耗时、
+// 响应字节数和客户端 IP。只记录路由模板 (例如 /api/data/:id)，不记录实际路径、查询参数
+// 和请求头，因此 ID、令牌等不会出现在访问日志中。
+func accessLogMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = "(unmatched)"
+		}
+		accessLog.Info("Request",
+			"method", c.Request.Method,
+			"route", route,
+			"status", c.Writer.Status(),
+			"duration", time.Since(start),
+			"bytes", max(c.Writer.Size(), 0),
+			"clientIp", c.ClientIP())
+	}
+}
+
+// recoveryMiddleware 代替 gin.Recovery: 处理请求时 panic 返回 500，并以结构化日志记录
+// 路由模板和调用栈。gin.Recovery 会打印完整的请求行，其中可能带有 ID。
+func recoveryMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			if err := recover(); err != nil {
+				serverLog.Error("Panic while handling request",
+					"method", c.Request.Method,
+					"route", c.FullPath(),
+					"error", fmt.Sprint(err),
+					"stack", string(debug.Stack()))
+				c.AbortWithStatus(http.StatusInternalServerError)
+			}
+		}()
+		c.Next()
+	}
+}
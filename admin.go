@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requireAdminToken 只允许携带 "Authorization: Bearer <admin.token>" 的请求访问管理接口。
+// 未配置 admin.token 时管理接口整体关闭。
+func requireAdminToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		config := currentConfig()
+		token := config.Admin.Token
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "资源未找到"})
+			return
+		}
+		provided, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			adminLog.Warn("Rejected unauthorized request", "route", c.FullPath(), "clientIp", c.ClientIP())
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// BurnQueueHandler 返回销毁队列的深度、失败次数和未完成的任务
+func BurnQueueHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, GetStorageManager().burns.Stats())
+	}
+}
+
+// ReloadConfigHandler 重新加载配置文件，与向进程发送 SIGHUP 相同。
+// 新配置验证失败时保留当前配置并返回错误；restartRequired 列出已修改但需要重启才能生效的配置项。
+func ReloadConfigHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		restartRequired, err := reloadConfig()
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"success": false, "message": "Config reload failed, keeping current config", "error": err.Error()})
+			return
+		}
+		if restartRequired == nil {
+			restartRequired = []string{}
+		}
+		c.JSON(http.StatusOK, gin.H{"success": true, "message": "Config reloaded", "restartRequired": restartRequired})
+	}
+}
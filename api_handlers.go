@@ -1,12 +1,15 @@
 package main
 
 import (
-	"encoding/json"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
-	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time" // Ensure time is imported
 
@@ -36,6 +39,39 @@ type StoredData struct {
 	ContentType        string              `json:"contentType,omitempty"`        // MIME type of the content
 	FileSize           int64               `json:"fileSize,omitempty"`           // Size of the final merged file (for files)
 	FirstAccessedTime  *time.Time          `json:"firstAccessedTime,omitempty"`  // Timestamp of first access (for access window calculation)
+	MaxViews           int                 `json:"maxViews,omitempty"`           // Optional view limit, 0 means unlimited
+	Views              int                 `json:"views,omitempty"`              // Number of times the ciphertext has been served
+	BurnOnRead         bool                `json:"burnOnRead,omitempty"`         // Text only: the request that returns the ciphertext also deletes it
+	CreatedAt          *time.Time          `json:"createdAt,omitempty"`          // Time the note or file was stored
+	ManageTokenHash    string              `json:"manageTokenHash,omitempty"`    // SHA-256 of the owner's management token
+	BurnToken          string              `json:"burnToken,omitempty"`          // Handed out together with the ciphertext so the reader may burn it
+	SHA256             string              `json:"sha256,omitempty"`             // Hex SHA-256 of the merged ciphertext (files), sent as Digest/ETag on download
+	ResumeUntil        *time.Time          `json:"resumeUntil,omitempty"`        // Files: ranged requests may resume the last counted download until this time
+}
+
+// newOwnerTokens 为新数据生成管理令牌 (只保存摘要) 和随密文下发的销毁令牌
+func newOwnerTokens(data *StoredData) (manageToken string, err error) {
+	manageToken, err = newSecretToken()
+	if err != nil {
+		return "", err
+	}
+	burnToken, err := newSecretToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	data.CreatedAt = &now
+	data.ManageTokenHash = hashToken(manageToken)
+	data.BurnToken = burnToken
+	return manageToken, nil
+}
+
+// RemainingViews 返回剩余的查看次数，不限次数时返回 -1
+func (d *StoredData) RemainingViews() int {
+	if d.MaxViews <= 0 {
+		return -1
+	}
+	return max(d.MaxViews-d.Views, 0)
 }
 
 // StoredMetadata 定义仅包含元数据的文件结构 (用于文件分片上传后)
@@ -51,6 +87,8 @@ type StoreRequest struct {
 	PasswordProtection *PasswordProtection `json:"passwordProtection,omitempty"`
 	SetDuration        string              `json:"setDuration,omitempty"` // User-selected duration (e.g., "1h", "24h")
 	ContentType        string              `json:"contentType,omitempty"` // Optional: Specify content type (e.g., text/markdown, text/x-python). Defaults to text/plain if empty.
+	MaxViews           int                 `json:"maxViews,omitempty"`    // Optional: burn after this many reads (0 = unlimited)
+	BurnOnRead         bool                `json:"burnOnRead,omitempty"`  // Optional: atomically delete the note in the same request that returns it (overrides maxViews)
 }
 
 // StoreMetadataRequest 定义 /api/store/metadata 的请求结构 (文件模式完成时)
@@ -63,6 +101,88 @@ type StoreMetadataRequest struct {
 	SetDuration        string              `json:"setDuration,omitempty"` // User-selected duration
 	ContentType        string              `json:"contentType"`           // MIME type detected by client or server
 	FileSize           int64               `json:"fileSize"`              // Size of the final merged file
+	MaxViews           int                 `json:"maxViews,omitempty"`    // Optional: burn after this many downloads (0 = unlimited)
+}
+
+// errViewsExhausted 表示数据的查看次数已经用完
+var errViewsExhausted = errors.New("view limit reached")
+
+// resumeGracePeriod 是一次计入的下载开始后允许断点续传的时间。超过后续传请求重新计为一次查看，
+// 最后一次查看的数据即使传输没有完成也会销毁。
+const resumeGracePeriod = 1 * time.Hour
+
+// consumeView 原子地记录一次查看并返回剩余次数 (不限次数时为 -1)。
+// 次数已用完时返回 errViewsExhausted，调用者不应再返回密文。
+// resumeGrace 大于 0 时 (文件下载)，记录这次查看的续传截止时间 (ResumeUntil)，
+// 最后一次查看还把有效期缩短到同一时间。
+func consumeView(id string, resumeGrace time.Duration) (int, error) {
+	remaining := -1
+	_, err := GetStorageManager().UpdateMetadata(id, func(stored *StoredData) error {
+		if stored.MaxViews > 0 && stored.Views >= stored.MaxViews {
+			return errViewsExhausted
+		}
+		stored.Views++
+		if stored.FirstAccessedTime == nil { // Access window disabled: still record first access for the owner
+			now := time.Now()
+			stored.FirstAccessedTime = &now
+		}
+		remaining = stored.RemainingViews()
+		if resumeGrace > 0 {
+			deadline := time.Now().Add(resumeGrace)
+			stored.ResumeUntil = &deadline
+			if remaining == 0 && (stored.ExpiresAt == nil || deadline.Before(*stored.ExpiresAt)) {
+				stored.ExpiresAt = &deadline
+			}
+		}
+		return nil
+	})
+	return remaining, err
+}
+
+// isResumedDownload 报告下载请求是否像在继续之前开始的传输: If-Range 与当前 ETag 一致，
+// Range 只有一个从正数偏移开始的范围 (bytes=N- 或 bytes=N-M)。后缀范围 (bytes=-N)、
+// 多个范围和没有 If-Range 的请求都按新的下载处理。是否仍在续传期限内由调用者检查 ResumeUntil。
+func isResumedDownload(r *http.Request, etag string) bool {
+	if etag == "" || r.Header.Get("If-Range") != etag {
+		return false
+	}
+	spec, ok := strings.CutPrefix(strings.TrimSpace(r.Header.Get("Range")), "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return false
+	}
+	start, _, ok := strings.Cut(spec, "-")
+	if !ok {
+		return false
+	}
+	offset, err := strconv.ParseInt(strings.TrimSpace(start), 10, 64)
+	return err == nil && offset > 0
+}
+
+// downloadCompleted 报告 ServeContent 是否把文件直到最后一个字节都完整发出
+func downloadCompleted(w gin.ResponseWriter, size int64) bool {
+	switch w.Status() {
+	case http.StatusOK:
+		return int64(w.Size()) == size
+	case http.StatusPartialContent:
+		var start, end, total int64
+		if _, err := fmt.Sscanf(w.Header().Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total); err != nil {
+			return false // Multipart ranges are not tracked
+		}
+		return end == total-1 && int64(w.Size()) == end-start+1
+	}
+	return false
+}
+
+// maxAllowedDuration 返回 free 模式下所有者最多能把有效期设为多长:
+// available_durations 中最长的一项，默认有效期更长时以默认有效期为准
+func maxAllowedDuration(config *Config) time.Duration {
+	max, _ := time.ParseDuration(config.Expiration.DefaultDuration)
+	for _, option := range config.Expiration.AvailableDurations {
+		if d, err := time.ParseDuration(option); err == nil && d > max {
+			max = d
+		}
+	}
+	return max
 }
 
 // calculateExpirationTime 根据配置和用户选择计算主有效期时间
@@ -81,12 +201,12 @@ func calculateExpirationTime(config *Config, userDurationStr string) (*time.Time
 			// Attempt to parse the user-provided duration directly
 			parsedDuration, err := time.ParseDuration(userDurationStr)
 			if err != nil {
-				log.Printf("Invalid duration format '%s' provided by client: %v. Using default: %s", userDurationStr, err, config.Expiration.DefaultDuration)
+				expirationLog.Info("Invalid duration provided by client, using default", "duration", userDurationStr, "error", err, "default", config.Expiration.DefaultDuration)
 				durationStr = config.Expiration.DefaultDuration
 				// Optionally return an error:
 				// return nil, fmt.Errorf("无效的有效期格式: %s", userDurationStr)
 			} else if parsedDuration <= 0 {
-				log.Printf("Non-positive duration '%s' provided by client. Using default: %s", userDurationStr, config.Expiration.DefaultDuration)
+				expirationLog.Info("Non-positive duration provided by client, using default", "duration", userDurationStr, "default", config.Expiration.DefaultDuration)
 				durationStr = config.Expiration.DefaultDuration
 				// Optionally return an error:
 				// return nil, fmt.Errorf("有效期必须为正数: %s", userDurationStr)
@@ -94,7 +214,7 @@ func calculateExpirationTime(config *Config, userDurationStr string) (*time.Time
 				// Optional: Add a maximum duration check if needed
 				// maxAllowedDuration := 365 * 24 * time.Hour // Example: 1 year
 				// if parsedDuration > maxAllowedDuration {
-				// 	log.Printf("Duration '%s' exceeds maximum allowed. Using default: %s", userDurationStr, config.Expiration.DefaultDuration)
+				// 	expirationLog.Info("Duration exceeds maximum allowed, using default", "duration", userDurationStr, "default", config.Expiration.DefaultDuration)
 				// 	durationStr = config.Expiration.DefaultDuration
 				//  // Optionally return an error:
 				//  // return nil, fmt.Errorf("有效期超过最大限制")
@@ -104,19 +224,19 @@ func calculateExpirationTime(config *Config, userDurationStr string) (*time.Time
 			}
 		} else {
 			// If user didn't provide one, use default
-			log.Printf("No duration provided by client. Using default: %s", config.Expiration.DefaultDuration)
+			expirationLog.Debug("No duration provided by client, using default", "default", config.Expiration.DefaultDuration)
 			durationStr = config.Expiration.DefaultDuration
 		}
 	} else {
 		// Should not happen due to config validation, but handle defensively
-		log.Printf("CRITICAL: Invalid expiration mode '%s' found despite validation. Using default duration.", config.Expiration.Mode)
+		expirationLog.Error("Invalid expiration mode found despite validation, using default duration", "mode", config.Expiration.Mode)
 		durationStr = config.Expiration.DefaultDuration
 	}
 
 	duration, err := time.ParseDuration(durationStr)
 	if err != nil {
 		// This should ideally not happen due to config validation, but handle defensively
-		log.Printf("CRITICAL: Failed to parse configured duration '%s': %v. Using default 24h.", durationStr, err)
+		expirationLog.Error("Failed to parse configured duration, using default 24h", "duration", durationStr, "error", err)
 		duration = 24 * time.Hour
 		// Return the error if strict handling is needed:
 		// return nil, fmt.Errorf("无法解析有效期 '%s': %w", durationStr, err)
@@ -127,46 +247,50 @@ func calculateExpirationTime(config *Config, userDurationStr string) (*time.Time
 }
 
 // StoreDataHandler handles storing encrypted TEXT data sent from the client
-func StoreDataHandler(config *Config) gin.HandlerFunc {
+func StoreDataHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		config := currentConfig()
 		var request StoreRequest
 		if err := c.ShouldBindJSON(&request); err != nil {
-			log.Printf("[StoreData] Error binding JSON: %v", err)
+			storeDataLog.Debug("Error binding JSON", "error", err)
 			c.JSON(http.StatusBadRequest, gin.H{"error": "无效的请求格式", "details": err.Error()})
 			return
 		}
 
 		// Validate required fields for text mode
 		if request.EncryptedData == "" {
-			log.Println("[StoreData] Missing encryptedData")
+			storeDataLog.Debug("Missing encryptedData")
 			c.JSON(http.StatusBadRequest, gin.H{"error": "缺少加密数据"})
 			return
 		}
 		if request.IV == "" {
-			log.Println("[StoreData] Missing IV")
+			storeDataLog.Debug("Missing IV")
 			c.JSON(http.StatusBadRequest, gin.H{"error": "缺少IV"})
 			return
 		}
 		if request.Salt == "" {
-			log.Println("[StoreData] Missing salt")
+			storeDataLog.Debug("Missing salt")
 			c.JSON(http.StatusBadRequest, gin.H{"error": "缺少salt"})
 			return
 		}
+		if request.MaxViews < 0 {
+			storeDataLog.Debug("Invalid maxViews", "maxViews", request.MaxViews)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "无效的查看次数限制"})
+			return
+		}
 
 		// Generate unique ID
 		id := uuid.New().String()
-		fileName := id + ".json"
-		filePath := filepath.Join(config.Paths.DataStorageDir, fileName)
 
 		// --- Expiration Logic ---
 		expirationTimePtr, err := calculateExpirationTime(config, request.SetDuration)
 		if err != nil {
 			// Handle error during duration calculation (e.g., invalid user input if not falling back)
-			log.Printf("[StoreData:%s] Error calculating expiration: %v", id, err)
+			storeDataLog.Error("Error calculating expiration", "id", id, "error", err)
 			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("计算有效期失败: %v", err)})
 			return
 		}
-		log.Printf("[StoreData:%s] Calculated expiration time: %v", id, expirationTimePtr)
+		storeDataLog.Debug("Calculated expiration time", "id", id, "expiresAt", expirationTimePtr)
 		// --- End Expiration Logic ---
 
 		// 构建存储数据结构
@@ -177,6 +301,8 @@ func StoreDataHandler(config *Config) gin.HandlerFunc {
 			PasswordProtection: request.PasswordProtection,
 			ExpiresAt:          expirationTimePtr, // Store calculated expiration time pointer
 			ContentType:        "text/plain",      // Default ContentType for text data
+			MaxViews:           request.MaxViews,
+			BurnOnRead:         request.BurnOnRead,
 			// File specific fields (OriginalFilename, FileSize) are empty for text
 			// Access window fields (FirstAccessedTime, AccessWindowEndsAt) are nil initially
 		}
@@ -185,75 +311,127 @@ func StoreDataHandler(config *Config) gin.HandlerFunc {
 			// Basic validation/sanitization could be added here if needed
 			data.ContentType = request.ContentType
 		}
+		manageToken, err := newOwnerTokens(&data)
+		if err != nil {
+			storeDataLog.Error("Error generating management token", "id", id, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "无法保存数据"})
+			return
+		}
+
+		// 写入存储后端
+		if err := GetStorageManager().PutMetadata(id, &data); err != nil {
+			storeDataLog.Error("Error storing metadata", "id", id, "error", err)
+			if errors.Is(err, ErrStorageFull) {
+				c.JSON(http.StatusInsufficientStorage, gin.H{"error": "存储空间已满，请稍后再试"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "无法保存数据"})
+			return
+		}
 
-		// 确保目录存在
-		if err := os.MkdirAll(config.Paths.DataStorageDir, 0750); err != nil {
-			log.Printf("[StoreData:%s] Error creating directory %s: %v", id, config.Paths.DataStorageDir, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "无法创建存储目录"})
+		storeDataLog.Info("Stored text data", "id", id)
+		metricItemsStored.WithLabelValues("text").Inc()
+		c.JSON(http.StatusOK, gin.H{"id": id, "manageToken": manageToken})
+	}
+}
+
+// sizeClass 把密文大小粗略分级，避免 peek 泄露精确长度
+func sizeClass(size int64) string {
+	switch {
+	case size < 1<<20:
+		return "small"
+	case size < 100<<20:
+		return "medium"
+	default:
+		return "large"
+	}
+}
+
+// PeekDataHandler 是无副作用的查询 (GET /api/data/:id)：只返回是否存在、大小级别、
+// 是否需要密码以及剩余时间。不返回密文，不计入查看次数，也不开始访问窗口计时，
+// 因此聊天软件和邮件扫描器预览链接时不会消耗数据。
+func PeekDataHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		if !IsValidUUID(id) {
+			peekDataLog.Debug("Invalid ID format received", "id", id)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "无效的数据ID"})
 			return
 		}
 
-		// 序列化数据
-		jsonData, err := json.MarshalIndent(data, "", "  ")
+		metadata, err := GetStorageManager().GetMetadata(id)
 		if err != nil {
-			log.Printf("[StoreData:%s] Error marshaling JSON: %v", id, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "无法序列化数据"})
+			if errors.Is(err, ErrNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "数据不存在或已被销毁"})
+			} else {
+				peekDataLog.Error("Error reading metadata", "id", id, "error", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "读取数据失败"})
+			}
 			return
 		}
 
-		// 写入文件
-		if err := os.WriteFile(filePath, jsonData, 0640); err != nil {
-			log.Printf("[StoreData:%s] Error writing file %s: %v", id, filePath, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "无法保存数据"})
+		// 已过期的数据由到期调度器销毁，这里只报告不存在
+		deadline, hasDeadline := expiryDeadline(metadata)
+		if hasDeadline && !time.Now().Before(deadline) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "数据不存在或已被销毁"})
 			return
 		}
 
-		log.Printf("[StoreData:%s] Successfully stored text data", id)
-		c.JSON(http.StatusOK, gin.H{"id": id})
+		response := gin.H{
+			"exists":       true,
+			"needPassword": metadata.PasswordProtection != nil,
+		}
+		if metadata.OriginalFilename != "" {
+			response["type"] = "file"
+			response["sizeClass"] = sizeClass(metadata.FileSize)
+		} else {
+			response["type"] = "text"
+			response["sizeClass"] = sizeClass(int64(len(metadata.EncryptedData)))
+		}
+		if hasDeadline {
+			response["expiresInSeconds"] = int64(time.Until(deadline).Seconds())
+		}
+		if remaining := metadata.RemainingViews(); remaining >= 0 {
+			response["remainingViews"] = remaining
+		}
+		c.JSON(http.StatusOK, response)
 	}
 }
 
-// GetDataHandler handles retrieving stored data (text or file metadata) by ID,
-// applying expiration checks (primary and access window).
-func GetDataHandler(config *Config) gin.HandlerFunc {
+// GetDataHandler handles the explicit reveal step (POST /api/data/:id/reveal):
+// it returns the stored data (text or file metadata) by ID, applying expiration checks
+// (primary and access window). Only this endpoint counts as an access and starts the access window.
+func GetDataHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		config := currentConfig()
 		id := c.Param("id")
 		if !IsValidUUID(id) {
-			log.Printf("[GetData:%s] Invalid ID format received.", id)
+			getDataLog.Debug("Invalid ID format received", "id", id)
 			c.JSON(http.StatusBadRequest, gin.H{"error": "无效的数据ID"})
 			return
 		}
 
-		dataPath := filepath.Join(config.Paths.DataStorageDir, id+".json")
-		log.Printf("[GetData:%s] Attempting to read metadata file: %s", id, dataPath)
+		getDataLog.Debug("Reading metadata", "id", id)
 
-		jsonData, err := os.ReadFile(dataPath)
+		metadata, err := GetStorageManager().GetMetadata(id)
 		if err != nil {
-			if os.IsNotExist(err) {
-				log.Printf("[GetData:%s] Metadata file not found (likely burned or invalid ID): %s", id, dataPath)
+			if errors.Is(err, ErrNotFound) {
+				getDataLog.Info("Metadata not found (likely burned or invalid ID)", "id", id)
 				c.JSON(http.StatusNotFound, gin.H{"error": "数据不存在或已被销毁"})
 			} else {
-				log.Printf("[GetData:%s] Error reading metadata file %s: %v", id, dataPath, err)
+				getDataLog.Error("Error reading metadata", "id", id, "error", err)
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "读取数据失败"})
 			}
 			return
 		}
 
-		// Unmarshal into the unified StoredData struct
-		var metadata StoredData
-		if err := json.Unmarshal(jsonData, &metadata); err != nil {
-			log.Printf("[GetData:%s] Error unmarshaling metadata from %s: %v", id, dataPath, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "存储的数据格式无效"})
-			return
-		}
-
 		now := time.Now()
 		needsUpdate := false // Flag to indicate if metadata file needs to be rewritten
 
 		// --- Primary Expiration Check ---
 		if metadata.ExpiresAt != nil && now.After(*metadata.ExpiresAt) {
-			log.Printf("[GetData:%s] Primary expiration time (%s) has passed. Burning data.", id, (*metadata.ExpiresAt).Format(time.RFC3339))
-			go burnData(config, id) // Burn in background
+			getDataLog.Info("Primary expiration time has passed, burning data", "id", id, "expiresAt", *metadata.ExpiresAt)
+			burnInBackground(config, id, burnReasonExpired) // Burn in background
 			c.JSON(http.StatusNotFound, gin.H{"error": "数据不存在或已被销毁"})
 			return
 		}
@@ -262,7 +440,7 @@ func GetDataHandler(config *Config) gin.HandlerFunc {
 		if config.Expiration.Enabled && config.Expiration.AccessWindow.Enabled {
 			if metadata.FirstAccessedTime == nil {
 				// First access: Calculate and set access window expiry
-				log.Printf("[GetData:%s] First access detected. Calculating access window.", id)
+				getDataLog.Debug("First access detected, calculating access window", "id", id)
 
 				isTextData := metadata.OriginalFilename == "" // Determine if it's text data
 				fileExt := ""
@@ -304,18 +482,18 @@ func GetDataHandler(config *Config) gin.HandlerFunc {
 
 					if sizeMatch {
 						accessWindowDurationStr = rule.Duration
-						log.Printf("[GetData:%s] Matched access window rule: Type=%v, SizeMB=%.2f -> Duration=%s", id, rule.Type, fileSizeMB, rule.Duration)
+						getDataLog.Debug("Matched access window rule", "id", id, "type", rule.Type, "sizeMB", fileSizeMB, "duration", rule.Duration)
 						break // Use first matching rule
 					}
 				}
 
 				accessWindowDuration, err := time.ParseDuration(accessWindowDurationStr)
 				if err != nil {
-					log.Printf("[GetData:%s] CRITICAL: Failed to parse access window duration '%s': %v. Using default.", id, accessWindowDurationStr, err)
+					getDataLog.Error("Failed to parse access window duration, using default", "id", id, "duration", accessWindowDurationStr, "error", err)
 					// Attempt to parse default duration as fallback
 					defaultAccessDur, defaultErr := time.ParseDuration(config.Expiration.AccessWindow.DefaultDuration)
 					if defaultErr != nil {
-						log.Printf("[GetData:%s] CRITICAL: Failed to parse DEFAULT access window duration '%s': %v. Using 10m.", id, config.Expiration.AccessWindow.DefaultDuration, defaultErr)
+						getDataLog.Error("Failed to parse default access window duration, using 10m", "id", id, "duration", config.Expiration.AccessWindow.DefaultDuration, "error", defaultErr)
 						defaultAccessDur = 10 * time.Minute // Absolute fallback
 					}
 					accessWindowDuration = defaultAccessDur
@@ -326,7 +504,7 @@ func GetDataHandler(config *Config) gin.HandlerFunc {
 				// Ensure access window doesn't exceed primary expiry
 				if metadata.ExpiresAt != nil && metadata.ExpiresAt.Before(calculatedAccessWindowEnd) {
 					finalAccessWindowEnd = *metadata.ExpiresAt
-					log.Printf("[GetData:%s] Access window expiry (%s) capped by primary expiry (%s)", id, calculatedAccessWindowEnd.Format(time.RFC3339), finalAccessWindowEnd.Format(time.RFC3339))
+					getDataLog.Debug("Access window capped by primary expiry", "id", id, "accessWindowEndsAt", calculatedAccessWindowEnd, "expiresAt", finalAccessWindowEnd)
 				}
 
 				// Update metadata in memory
@@ -334,35 +512,37 @@ func GetDataHandler(config *Config) gin.HandlerFunc {
 				metadata.AccessWindowEndsAt = &finalAccessWindowEnd
 				needsUpdate = true // Mark for rewrite
 
-				log.Printf("[GetData:%s] Access window set. FirstAccess: %s, AccessWindowEndsAt: %s", id, now.Format(time.RFC3339), finalAccessWindowEnd.Format(time.RFC3339))
+				getDataLog.Debug("Access window set", "id", id, "firstAccessAt", now, "accessWindowEndsAt", finalAccessWindowEnd)
 
 			} else {
 				// Subsequent access: Check if access window has expired
 				if metadata.AccessWindowEndsAt != nil && now.After(*metadata.AccessWindowEndsAt) {
-					log.Printf("[GetData:%s] Access window expired at %s. Burning data.", id, (*metadata.AccessWindowEndsAt).Format(time.RFC3339))
-					go burnData(config, id) // Burn in background
+					getDataLog.Info("Access window expired, burning data", "id", id, "accessWindowEndsAt", *metadata.AccessWindowEndsAt)
+					burnInBackground(config, id, burnReasonAccessWindow) // Burn in background
 					c.JSON(http.StatusNotFound, gin.H{"error": "数据不存在或已被销毁"})
 					return
 				}
 				// Log subsequent access within window (optional)
-				// log.Printf("[GetData:%s] Subsequent access within window. AccessWindowEndsAt: %s", id, (*metadata.AccessWindowEndsAt).Format(time.RFC3339))
+				getDataLog.Debug("Subsequent access within window", "id", id, "accessWindowEndsAt", *metadata.AccessWindowEndsAt)
 			}
 		}
 
-		// --- Update Metadata File if Necessary ---
-		if needsUpdate {
-			updatedJsonData, marshalErr := json.MarshalIndent(metadata, "", "  ") // Marshal the updated StoredData
-			if marshalErr != nil {
-				log.Printf("[GetData:%s] CRITICAL: Failed to marshal updated metadata for saving: %v", id, marshalErr)
+		// --- Update Metadata If Necessary ---
+		// (burn-on-read notes are deleted by this request, no point in recording the access window)
+		if needsUpdate && !metadata.BurnOnRead {
+			firstAccessed, accessWindowEnd := metadata.FirstAccessedTime, metadata.AccessWindowEndsAt
+			_, updateErr := GetStorageManager().UpdateMetadata(id, func(stored *StoredData) error {
+				if stored.FirstAccessedTime == nil { // Another request may have set it concurrently
+					stored.FirstAccessedTime = firstAccessed
+					stored.AccessWindowEndsAt = accessWindowEnd
+				}
+				return nil
+			})
+			if updateErr != nil {
+				getDataLog.Error("Failed to update metadata with access times", "id", id, "error", updateErr)
 				// Don't fail the request, but log the error. The access window won't be persisted.
 			} else {
-				writeErr := os.WriteFile(dataPath, updatedJsonData, 0640)
-				if writeErr != nil {
-					log.Printf("[GetData:%s] CRITICAL: Failed to write updated metadata file %s: %v", id, dataPath, writeErr)
-					// Don't fail the request, but log the error.
-				} else {
-					log.Printf("[GetData:%s] Successfully updated metadata file with access times.", id)
-				}
+				getDataLog.Debug("Updated metadata with access times", "id", id)
 			}
 		}
 
@@ -379,11 +559,60 @@ func GetDataHandler(config *Config) gin.HandlerFunc {
 
 		isTextData := metadata.OriginalFilename == ""
 		if !isTextData { // File data
+			// 文件的查看次数在下载时扣减，这里只报告当前剩余次数
 			response["originalFilename"] = metadata.OriginalFilename
-			log.Printf("[GetData:%s] Returning metadata for file: %s", id, metadata.OriginalFilename)
+			if remaining := metadata.RemainingViews(); remaining >= 0 {
+				response["remainingViews"] = remaining
+			}
+			getDataLog.Debug("Returning metadata for file", "id", id)
+		} else if metadata.BurnOnRead { // Text data, burned by this very request
+			// 原子地认领元数据: 并发请求中只有一个能拿到密文，其余的看到数据已被销毁
+			claimed, err := GetStorageManager().TakeMetadata(id)
+			if err != nil {
+				if errors.Is(err, ErrNotFound) {
+					getDataLog.Info("Burn-on-read note already claimed by another request", "id", id)
+					c.JSON(http.StatusNotFound, gin.H{"error": "数据不存在或已被销毁"})
+				} else {
+					getDataLog.Error("Error claiming burn-on-read note", "id", id, "error", err)
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "读取数据失败"})
+				}
+				return
+			}
+			metricBurns.WithLabelValues(burnReasonRead).Inc()
+			metricReads.WithLabelValues("text").Inc()
+			response["encryptedData"] = claimed.EncryptedData
+			response["burned"] = true
+			getDataLog.Info("Returning encrypted text data, note burned on read", "id", id)
 		} else { // Text data
+			remaining, err := consumeView(id, 0)
+			if err != nil {
+				if errors.Is(err, errViewsExhausted) || errors.Is(err, ErrNotFound) {
+					getDataLog.Info("View limit reached or data burned concurrently", "id", id)
+					burnInBackground(config, id, burnReasonRead)
+					c.JSON(http.StatusNotFound, gin.H{"error": "数据不存在或已被销毁"})
+				} else {
+					getDataLog.Error("Error recording view", "id", id, "error", err)
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "读取数据失败"})
+				}
+				return
+			}
 			response["encryptedData"] = metadata.EncryptedData
-			log.Printf("[GetData:%s] Returning encrypted text data.", id)
+			if metadata.BurnToken != "" {
+				response["burnToken"] = metadata.BurnToken
+			}
+			if remaining >= 0 {
+				response["remainingViews"] = remaining
+			}
+			getDataLog.Debug("Returning encrypted text data", "id", id)
+			metricReads.WithLabelValues("text").Inc()
+
+			if remaining == 0 {
+				// 最后一次查看: 在返回密文之前由服务器销毁
+				getDataLog.Info("View limit reached, burning data", "id", id)
+				if err := burnData(config, id, burnReasonRead); err != nil {
+					getDataLog.Warn("Burn after last view incomplete", "id", id, "error", err)
+				}
+			}
 		}
 
 		c.JSON(http.StatusOK, response)
@@ -391,159 +620,171 @@ func GetDataHandler(config *Config) gin.HandlerFunc {
 }
 
 // burnData 销毁数据文件和相关资源
-func burnData(config *Config, id string) error {
-	log.Printf("[BurnData:%s] Starting burn process.", id)
-	// 删除元数据文件
-	metaFilePath := filepath.Join(config.Paths.DataStorageDir, id+".json")
-	log.Printf("[BurnData:%s] Attempting to remove metadata file: %s", id, metaFilePath)
-	errMeta := os.Remove(metaFilePath)
-	if errMeta != nil && !os.IsNotExist(errMeta) {
-		log.Printf("[BurnData:%s] Failed to remove metadata file: %v", id, errMeta)
-		// Continue to attempt deleting other files
-	} else if errMeta == nil {
-		log.Printf("[BurnData:%s] Successfully removed metadata file.", id)
-	} else { // err is os.IsNotExist
-		log.Printf("[BurnData:%s] Metadata file did not exist.", id)
+func burnData(config *Config, id string, reason string) error {
+	burnDataLog.Debug("Starting burn process", "id", id, "reason", reason)
+	burns := GetStorageManager().burns
+
+	// 先把销毁任务写入持久化队列，再删除元数据；即使中途重启，剩余的密文也会在启动后被继续删除
+	if err := burns.Enqueue(id, reason); err != nil {
+		burnDataLog.Error("Failed to enqueue burn", "id", id, "error", err)
+		return err
 	}
 
-	// 删除上传目录（如果存在），带重试逻辑
-	uploadDir := filepath.Join(config.Paths.FinalUploadDir, id)
-	log.Printf("[BurnData:%s] Attempting to remove upload directory with retries: %s", id, uploadDir)
-	var errUpload error
-	maxRetries := 5
-	retryDelay := 1 * time.Second
-	for i := 0; i < maxRetries; i++ {
-		errUpload = os.RemoveAll(uploadDir)
-		if errUpload == nil || os.IsNotExist(errUpload) {
-			break // Success or directory doesn't exist
-		}
-		log.Printf("[BurnData:%s] Attempt %d/%d: Failed to remove upload directory: %v. Retrying after %v...", id, i+1, maxRetries, errUpload, retryDelay)
-		time.Sleep(retryDelay)
+	// 立即尝试一次；失败的部分留在队列中由后台按退避时间重试
+	if err := burns.Process(id); err != nil {
+		burnDataLog.Warn("Burn incomplete, queued for retry", "id", id, "error", err)
+		return err
 	}
 
-	if errUpload != nil && !os.IsNotExist(errUpload) {
-		log.Printf("[BurnData:%s] Failed to remove upload directory after %d retries: %v", id, maxRetries, errUpload)
-		// Continue
-	} else if errUpload == nil {
-		log.Printf("[BurnData:%s] Successfully removed upload directory.", id)
-	} else { // err is os.IsNotExist
-		log.Printf("[BurnData:%s] Upload directory did not exist.", id)
-	}
+	burnDataLog.Info("Burn completed", "id", id, "reason", reason)
+	return nil
+}
 
-	// 删除临时文件目录（如果存在）
-	tempDir := filepath.Join(config.Paths.TempChunkDir, id)
-	log.Printf("[BurnData:%s] Attempting to remove temporary directory: %s", id, tempDir)
-	errTemp := os.RemoveAll(tempDir)
-	if errTemp != nil && !os.IsNotExist(errTemp) {
-		log.Printf("[BurnData:%s] Failed to remove temporary directory: %v", id, errTemp)
-		// Continue
-	} else if errTemp == nil {
-		log.Printf("[BurnData:%s] Successfully removed temporary directory.", id)
-	} else { // err is os.IsNotExist
-		log.Printf("[BurnData:%s] Temporary directory did not exist.", id)
-	}
+// burnInBackground 在后台销毁数据，关闭服务时等待它完成
+func burnInBackground(config *Config, id string, reason string) {
+	backgroundJobs.Go("burn", func() { burnData(config, id, reason) })
+}
 
-	// Return the first significant error encountered
-	if errMeta != nil && !os.IsNotExist(errMeta) {
-		log.Printf("[BurnData:%s] Burn process completed with error (metadata).", id)
-		return fmt.Errorf("failed to remove metadata file: %w", errMeta)
-	}
-	if errUpload != nil && !os.IsNotExist(errUpload) {
-		log.Printf("[BurnData:%s] Burn process completed with error (upload dir).", id)
-		return fmt.Errorf("failed to remove upload directory: %w", errUpload)
+// canBurn 判断令牌是否允许销毁数据: 管理令牌，或随密文下发的销毁令牌。
+// 早于令牌机制创建的数据两者皆无，保持原来的行为。
+func canBurn(metadata *StoredData, token string) bool {
+	if metadata.ManageTokenHash == "" && metadata.BurnToken == "" {
+		return true
 	}
-	if errTemp != nil && !os.IsNotExist(errTemp) {
-		log.Printf("[BurnData:%s] Burn process completed with error (temp dir).", id)
-		return fmt.Errorf("failed to remove temporary directory: %w", errTemp)
+	if tokenMatchesHash(token, metadata.ManageTokenHash) {
+		return true
 	}
-
-	log.Printf("[BurnData:%s] Burn process completed successfully.", id)
-	return nil
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(metadata.BurnToken)) == 1
 }
 
 // BurnDataHandler handles deleting stored metadata AND the corresponding merged file (if applicable)
-func BurnDataHandler(config *Config) gin.HandlerFunc {
+func BurnDataHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		config := currentConfig()
 		id := c.Param("id")
 		if !IsValidUUID(id) { // Use shared function and check format first
-			log.Printf("[BurnData:%s] Invalid ID format received", id)
+			burnDataLog.Debug("Invalid ID format received", "id", id)
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Data ID format"})
 			return
 		}
 
+		// 只有所有者 (管理令牌) 或者已经拿到密文的读者 (销毁令牌) 可以销毁
+		metadata, err := GetStorageManager().GetMetadata(id)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				burnDataLog.Info("Metadata not found (likely already burned)", "id", id)
+				c.JSON(http.StatusNotFound, gin.H{"error": "数据不存在或已被销毁"})
+			} else {
+				burnDataLog.Error("Error reading metadata", "id", id, "error", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "读取数据失败"})
+			}
+			return
+		}
+		if !canBurn(metadata, bearerToken(c)) {
+			burnDataLog.Warn("Rejected burn request without a valid token", "id", id)
+			c.JSON(http.StatusForbidden, gin.H{"error": "无权销毁此数据"})
+			return
+		}
+
 		// Call the burnData function
-		err := burnData(config, id) // Call the actual burning logic
+		err = burnData(config, id, burnReasonManual) // Call the actual burning logic
 
 		if err != nil {
 			// Log the specific error from burnData
-			log.Printf("[BurnData:%s] Burn process failed: %v", id, err)
+			burnDataLog.Error("Burn process failed", "id", id, "error", err)
 			// Return a generic server error to the client
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to burn data completely."})
 		} else {
 			// Success
-			log.Printf("[BurnData:%s] Data successfully burned via API request.", id)
+			burnDataLog.Debug("Data burned via API request", "id", id)
 			c.JSON(http.StatusOK, gin.H{"message": "Data successfully burned"})
 		}
 	}
 }
 
 // StoreMetadataHandler handles storing metadata after chunk upload completes
-func StoreMetadataHandler(config *Config) gin.HandlerFunc {
+func StoreMetadataHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		config := currentConfig()
 		var requestData StoreMetadataRequest // Use the specific request struct
 		if err := c.ShouldBindJSON(&requestData); err != nil {
-			log.Printf("[StoreMetadata] Error binding JSON: %v", err)
+			storeMetadataLog.Debug("Error binding JSON", "error", err)
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format", "details": err.Error()})
 			return
 		}
 
 		// Basic validation
 		if requestData.ID == "" || requestData.IV == "" || requestData.Salt == "" || requestData.OriginalFilename == "" || requestData.ContentType == "" {
-			log.Printf("[StoreMetadata:%s] Missing required fields (id, iv, salt, originalFilename, contentType)", requestData.ID)
+			storeMetadataLog.Debug("Missing required fields (id, iv, salt, originalFilename, contentType)", "id", requestData.ID)
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required fields", "fields": []string{"id", "iv", "salt", "originalFilename", "contentType"}})
 			return
 		}
+		if requestData.MaxViews < 0 {
+			storeMetadataLog.Debug("Invalid maxViews", "id", requestData.ID, "maxViews", requestData.MaxViews)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid maxViews"})
+			return
+		}
 		// Validate the ID format received in the metadata payload
 		if !IsValidUUID(requestData.ID) {
-			log.Printf("[StoreMetadata] Invalid ID format received in metadata payload: %s", requestData.ID)
+			storeMetadataLog.Debug("Invalid ID format received in metadata payload", "id", requestData.ID)
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Data ID format in payload"})
 			return
 		}
 		// Path traversal check (redundant if IsValidUUID is strict, but good practice)
 		cleanID := filepath.Clean(requestData.ID)
 		if cleanID != requestData.ID || strings.Contains(cleanID, "..") {
-			log.Printf("[StoreMetadata:%s] Potential path traversal detected after cleaning ID from payload ('%s' -> '%s')", requestData.ID, requestData.ID, cleanID)
+			storeMetadataLog.Warn("Potential path traversal detected after cleaning ID from payload", "id", requestData.ID, "cleanId", cleanID)
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Data ID format in payload"})
 			return
 		}
 
-		// Construct metadata file path
 		id := requestData.ID // Use ID from request
-		fileName := id + ".json"
-		filePath := filepath.Join(config.Paths.DataStorageDir, fileName)
+		store := GetStorageManager()
+
+		// 只有合并完成的上传才能保存元数据
+		var digest string
+		session, err := store.uploads.Get(id)
+		if err == nil {
+			if session.State != UploadStateComplete {
+				storeMetadataLog.Info("Upload is not complete, cannot store metadata", "id", id, "state", session.State)
+				c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Upload is %s, cannot save metadata.", session.State), "state": session.State})
+				return
+			}
+			digest = session.Digest
+		}
 
 		// Check if merged file exists before saving metadata (important!)
-		mergedFilePath := filepath.Join(config.Paths.FinalUploadDir, id, requestData.OriginalFilename)
-		fileInfo, err := os.Stat(mergedFilePath)
-		if os.IsNotExist(err) {
-			log.Printf("[StoreMetadata:%s] Error: Merged file %s not found. Cannot store metadata.", id, mergedFilePath)
+		blobInfo, err := store.StatBlob(id, requestData.OriginalFilename)
+		if errors.Is(err, ErrNotFound) {
+			storeMetadataLog.Info("Merged file not found, cannot store metadata", "id", id)
 			c.JSON(http.StatusPreconditionFailed, gin.H{"error": "Merged file not found, cannot save metadata."})
 			return
 		} else if err != nil {
-			log.Printf("[StoreMetadata:%s] Error checking merged file %s: %v", id, mergedFilePath, err)
+			storeMetadataLog.Error("Error checking merged file", "id", id, "error", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error checking merged file status."})
 			return
 		}
-		log.Printf("[StoreMetadata:%s] Merged file found. Size: %d bytes", id, fileInfo.Size())
+		storeMetadataLog.Debug("Merged file found", "id", id, "size", blobInfo.Size)
+
+		// 元数据只能保存一次，否则知道上传 ID 的人可以覆盖它并拿到新的管理令牌
+		if _, err := store.GetMetadata(id); err == nil {
+			storeMetadataLog.Warn("Metadata already exists, refusing to overwrite", "id", id)
+			c.JSON(http.StatusConflict, gin.H{"error": "Metadata already stored for this upload"})
+			return
+		} else if !errors.Is(err, ErrNotFound) {
+			storeMetadataLog.Error("Error checking existing metadata", "id", id, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error saving metadata"})
+			return
+		}
 
 		// --- Expiration Logic ---
 		expirationTimePtr, err := calculateExpirationTime(config, requestData.SetDuration)
 		if err != nil {
-			log.Printf("[StoreMetadata:%s] Error calculating expiration: %v", id, err)
+			storeMetadataLog.Error("Error calculating expiration", "id", id, "error", err)
 			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("计算有效期失败: %v", err)})
 			return
 		}
-		log.Printf("[StoreMetadata:%s] Calculated expiration time: %v", id, expirationTimePtr)
+		storeMetadataLog.Debug("Calculated expiration time", "id", id, "expiresAt", expirationTimePtr)
 		// --- End Expiration Logic ---
 
 		// Create the metadata struct to store
@@ -554,112 +795,149 @@ func StoreMetadataHandler(config *Config) gin.HandlerFunc {
 			PasswordProtection: requestData.PasswordProtection,
 			ExpiresAt:          expirationTimePtr,
 			ContentType:        requestData.ContentType,
-			FileSize:           fileInfo.Size(), // Store the actual file size from stat
+			FileSize:           blobInfo.Size, // Store the actual file size from stat
+			MaxViews:           requestData.MaxViews,
+			SHA256:             digest,
 			// AccessWindowEndsAt and FirstAccessedTime are nil initially
 		}
-
-		// Marshal the metadata to JSON
-		jsonData, err := json.MarshalIndent(metadata, "", "  ")
+		manageToken, err := newOwnerTokens(&metadata)
 		if err != nil {
-			log.Printf("[StoreMetadata:%s] Error marshaling metadata: %v", id, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error preparing metadata"})
-			return
-		}
-
-		// Ensure the directory exists
-		if err := os.MkdirAll(config.Paths.DataStorageDir, 0750); err != nil {
-			log.Printf("[StoreMetadata:%s] Error ensuring data storage directory '%s': %v", id, config.Paths.DataStorageDir, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error ensuring storage directory"})
+			storeMetadataLog.Error("Error generating management token", "id", id, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error saving metadata"})
 			return
 		}
 
-		// Write the JSON metadata to the file
-		if err := os.WriteFile(filePath, jsonData, 0640); err != nil {
-			log.Printf("[StoreMetadata:%s] Error writing metadata file %s: %v", id, filePath, err)
+		// Write the metadata to the storage backend. 上面的检查只是快速失败，
+		// 并发保存同一个上传时由 CreateMetadata 保证只有一个成功
+		if err := store.CreateMetadata(id, &metadata); err != nil {
+			if errors.Is(err, ErrAlreadyExists) {
+				storeMetadataLog.Warn("Metadata already exists, refusing to overwrite", "id", id)
+				c.JSON(http.StatusConflict, gin.H{"error": "Metadata already stored for this upload"})
+				return
+			}
+			storeMetadataLog.Error("Error storing metadata", "id", id, "error", err)
+			if errors.Is(err, ErrStorageFull) {
+				c.JSON(http.StatusInsufficientStorage, gin.H{"error": "Storage is full, please try again later"})
+				return
+			}
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error saving metadata"})
 			return
 		}
 
-		log.Printf("[StoreMetadata:%s] Successfully stored metadata", id)
-		c.JSON(http.StatusOK, gin.H{"message": "Metadata successfully stored", "id": id})
+		storeMetadataLog.Info("Stored file metadata", "id", id)
+		// 上传已转为正式数据，会话不再需要
+		if err := store.uploads.Delete(id); err != nil {
+			storeMetadataLog.Warn("Failed to remove upload session", "id", id, "error", err)
+		}
+		metricItemsStored.WithLabelValues("file").Inc()
+		c.JSON(http.StatusOK, gin.H{"message": "Metadata successfully stored", "id": id, "manageToken": manageToken})
 	}
 }
 
 // DownloadHandler handles downloading the merged encrypted file, checking expiration.
-func DownloadHandler(config *Config) gin.HandlerFunc {
+func DownloadHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		config := currentConfig()
 		id := c.Param("id")
 		if !IsValidUUID(id) {
-			log.Printf("[Download:%s] Invalid ID format received", id)
+			downloadLog.Debug("Invalid ID format received", "id", id)
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Data ID format"})
 			return
 		}
 
 		// 1. Read metadata to get the original filename and check expiration
-		metaFileName := id + ".json"
-		metaFilePath := filepath.Join(config.Paths.DataStorageDir, metaFileName)
-
-		jsonData, err := os.ReadFile(metaFilePath)
+		store := GetStorageManager()
+		metadata, err := store.GetMetadata(id)
 		if err != nil {
-			if os.IsNotExist(err) {
-				log.Printf("[Download:%s] Metadata file not found: %s", id, metaFilePath)
+			if errors.Is(err, ErrNotFound) {
+				downloadLog.Info("Metadata not found", "id", id)
 				c.JSON(http.StatusNotFound, gin.H{"error": "数据不存在或已被销毁"})
 			} else {
-				log.Printf("[Download:%s] Error reading metadata file %s: %v", id, metaFilePath, err)
+				downloadLog.Error("Error reading metadata", "id", id, "error", err)
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "读取元数据失败"})
 			}
 			return
 		}
 
-		var metadata StoredData
-		if err := json.Unmarshal(jsonData, &metadata); err != nil {
-			log.Printf("[Download:%s] Error unmarshaling metadata: %v. Assuming invalid state.", id, err)
-			c.JSON(http.StatusNotFound, gin.H{"error": "数据格式无效或已损坏"})
-			return
-		}
-
 		// --- Expiration Checks ---
 		now := time.Now()
 		// Primary Expiration
 		if metadata.ExpiresAt != nil && now.After(*metadata.ExpiresAt) {
-			log.Printf("[Download:%s] Primary expiration time (%s) has passed. Burning data.", id, (*metadata.ExpiresAt).Format(time.RFC3339))
-			go burnData(config, id) // Burn in background
+			downloadLog.Info("Primary expiration time has passed, burning data", "id", id, "expiresAt", *metadata.ExpiresAt)
+			burnInBackground(config, id, burnReasonExpired) // Burn in background
 			c.JSON(http.StatusNotFound, gin.H{"error": "数据不存在或已被销毁"})
 			return
 		}
 		// Access Window Expiration (check only, don't set on download)
 		if config.Expiration.Enabled && config.Expiration.AccessWindow.Enabled && metadata.AccessWindowEndsAt != nil && now.After(*metadata.AccessWindowEndsAt) {
-			log.Printf("[Download:%s] Access window expired at %s. Burning data.", id, (*metadata.AccessWindowEndsAt).Format(time.RFC3339))
-			go burnData(config, id) // Burn in background
+			downloadLog.Info("Access window expired, burning data", "id", id, "accessWindowEndsAt", *metadata.AccessWindowEndsAt)
+			burnInBackground(config, id, burnReasonAccessWindow) // Burn in background
 			c.JSON(http.StatusNotFound, gin.H{"error": "数据不存在或已被销毁"})
 			return
 		}
 		// --- End Expiration Checks ---
 
 		if metadata.OriginalFilename == "" {
-			log.Printf("[Download:%s] Metadata indicates text data, cannot download file.", id)
+			downloadLog.Info("Metadata indicates text data, cannot download file", "id", id)
 			c.JSON(http.StatusNotFound, gin.H{"error": "无法下载：此ID关联的是文本数据"})
 			return
 		}
 
-		// 2. Construct path to the merged file
-		mergedFilePath := filepath.Join(config.Paths.FinalUploadDir, id, metadata.OriginalFilename)
-
-		// 3. Check if file exists
-		fileInfo, err := os.Stat(mergedFilePath)
-		if os.IsNotExist(err) {
-			log.Printf("[Download:%s] Merged file not found: %s", id, mergedFilePath)
+		// 2. Open the merged file
+		blob, blobInfo, err := store.OpenBlob(id, metadata.OriginalFilename)
+		if errors.Is(err, ErrNotFound) {
+			downloadLog.Error("Merged file not found", "id", id)
 			// Attempt to burn metadata if file is missing (consistency)
-			go burnData(config, id)
+			burnInBackground(config, id, burnReasonOrphaned)
 			c.JSON(http.StatusNotFound, gin.H{"error": "无法下载：加密文件不存在（可能已被销毁）"})
 			return
 		} else if err != nil {
-			log.Printf("[Download:%s] Error stating merged file %s: %v", id, mergedFilePath, err)
+			downloadLog.Error("Error opening merged file", "id", id, "error", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "访问加密文件时出错"})
 			return
 		}
+		defer blob.Close()
+
+		etag := ""
+		if metadata.SHA256 != "" {
+			etag = `"` + metadata.SHA256 + `"`
+		}
+
+		// 计入一次查看: 完整下载或从 0 开始的范围请求算一次。断点续传 (带 If-Range 的 bytes=N-)
+		// 只在上一次计入的下载开始后 resumeGracePeriod 内不计次数，之后按新的下载处理，次数用完时拒绝。
+		// 最后一次查看在文件最后一个字节发出后销毁，传输中断时数据保留到续传期限结束。
+		remaining := metadata.RemainingViews()
+		resumed := isResumedDownload(c.Request, etag) && metadata.ResumeUntil != nil && now.Before(*metadata.ResumeUntil)
+		if !resumed {
+			remaining, err = consumeView(id, resumeGracePeriod)
+		}
+		if err != nil {
+			if errors.Is(err, errViewsExhausted) || errors.Is(err, ErrNotFound) {
+				downloadLog.Info("View limit reached or data burned concurrently", "id", id)
+				// 最后一次下载仍可续传时不销毁，到期后由到期清理销毁
+				if metadata.ResumeUntil == nil || !now.Before(*metadata.ResumeUntil) {
+					burnInBackground(config, id, burnReasonRead)
+				}
+				c.JSON(http.StatusNotFound, gin.H{"error": "数据不存在或已被销毁"})
+			} else {
+				downloadLog.Error("Error recording view", "id", id, "error", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "读取元数据失败"})
+			}
+			return
+		}
+		if remaining >= 0 {
+			c.Header("X-Remaining-Views", strconv.Itoa(remaining))
+		}
+		if metadata.BurnToken != "" {
+			c.Header("X-Burn-Token", metadata.BurnToken)
+		}
+		// 密文摘要，接收方可据此发现传输或存储中的损坏
+		if sum, err := hex.DecodeString(metadata.SHA256); err == nil && len(sum) == sha256.Size {
+			c.Header("Digest", "sha-256="+base64.StdEncoding.EncodeToString(sum))
+			c.Header("ETag", etag)
+		}
 
-		// 4. Stream the file
+		// 3. Stream the file
 		c.Header("Content-Description", "File Transfer")
 		c.Header("Content-Transfer-Encoding", "binary")
 		// Use ContentType from metadata if available, otherwise octet-stream
@@ -669,11 +947,23 @@ func DownloadHandler(config *Config) gin.HandlerFunc {
 		}
 		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.enc\"", metadata.OriginalFilename)) // Suggest adding .enc extension
 		c.Header("Content-Type", contentTypeHeader)
-		c.Header("Content-Length", fmt.Sprintf("%d", fileInfo.Size()))
 
-		c.File(mergedFilePath)
-		log.Printf("[Download:%s] Started streaming file %s", id, mergedFilePath)
+		// http.ServeContent sets Content-Length and handles Range requests
+		downloadLog.Info("Started streaming file", "id", id, "size", blobInfo.Size, "resumed", resumed)
+		http.ServeContent(c.Writer, c.Request, metadata.OriginalFilename, blobInfo.ModTime, blob)
+		if !resumed {
+			metricReads.WithLabelValues("file").Inc()
+		}
+
+		if remaining == 0 && !downloadCompleted(c.Writer, blobInfo.Size) {
+			downloadLog.Info("Last download not finished, keeping data for resume", "id", id, "grace", resumeGracePeriod)
+		} else if remaining == 0 {
+			downloadLog.Info("View limit reached, burning data", "id", id)
+			if err := burnData(config, id, burnReasonRead); err != nil {
+				downloadLog.Warn("Burn after last download incomplete", "id", id, "error", err)
+			}
+		}
 
-		// Note: After c.File(), you cannot reliably write JSON errors if streaming fails midway.
+		// Note: After ServeContent, you cannot reliably write JSON errors if streaming fails midway.
 	}
 }
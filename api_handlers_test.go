@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// setupTestStorage 用临时目录 (或纯内存) 初始化全局配置和存储管理器，测试结束后恢复。
+// 配置与启动时一样补上默认值，分片大小为 1MB，单个文件上限 8MB。
+func setupTestStorage(t *testing.T, mode string) *Config {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := &Config{}
+	cfg.Paths.DataStorageDir = filepath.Join(dir, "meta")
+	cfg.Paths.FinalUploadDir = filepath.Join(dir, "uploads")
+	cfg.Paths.TempChunkDir = filepath.Join(dir, "chunks")
+	cfg.Storage.Mode = mode
+	cfg.Storage.Memory.MaxSizeMB = 16
+	cfg.Server.MaxFileSizeMB = 8
+	cfg.Upload.ChunkSizeMB = 1
+	if err := validateAndNormalizeConfig(cfg); err != nil {
+		t.Fatalf("validateAndNormalizeConfig: %v", err)
+	}
+
+	configLock.Lock()
+	previous := config
+	config = cfg
+	configLock.Unlock()
+	managerLock.Lock()
+	storageManager = nil
+	managerLock.Unlock()
+
+	if err := InitStorage(cfg); err != nil {
+		t.Fatalf("InitStorage: %v", err)
+	}
+	t.Cleanup(func() {
+		// 等待后台销毁结束，再删除临时目录
+		waitBackgroundJobs(t)
+
+		managerLock.Lock()
+		storageManager = nil
+		managerLock.Unlock()
+		configLock.Lock()
+		config = previous
+		configLock.Unlock()
+	})
+	return cfg
+}
+
+// serveTestRequest 用只注册了 route 的 gin 引擎处理 req
+func serveTestRequest(method, route string, handler gin.HandlerFunc, req *http.Request) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Handle(method, route, handler)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// waitBackgroundJobs 等待后台任务 (例如 burnInBackground) 结束
+func waitBackgroundJobs(t *testing.T) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := backgroundJobs.Wait(ctx); err != nil {
+		t.Fatalf("background jobs still running: %v", err)
+	}
+}
+
+// revealConcurrently 同时发出 n 个 reveal 请求，返回拿到密文的响应数
+func revealConcurrently(t *testing.T, id string, n int) int {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/api/data/:id/reveal", GetDataHandler())
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	recorders := make([]*httptest.ResponseRecorder, n)
+	for i := range recorders {
+		recorders[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(w *httptest.ResponseRecorder) {
+			defer wg.Done()
+			<-start
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/data/"+id+"/reveal", nil))
+		}(recorders[i])
+	}
+	close(start)
+	wg.Wait()
+
+	revealed := 0
+	for _, w := range recorders {
+		switch w.Code {
+		case http.StatusOK:
+			var body struct {
+				EncryptedData string `json:"encryptedData"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("decode reveal response: %v", err)
+			}
+			if body.EncryptedData != "" {
+				revealed++
+			}
+		case http.StatusNotFound:
+		default:
+			t.Fatalf("reveal returned %d: %s", w.Code, w.Body.String())
+		}
+	}
+	return revealed
+}
+
+func TestRevealConcurrently(t *testing.T) {
+	cases := []struct {
+		name string
+		data StoredData
+		want int
+	}{
+		{"burnOnRead", StoredData{BurnOnRead: true}, 1},
+		{"maxViews=1", StoredData{MaxViews: 1}, 1},
+		{"maxViews=3", StoredData{MaxViews: 3}, 3},
+	}
+	for _, mode := range []string{StorageModePersistent, StorageModeMemory} {
+		for _, tc := range cases {
+			t.Run(mode+"/"+tc.name, func(t *testing.T) {
+				setupTestStorage(t, mode)
+				const id = "0b7e6a52-3c1d-4f8e-9a2b-5d6c7e8f9a0b"
+				data := tc.data
+				data.EncryptedData = "ciphertext"
+				data.IV = "iv"
+				if err := GetStorageManager().CreateMetadata(id, &data); err != nil {
+					t.Fatalf("CreateMetadata: %v", err)
+				}
+
+				if got := revealConcurrently(t, id, 16); got != tc.want {
+					t.Fatalf("%d concurrent reveals returned the data, want %d", got, tc.want)
+				}
+				if got := revealConcurrently(t, id, 1); got != 0 {
+					t.Fatalf("data still readable after it should have been burned")
+				}
+			})
+		}
+	}
+}
+
+// storeTestFile 保存一个文件 (元数据和加密文件)，返回下载时的 ETag
+func storeTestFile(t *testing.T, id string, content []byte, data StoredData) string {
+	t.Helper()
+	store := GetStorageManager()
+	sum := sha256.Sum256(content)
+	data.OriginalFilename = "file.bin"
+	data.FileSize = int64(len(content))
+	data.SHA256 = hex.EncodeToString(sum[:])
+	if err := store.CreateMetadata(id, &data); err != nil {
+		t.Fatalf("CreateMetadata: %v", err)
+	}
+	blob, err := store.CreateBlob(id, data.OriginalFilename)
+	if err != nil {
+		t.Fatalf("CreateBlob: %v", err)
+	}
+	blob.Write(content)
+	if err := blob.Close(); err != nil {
+		t.Fatalf("close blob: %v", err)
+	}
+	return `"` + data.SHA256 + `"`
+}
+
+// download 请求 GET /api/download/:id，headers 依次为名称和值
+func download(id string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/api/download/"+id, nil)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	return serveTestRequest(http.MethodGet, "/api/download/:id", DownloadHandler(), req)
+}
+
+func TestDownloadViewLimit(t *testing.T) {
+	setupTestStorage(t, StorageModePersistent)
+	const id = "2c4e6a8b-1d3f-4a5b-8c7d-9e0f1a2b3c4d"
+	content := []byte("encrypted file contents")
+	storeTestFile(t, id, content, StoredData{MaxViews: 2})
+
+	for view, want := range []string{"1", "0"} {
+		w := download(id)
+		if w.Code != http.StatusOK || w.Body.String() != string(content) {
+			t.Fatalf("download %d: %d %q", view+1, w.Code, w.Body.String())
+		}
+		if got := w.Header().Get("X-Remaining-Views"); got != want {
+			t.Fatalf("download %d: X-Remaining-Views = %q, want %q", view+1, got, want)
+		}
+	}
+	if w := download(id); w.Code != http.StatusNotFound {
+		t.Fatalf("download after the last view returned %d", w.Code)
+	}
+	if _, err := GetStorageManager().GetMetadata(id); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("data not burned after the last complete download: %v", err)
+	}
+}
+
+func TestDownloadResumeAfterLastView(t *testing.T) {
+	content := []byte("0123456789abcdefghij")
+	cases := []struct {
+		name    string
+		headers func(etag string) []string
+		expire  bool // 续传期限已过
+		want    int
+	}{
+		{"resume", func(etag string) []string { return []string{"Range", "bytes=10-", "If-Range", etag} }, false, http.StatusPartialContent},
+		{"resume after grace", func(etag string) []string { return []string{"Range", "bytes=10-", "If-Range", etag} }, true, http.StatusNotFound},
+		{"no If-Range", func(string) []string { return []string{"Range", "bytes=10-"} }, false, http.StatusNotFound},
+		{"wrong If-Range", func(string) []string { return []string{"Range", "bytes=10-", "If-Range", `"other"`} }, false, http.StatusNotFound},
+		{"suffix range", func(etag string) []string { return []string{"Range", "bytes=-10", "If-Range", etag} }, false, http.StatusNotFound},
+		{"multiple ranges", func(etag string) []string { return []string{"Range", "bytes=10-11,12-", "If-Range", etag} }, false, http.StatusNotFound},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			setupTestStorage(t, StorageModePersistent)
+			const id = "3d5f7b9c-2e4a-4b6c-9d8e-0f1a2b3c4d5e"
+			etag := storeTestFile(t, id, content, StoredData{MaxViews: 1})
+
+			// 最后一次查看只下载了前 10 个字节: 数据保留给续传
+			if w := download(id, "Range", "bytes=0-9"); w.Code != http.StatusPartialContent || w.Header().Get("X-Remaining-Views") != "0" {
+				t.Fatalf("first ranged download: %d, remaining %q", w.Code, w.Header().Get("X-Remaining-Views"))
+			}
+			if tc.expire {
+				if _, err := GetStorageManager().UpdateMetadata(id, func(stored *StoredData) error {
+					past := time.Now().Add(-time.Second)
+					stored.ResumeUntil = &past
+					return nil
+				}); err != nil {
+					t.Fatalf("UpdateMetadata: %v", err)
+				}
+			}
+
+			w := download(id, tc.headers(etag)...)
+			if w.Code != tc.want {
+				t.Fatalf("download returned %d, want %d", w.Code, tc.want)
+			}
+			if tc.want == http.StatusPartialContent && w.Body.String() != string(content[10:]) {
+				t.Fatalf("resumed body = %q", w.Body.String())
+			}
+			waitBackgroundJobs(t)
+
+			stored, err := GetStorageManager().GetMetadata(id)
+			if tc.want == http.StatusPartialContent || tc.expire {
+				// 续传完成，或续传期限已过: 数据已被销毁
+				if !errors.Is(err, ErrNotFound) {
+					t.Fatalf("data not burned: %v", err)
+				}
+				return
+			}
+			// 被拒绝的请求不计次数，也不能让真正的续传失效
+			if err != nil || stored.Views != 1 {
+				t.Fatalf("metadata after refused request: %+v, %v", stored, err)
+			}
+			if w := download(id, "Range", "bytes=10-", "If-Range", etag); w.Code != http.StatusPartialContent {
+				t.Fatalf("genuine resume after a refused request returned %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestStoreDataHandlerUsesStorageBackend(t *testing.T) {
+	cfg := setupTestStorage(t, StorageModePersistent)
+	body := `{"encryptedData": "ciphertext", "iv": "iv", "salt": "salt"}`
+	req := httptest.NewRequest(http.MethodPost, "/api/store", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := serveTestRequest(http.MethodPost, "/api/store", StoreDataHandler(), req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("store returned %d: %s", w.Code, w.Body.String())
+	}
+	var response struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || !IsValidUUID(response.ID) {
+		t.Fatalf("store response %s: %v", w.Body.String(), err)
+	}
+
+	// 文件系统后端保持原来的布局: <data_storage_dir>/<id>.json
+	if _, err := os.Stat(filepath.Join(cfg.Paths.DataStorageDir, response.ID+".json")); err != nil {
+		t.Fatalf("metadata file not written by the filesystem backend: %v", err)
+	}
+	stored, err := GetStorageManager().GetMetadata(response.ID)
+	if err != nil || stored.EncryptedData != "ciphertext" {
+		t.Fatalf("GetMetadata = %+v, %v", stored, err)
+	}
+}
+
+func TestPeekHasNoSideEffects(t *testing.T) {
+	cfg := setupTestStorage(t, StorageModePersistent)
+	cfg.Expiration.Enabled = true
+	cfg.Expiration.AccessWindow.Enabled = true
+	cfg.Expiration.AccessWindow.DefaultDuration = "10m"
+	const id = "5f7b9d1e-4a6c-4d8e-9f0a-2b3c4d5e6f7a"
+	if err := GetStorageManager().CreateMetadata(id, &StoredData{EncryptedData: "ciphertext", IV: "iv", MaxViews: 2}); err != nil {
+		t.Fatalf("CreateMetadata: %v", err)
+	}
+	peek := func() map[string]any {
+		t.Helper()
+		w := serveTestRequest(http.MethodGet, "/api/data/:id", PeekDataHandler(), httptest.NewRequest(http.MethodGet, "/api/data/"+id, nil))
+		var body map[string]any
+		if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &body) != nil {
+			t.Fatalf("peek returned %d: %s", w.Code, w.Body.String())
+		}
+		return body
+	}
+
+	// 预览只返回概要信息，不计入查看次数，也不开始访问窗口
+	for i := 0; i < 3; i++ {
+		body := peek()
+		if _, ok := body["encryptedData"]; ok || body["type"] != "text" || body["remainingViews"] != float64(2) {
+			t.Fatalf("peek %d = %v", i+1, body)
+		}
+	}
+	stored, err := GetStorageManager().GetMetadata(id)
+	if err != nil || stored.Views != 0 || stored.FirstAccessedTime != nil || stored.AccessWindowEndsAt != nil {
+		t.Fatalf("metadata after peek: %+v, %v", stored, err)
+	}
+
+	if got := revealConcurrently(t, id, 1); got != 1 {
+		t.Fatalf("reveal did not return the data")
+	}
+	stored, err = GetStorageManager().GetMetadata(id)
+	if err != nil || stored.Views != 1 || stored.FirstAccessedTime == nil || stored.AccessWindowEndsAt == nil {
+		t.Fatalf("metadata after reveal: %+v, %v", stored, err)
+	}
+	if body := peek(); body["remainingViews"] != float64(1) {
+		t.Fatalf("peek after reveal = %v", body)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	burnRetryBaseDelay = 2 * time.Second
+	burnRetryMaxDelay  = 10 * time.Minute
+)
+
+// burnTask 是销毁队列中的一项，在元数据删除之前持久化，直到密文确实被删除
+type burnTask struct {
+	ID          string    `json:"id"`
+	Reason      string    `json:"reason,omitempty"`
+	EnqueuedAt  time.Time `json:"enqueuedAt"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"lastError,omitempty"`
+	NextAttempt time.Time `json:"nextAttempt"`
+}
+
+// BurnQueueStats 描述销毁队列的当前状态
+type BurnQueueStats struct {
+	Depth    int         `json:"depth"`    // 尚未完成的销毁任务数
+	Failing  int         `json:"failing"`  // 至少失败过一次、仍在重试的任务数
+	Failures int64       `json:"failures"` // 自启动以来失败的尝试总数
+	Tasks    []*burnTask `json:"tasks"`    // 尚未完成的任务，按入队时间排序
+}
+
+// burnQueue 是持久化的销毁队列。每个任务保存为 dir 下的一个 JSON 文件，
+// 进程重启后会继续处理；dir 为空时 (纯内存模式) 只保存在内存中。
+type burnQueue struct {
+	mu       sync.Mutex
+	dir      string
+	store    Storage
+	tasks    map[string]*burnTask
+	failures int64
+	wake     chan struct{}
+}
+
+func newBurnQueue(dir string, store Storage) *burnQueue {
+	return &burnQueue{
+		dir:   dir,
+		store: store,
+		tasks: make(map[string]*burnTask),
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// Load 读取上次运行时未完成的销毁任务
+func (q *burnQueue) Load() error {
+	if q.dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(q.dir, 0750); err != nil {
+		return fmt.Errorf("创建销毁队列目录失败: %w", err)
+	}
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return fmt.Errorf("读取销毁队列目录失败: %w", err)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(q.dir, entry.Name()))
+		if err != nil {
+			burnQueueLog.Error("Failed to read task file", "file", entry.Name(), "error", err)
+			continue
+		}
+		var task burnTask
+		if err := json.Unmarshal(data, &task); err != nil || task.ID == "" {
+			burnQueueLog.Warn("Skipping invalid task file", "file", entry.Name(), "error", err)
+			continue
+		}
+		q.tasks[task.ID] = &task
+	}
+	if len(q.tasks) > 0 {
+		burnQueueLog.Info("Resuming pending burns from previous run", "count", len(q.tasks))
+	}
+	return nil
+}
+
+func (q *burnQueue) taskPath(id string) string {
+	return filepath.Join(q.dir, id+".json")
+}
+
+// persistLocked 原子地写入任务文件 (调用者须持有 mu)
+func (q *burnQueue) persistLocked(task *burnTask) error {
+	if q.dir == "" {
+		return nil
+	}
+	data, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	path := q.taskPath(task.ID)
+	tempFile := path + ".tmp"
+	if err := os.WriteFile(tempFile, data, 0640); err != nil {
+		return err
+	}
+	if err := os.Rename(tempFile, path); err != nil {
+		os.Remove(tempFile)
+		return err
+	}
+	return nil
+}
+
+// Enqueue 持久化一个销毁任务。只有在它返回成功后才能删除元数据。
+func (q *burnQueue) Enqueue(id, reason string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.tasks[id]; ok {
+		return nil // Already pending
+	}
+	now := time.Now()
+	task := &burnTask{ID: id, Reason: reason, EnqueuedAt: now, NextAttempt: now}
+	if err := q.persistLocked(task); err != nil {
+		return fmt.Errorf("持久化销毁任务失败: %w", err)
+	}
+	q.tasks[id] = task
+	return nil
+}
+
+// Process 立即执行一次 id 的销毁。失败的任务留在队列中，由后台按退避时间重试。
+func (q *burnQueue) Process(id string) error {
+	q.mu.Lock()
+	var reason string
+	if task, ok := q.tasks[id]; ok {
+		reason = task.Reason
+	}
+	q.mu.Unlock()
+
+	err := q.burn(id, reason)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	task, ok := q.tasks[id]
+	if !ok {
+		return err // Completed concurrently by the worker
+	}
+	if err == nil {
+		delete(q.tasks, id)
+		if q.dir != "" {
+			if rmErr := os.Remove(q.taskPath(id)); rmErr != nil && !os.IsNotExist(rmErr) {
+				burnQueueLog.Error("Failed to remove task file", "id", id, "error", rmErr)
+			}
+		}
+		return nil
+	}
+
+	task.Attempts++
+	task.LastError = err.Error()
+	delay := burnRetryBaseDelay << min(task.Attempts-1, 16)
+	if delay > burnRetryMaxDelay {
+		delay = burnRetryMaxDelay
+	}
+	task.NextAttempt = time.Now().Add(delay)
+	q.failures++
+	if perr := q.persistLocked(task); perr != nil {
+		burnQueueLog.Error("Failed to persist retry state", "id", id, "error", perr)
+	}
+	burnQueueLog.Warn("Burn attempt failed, retrying later", "id", id, "attempt", task.Attempts, "error", err, "retryIn", delay)
+	q.notify()
+	return err
+}
+
+// burn 删除元数据、加密文件和未合并的分片。每一步都是幂等的，可以安全重试。
+// 只有真正删除了元数据的那一次会计入 biu_burns_total。
+func (q *burnQueue) burn(id, reason string) error {
+	var errs []error
+	if err := q.store.DeleteMetadata(id); err == nil {
+		if reason != "" { // Tasks persisted before reasons were recorded are not counted
+			metricBurns.WithLabelValues(reason).Inc()
+		}
+	} else if !errors.Is(err, ErrNotFound) {
+		errs = append(errs, fmt.Errorf("failed to remove metadata: %w", err))
+	}
+	if err := q.store.RemoveBlob(id); err != nil {
+		errs = append(errs, fmt.Errorf("failed to remove encrypted file: %w", err))
+	}
+	if err := q.store.RemoveChunks(id); err != nil {
+		errs = append(errs, fmt.Errorf("failed to remove pending chunks: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+func (q *burnQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dueTasks 返回所有到了重试时间的任务 id，以及下一个任务的重试时间
+func (q *burnQueue) dueTasks(now time.Time) ([]string, time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var due []string
+	var next time.Time
+	for id, task := range q.tasks {
+		if !task.NextAttempt.After(now) {
+			due = append(due, id)
+		} else if next.IsZero() || task.NextAttempt.Before(next) {
+			next = task.NextAttempt
+		}
+	}
+	return due, next
+}
+
+// run 在后台按退避时间重试未完成的销毁任务，stop 关闭后退出；剩余任务在下次启动时继续
+func (q *burnQueue) run(stop <-chan struct{}) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-q.wake:
+		case <-stop:
+			return
+		}
+
+		due, next := q.dueTasks(time.Now())
+		for _, id := range due {
+			if err := q.Process(id); err == nil {
+				burnQueueLog.Info("Pending burn completed", "id", id)
+			}
+		}
+
+		// Process may have rescheduled tasks; recompute the next wake-up
+		if len(due) > 0 {
+			_, next = q.dueTasks(time.Now())
+		}
+		wait := time.Hour
+		if !next.IsZero() {
+			wait = time.Until(next)
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+	}
+}
+
+// Stats 返回队列深度、失败次数以及所有未完成的任务
+func (q *burnQueue) Stats() BurnQueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stats := BurnQueueStats{Depth: len(q.tasks), Failures: q.failures, Tasks: make([]*burnTask, 0, len(q.tasks))}
+	for _, task := range q.tasks {
+		if task.Attempts > 0 {
+			stats.Failing++
+		}
+		taskCopy := *task
+		stats.Tasks = append(stats.Tasks, &taskCopy)
+	}
+	sort.Slice(stats.Tasks, func(i, j int) bool {
+		return stats.Tasks[i].EnqueuedAt.Before(stats.Tasks[j].EnqueuedAt)
+	})
+	return stats
+}
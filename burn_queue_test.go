@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// flakyBlobStorage 在前 failures 次删除加密文件时返回错误
+type flakyBlobStorage struct {
+	Storage
+	failures int
+}
+
+func (s *flakyBlobStorage) RemoveBlob(id string) error {
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("blob store unavailable")
+	}
+	return s.Storage.RemoveBlob(id)
+}
+
+func TestBurnQueueRetriesUntilBlobRemoved(t *testing.T) {
+	dir := t.TempDir()
+	backend := newFileStorage(filepath.Join(dir, "meta"), filepath.Join(dir, "blobs"), filepath.Join(dir, "chunks"))
+	store := &flakyBlobStorage{Storage: backend, failures: 2}
+	queueDir := filepath.Join(dir, "burn-queue")
+
+	const id = "9d8c7b6a-5f4e-4d3c-8b2a-1f0e9d8c7b6a"
+	if err := store.PutMetadata(id, &StoredData{IV: "iv"}); err != nil {
+		t.Fatalf("PutMetadata: %v", err)
+	}
+	blob, err := store.CreateBlob(id, "file.bin")
+	if err != nil {
+		t.Fatalf("CreateBlob: %v", err)
+	}
+	blob.Write([]byte("ciphertext"))
+	blob.Close()
+
+	queue := newBurnQueue(queueDir, store)
+	if err := queue.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if err := queue.Enqueue(id, burnReasonManual); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+
+	// 第一次失败: 元数据已删除，任务留在队列中并按退避时间重试
+	before := time.Now()
+	if err := queue.Process(id); err == nil {
+		t.Fatalf("Process succeeded although RemoveBlob failed")
+	}
+	if _, err := store.GetMetadata(id); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("metadata not removed on first attempt: %v", err)
+	}
+	stats := queue.Stats()
+	if stats.Depth != 1 || stats.Failing != 1 || stats.Failures != 1 {
+		t.Fatalf("stats after failure = %+v", stats)
+	}
+	task := stats.Tasks[0]
+	if task.Attempts != 1 || task.LastError == "" || task.NextAttempt.Before(before.Add(burnRetryBaseDelay)) {
+		t.Fatalf("task after failure = %+v", task)
+	}
+	if due, _ := queue.dueTasks(time.Now()); len(due) != 0 {
+		t.Fatalf("failed task due again before its backoff: %v", due)
+	}
+
+	// 重启后从持久化的任务文件继续，退避时间逐次加倍
+	queue = newBurnQueue(queueDir, store)
+	if err := queue.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if err := queue.Process(id); err == nil {
+		t.Fatalf("Process succeeded although RemoveBlob failed")
+	}
+	task = queue.Stats().Tasks[0]
+	if task.Attempts != 2 || task.NextAttempt.Before(time.Now().Add(2*burnRetryBaseDelay-time.Second)) {
+		t.Fatalf("task after second failure = %+v", task)
+	}
+	if due, _ := queue.dueTasks(task.NextAttempt); len(due) != 1 {
+		t.Fatalf("task not due at its retry time")
+	}
+
+	if err := queue.Process(id); err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	if stats := queue.Stats(); stats.Depth != 0 || stats.Failures != 1 {
+		t.Fatalf("stats after success = %+v", stats)
+	}
+	if _, err := os.Stat(filepath.Join(queueDir, id+".json")); !os.IsNotExist(err) {
+		t.Fatalf("task file left behind: %v", err)
+	}
+	if _, _, err := backend.OpenBlob(id, "file.bin"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("blob still present after burn: %v", err)
+	}
+}
@@ -1,18 +1,20 @@
 package main
 
 import (
+	"context"
 	"crypto/md5"
 	cryptoRand "crypto/rand" // Alias for crypto/rand
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	mathRand "math/rand" // Alias for math/rand
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -27,6 +29,32 @@ type ChunkInfo struct {
 	FileSize    int64  `json:"fileSize"`    // 文件总大小
 }
 
+// UploadStatusResponse 是 /api/upload/status 的响应，如实反映上传会话的状态
+type UploadStatusResponse struct {
+	Success        bool            `json:"success"`
+	Message        string          `json:"message,omitempty"`
+	UploadID       string          `json:"uploadId"`
+	State          string          `json:"state"`                   // initialized, receiving, merging, complete 或 failed
+	FailureReason  string          `json:"failureReason,omitempty"` // State 为 failed 时的原因代码
+	FailureDetail  string          `json:"failureDetail,omitempty"`
+	FileName       string          `json:"fileName"`
+	FileSize       int64           `json:"fileSize"`
+	TotalChunks    int             `json:"totalChunks"`
+	ReceivedChunks int             `json:"receivedChunks"`
+	ReceivedBytes  int64           `json:"receivedBytes"`
+	Chunks         []ReceivedChunk `json:"chunks"` // 已接收的分片，按编号排序
+	CreatedAt      time.Time       `json:"createdAt"`
+	FilePath       string          `json:"filePath,omitempty"`
+	Digest         string          `json:"digest,omitempty"` // 上传完成后最终密文的 SHA-256
+	Completed      bool            `json:"completed"`
+}
+
+// ReceivedChunk 描述一个已接收的分片
+type ReceivedChunk struct {
+	Number int   `json:"number"`
+	Size   int64 `json:"size"`
+}
+
 // ChunkResponse 返回给客户端的响应
 type ChunkResponse struct {
 	Success   bool   `json:"success"`
@@ -36,9 +64,19 @@ type ChunkResponse struct {
 	Completed bool   `json:"completed,omitempty"`
 }
 
-// mergeMutex 用于保护文件合并过程的互斥锁
-// 确保同一时间只有一个合并操作在进行，防止并发问题
-var mergeMutex sync.Mutex
+// InitUploadResponse 是 /api/upload/init 的响应，告诉客户端服务器要求的上传参数
+type InitUploadResponse struct {
+	Success     bool   `json:"success"`
+	Message     string `json:"message,omitempty"`
+	UploadID    string `json:"uploadId"`
+	CancelToken string `json:"cancelToken"` // 只返回一次，用于 DELETE /api/upload/:uploadId
+	ChunkSize   int64  `json:"chunkSize"`   // 除最后一个分片外每个分片必须正好是这么大
+	TotalChunks int    `json:"totalChunks"` // 本次上传的分片数
+	MaxChunks   int    `json:"maxChunks"`   // 单个上传最多的分片数
+	MaxFileSize int64  `json:"maxFileSize"` // 单个上传 (加密后) 的最大字节数
+	Parallelism int    `json:"parallelism"` // 同时上传的分片数上限，超出的请求返回 429
+	SessionTTL  int64  `json:"sessionTtl"`  // 秒；上传在最后一次活动后保留多久，0 表示不会被回收
+}
 
 // 初始化随机数生成器
 func init() {
@@ -46,10 +84,12 @@ func init() {
 	mathRand.Seed(time.Now().UnixNano())
 }
 
-// ChunkUploadHandler 处理分片上传请求 (Exported)
+// ChunkUploadHandler 处理 multipart/form-data 格式的分片上传请求 (Exported)，
+// 保留给旧客户端；新客户端使用不做 multipart 解析的 RawChunkUploadHandler
 // ChunkUploadHandler handles receiving individual file chunks.
-func ChunkUploadHandler(config *Config) gin.HandlerFunc { // Accept config
-	return func(c *gin.Context) { // Return the actual handler
+func ChunkUploadHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		config := currentConfig()
 		// 确保目录存在
 		// ensureDirectoriesExist() // 可以在 main 函数开始时调用一次
 
@@ -72,13 +112,13 @@ func ChunkUploadHandler(config *Config) gin.HandlerFunc { // Accept config
 		fileName = filepath.Base(originalFileName) // Extract only the filename part
 		// Basic validation for the cleaned filename
 		if fileName == "" || fileName == "." || fileName == ".." {
-			log.Printf("[ChunkUpload:%s] Invalid filename received after cleaning: '%s' (original: '%s')", uploadID, fileName, originalFileName)
+			chunkUploadLog.Debug("Invalid filename received after cleaning", "uploadId", uploadID)
 			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid file name provided"})
 			return
 		}
 		// Log the cleaned filename being used
 		if fileName != originalFileName {
-			log.Printf("[ChunkUpload:%s] Sanitized filename from '%s' to '%s'", uploadID, originalFileName, fileName)
+			chunkUploadLog.Debug("Sanitized filename", "uploadId", uploadID)
 		}
 		// --- End Security ---
 
@@ -88,7 +128,7 @@ func ChunkUploadHandler(config *Config) gin.HandlerFunc { // Accept config
 		if uploadID == "" {
 			missingParams = append(missingParams, "uploadId")
 		} else if !IsValidUploadID(uploadID) { // --- Use shared validation ---
-			log.Printf("[ChunkUpload] Invalid uploadId format received: %s", uploadID)
+			chunkUploadLog.Debug("Invalid uploadId format received", "uploadId", uploadID)
 			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid uploadId format"})
 			return
 		} // --- End validation ---
@@ -106,7 +146,7 @@ func ChunkUploadHandler(config *Config) gin.HandlerFunc { // Accept config
 			missingParams = append(missingParams, "fileSize")
 		}
 		if len(missingParams) > 0 {
-			log.Printf("[ChunkUpload] Missing required parameters: %v", missingParams)
+			chunkUploadLog.Debug("Missing required parameters", "missing", missingParams)
 			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Missing required parameters", "missing": missingParams})
 			return
 		}
@@ -114,431 +154,686 @@ func ChunkUploadHandler(config *Config) gin.HandlerFunc { // Accept config
 		// 转换参数类型
 		chunkNumber, err := strconv.Atoi(chunkNumberStr)
 		if err != nil {
-			log.Printf("[ChunkUpload:%s] Invalid chunk number format: %s, error: %v", uploadID, chunkNumberStr, err)
+			chunkUploadLog.Debug("Invalid chunk number format", "uploadId", uploadID, "chunkNumber", chunkNumberStr, "error", err)
 			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid chunk number format"})
 			return
 		}
 
 		totalChunks, err := strconv.Atoi(totalChunksStr)
 		if err != nil {
-			log.Printf("[ChunkUpload:%s] Invalid total chunks format: %s, error: %v", uploadID, totalChunksStr, err)
+			chunkUploadLog.Debug("Invalid total chunks format", "uploadId", uploadID, "totalChunks", totalChunksStr, "error", err)
 			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid total chunks format"})
 			return
 		}
 
-		// 使用加密后的文件大小而不是原始文件大小
-		fileSize, err := strconv.ParseInt(fileSizeStr, 10, 64)
-		if err != nil {
-			log.Printf("[ChunkUpload:%s] Invalid file size format: %s, error: %v", uploadID, fileSizeStr, err)
+		// 只校验格式；以初始化时声明的密文大小为准
+		if _, err := strconv.ParseInt(fileSizeStr, 10, 64); err != nil {
+			chunkUploadLog.Debug("Invalid file size format", "uploadId", uploadID, "fileSize", fileSizeStr, "error", err)
 			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid file size format"})
 			return
 		}
 
+		// 上传必须先通过 /api/upload/init 初始化，会话中记录了声明的文件名、大小和分片数
+		store := GetStorageManager()
+		session, err := store.uploads.Get(uploadID)
+		if err != nil {
+			chunkUploadLog.Info("Rejected chunk for unknown upload session", "uploadId", uploadID)
+			c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Upload not found, call /api/upload/init first"})
+			return
+		}
+		if totalChunks != session.TotalChunks {
+			chunkUploadLog.Info("totalChunks does not match declared value", "uploadId", uploadID, "totalChunks", totalChunks, "declared", session.TotalChunks)
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "totalChunks does not match the value declared at init"})
+			return
+		}
+
 		// 获取文件分片
 		file, header, err := c.Request.FormFile("chunk")
 		if err != nil {
-			log.Printf("[ChunkUpload:%s] Failed to get chunk file from form: %v", uploadID, err)
+			chunkUploadLog.Debug("Failed to get chunk file from form", "uploadId", uploadID, "error", err)
 			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Failed to retrieve chunk file from request"})
 			return
 		}
 		defer file.Close()
 
 		// 检查分片大小是否在合理范围内
-		if header.Size > int64(config.Server.MaxFileSizeMB)*1024*1024 {
-			log.Printf("[ChunkUpload:%s] Chunk size exceeds limit: %d bytes", uploadID, header.Size)
+		if header.Size > maxUploadBytes(config) {
+			chunkUploadLog.Info("Chunk size exceeds limit", "uploadId", uploadID, "size", header.Size)
 			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Chunk size exceeds server limit"})
 			return
 		}
 
 		// 在 header 有效的作用域内记录日志
-		log.Printf("[ChunkUpload:%s] Received chunk %d / %d: Name=%s, Size=%d bytes", uploadID, chunkNumber, totalChunks, header.Filename, header.Size) // Add filename
+		chunkUploadLog.Debug("Received chunk", "uploadId", uploadID, "chunk", chunkNumber, "totalChunks", totalChunks, "size", header.Size) // Add filename
+
+		receiveChunk(c, config, session, chunkNumber, file, header.Size, strings.ToLower(c.PostForm("chunkSha256")))
+	} // Close returned handler
+}
 
-		// 存储分片
-		chunkDir := filepath.Join(config.Paths.TempChunkDir, uploadID) // Use config path
-		if err := os.MkdirAll(chunkDir, 0755); err != nil {
-			log.Printf("[ChunkUpload:%s] Failed to create chunk directory %s: %v", uploadID, chunkDir, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Internal server error creating storage directory"})
+// RawChunkUploadHandler 处理 PUT /api/upload/:uploadId/chunks/:n。请求体就是分片本身
+// (application/octet-stream)，不经过 multipart 解析，直接流式写入存储；
+// 分片摘要可以放在 X-Chunk-Sha256 请求头中。
+func RawChunkUploadHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		config := currentConfig()
+		uploadID := c.Param("uploadId")
+		if !IsValidUploadID(uploadID) {
+			chunkUploadLog.Debug("Invalid uploadId format received", "uploadId", uploadID)
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid uploadId format"})
 			return
 		}
-
-		chunkPath := filepath.Join(chunkDir, fmt.Sprintf("%d", chunkNumber))
-		out, err := os.Create(chunkPath)
+		chunkNumber, err := strconv.Atoi(c.Param("n"))
 		if err != nil {
-			log.Printf("[ChunkUpload:%s] Failed to create chunk file %s: %v", uploadID, chunkPath, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Internal server error creating chunk file"})
+			chunkUploadLog.Debug("Invalid chunk number format", "uploadId", uploadID, "chunkNumber", c.Param("n"))
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid chunk number format"})
 			return
 		}
-		defer out.Close()
-
-		bytesWritten, err := io.Copy(out, file)
-		if err != nil {
-			log.Printf("[ChunkUpload:%s] Failed to save chunk file %s: %v", uploadID, chunkPath, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Internal server error saving chunk file"})
+		if contentType := c.ContentType(); contentType != "" && contentType != "application/octet-stream" {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"success": false, "message": "Content-Type must be application/octet-stream"})
 			return
 		}
-		log.Printf("[ChunkUpload:%s] Successfully wrote %d bytes for chunk %d to %s", uploadID, bytesWritten, chunkNumber, chunkPath) // Log bytes written
 
-		// 检查是否所有分片都已上传
-		// 检查是否所有分片都已上传
-		// 读取目录前确保目录存在
-		// Re-check directory existence before reading (belt-and-suspenders)
-		if err := os.MkdirAll(chunkDir, 0755); err != nil {
-			log.Printf("[ChunkUpload:%s] Failed to ensure chunk directory exists before reading %s: %v", uploadID, chunkDir, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Internal server error accessing storage"})
+		// 分片大小由 Content-Length 给出，在读取请求体之前检查
+		size := c.Request.ContentLength
+		if size < 0 {
+			c.JSON(http.StatusLengthRequired, gin.H{"success": false, "message": "Content-Length is required"})
 			return
 		}
-		// Use os.ReadDir instead of ioutil.ReadDir
-		dirEntries, err := os.ReadDir(chunkDir) // Use os.ReadDir
+		if size > maxUploadBytes(config) {
+			chunkUploadLog.Info("Chunk size exceeds limit", "uploadId", uploadID, "size", size)
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"success": false, "message": "Chunk size exceeds server limit"})
+			return
+		}
+
+		session, err := GetStorageManager().uploads.Get(uploadID)
 		if err != nil {
-			log.Printf("[ChunkUpload:%s] Failed to read chunk directory %s: %v", uploadID, chunkDir, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Internal server error reading storage"})
+			chunkUploadLog.Info("Rejected chunk for unknown upload session", "uploadId", uploadID)
+			c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Upload not found, call /api/upload/init first"})
 			return
 		}
 
-		// 实际接收到的分片数量
-		// Count valid entries (files, not directories or symlinks if any)
-		receivedChunks := 0
-		if err == nil { // Only count if ReadDir succeeded
-			for _, entry := range dirEntries {
-				if !entry.IsDir() { // Count only files
-					receivedChunks++
-				}
+		chunkUploadLog.Debug("Received chunk", "uploadId", uploadID, "chunk", chunkNumber, "totalChunks", session.TotalChunks, "size", size)
+
+		// 读取超过 Content-Length 的数据时报错
+		body := http.MaxBytesReader(c.Writer, c.Request.Body, size)
+		receiveChunk(c, config, session, chunkNumber, body, size, strings.ToLower(c.GetHeader("X-Chunk-Sha256")))
+	}
+}
+
+// receiveChunk 把一个分片写到预分配文件中对应的偏移处并更新会话，两种上传方式共用。
+// 分片边读边写入存储，同时计算 SHA-256，不会先把整个分片缓存下来。
+func receiveChunk(c *gin.Context, config *Config, session *UploadSession, chunkNumber int, body io.Reader, size int64, declaredSum string) {
+	uploadID := session.UploadID
+	store := GetStorageManager()
+
+	if session.State == UploadStateCancelled {
+		rejectCancelledChunk(c, uploadID, chunkNumber)
+		return
+	}
+
+	// 同一个上传同时写入的分片数不超过初始化时告知的 parallelism
+	if !store.uploads.acquireChunkSlot(uploadID, config.Upload.Parallelism) {
+		chunkUploadLog.Debug("Rejected chunk: too many chunks in flight", "uploadId", uploadID, "chunk", chunkNumber, "parallelism", config.Upload.Parallelism)
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusTooManyRequests, gin.H{"success": false, "message": fmt.Sprintf("At most %d chunks of an upload may be sent at once", config.Upload.Parallelism)})
+		return
+	}
+	defer store.uploads.releaseChunkSlot(uploadID)
+
+	// 分片写在 (chunkNumber-1)*chunkSize 处，大小必须与初始化时确定的布局一致
+	offset, err := session.chunkOffset(chunkNumber, size)
+	if err != nil {
+		chunkUploadLog.Info("Rejected chunk", "uploadId", uploadID, "error", err)
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": fmt.Sprintf("Invalid chunk: %v", err)})
+		return
+	}
+
+	received, resend := store.uploads.Chunk(uploadID, chunkNumber)
+
+	// 上传已经不再接收分片: 只计算摘要判断是否是内容相同的重发 (断点续传时客户端可以安全地重发)，不写入存储
+	if session.State != UploadStateInitialized && session.State != UploadStateReceiving {
+		if resend && received.Size == size {
+			hasher := sha256.New()
+			if _, err := io.Copy(hasher, body); err == nil && hex.EncodeToString(hasher.Sum(nil)) == received.SHA256 {
+				chunkUploadLog.Debug("Chunk already received, ignoring identical resend", "uploadId", uploadID, "chunk", chunkNumber)
+				c.JSON(http.StatusOK, ChunkResponse{
+					Success:   true,
+					Message:   fmt.Sprintf("Chunk %d already received", chunkNumber),
+					UploadID:  uploadID,
+					Completed: session.State == UploadStateComplete,
+				})
+				return
 			}
-		} else {
-			// Error already logged, proceed with receivedChunks = 0
-		}
-
-		// 只有当实际接收到的分片数等于总分片数时才开始合并
-		if receivedChunks == totalChunks {
-			// 异步合并文件，传递 fileSize
-			// 异步合并文件，传递 fileSize
-			// 确保 ensureDirectoriesExist 在 main 中调用或在这里调用
-			// EnsureUploadDirectoriesExist is called once at startup in main.go
-			// 添加日志，记录即将传递给 mergeChunks 的 totalChunks 值
-			log.Printf("[ChunkUpload:%s] All %d chunks received. Triggering merge for sanitized file '%s' (original: '%s').", uploadID, totalChunks, fileName, originalFileName) // Log sanitized name
-			// Pass config to MergeChunks
-			go MergeChunks(config, uploadID, fileName, totalChunks, fileSize, chunkDir) // Pass config and sanitized fileName
-
-			// 返回成功响应
-			c.JSON(http.StatusOK, ChunkResponse{
-				Success:   true,
-				Message:   "All chunks received, merging has begun",
-				UploadID:  uploadID,
-				Completed: false, // 合并是异步的
-			})
+		}
+		chunkUploadLog.Info("Rejected chunk: upload is not receiving", "uploadId", uploadID, "chunk", chunkNumber, "state", session.State)
+		c.JSON(http.StatusConflict, gin.H{"success": false, "message": fmt.Sprintf("Upload is %s, no more chunks accepted", session.State), "state": session.State})
+		return
+	}
+
+	// 累计接收的字节数不能超过初始化时声明的大小，也不能超过服务器上限
+	replaced := int64(0)
+	if resend {
+		replaced = received.Size
+	}
+	if total := session.ReceivedBytes - replaced + size; total > session.FileSize || total > maxUploadBytes(config) {
+		chunkUploadLog.Info("Rejected chunk: would exceed declared size or limit", "uploadId", uploadID, "chunk", chunkNumber, "total", total, "declared", session.FileSize, "limit", maxUploadBytes(config))
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"success": false, "message": "Upload exceeds the declared file size or the server limit"})
+		return
+	}
+
+	// 直接写入预分配的文件 (使用初始化时声明的文件名)，写入的同时计算摘要
+	hasher := sha256.New()
+	bytesWritten, err := store.WriteChunk(uploadID, session.FileName, chunkNumber, offset, io.TeeReader(body, hasher), size)
+	if err != nil {
+		chunkUploadLog.Error("Failed to save chunk", "uploadId", uploadID, "chunk", chunkNumber, "error", err)
+		// 写入期间上传被取消，文件已被删除
+		if current, getErr := store.uploads.Get(uploadID); getErr == nil && current.State == UploadStateCancelled {
+			rejectCancelledChunk(c, uploadID, chunkNumber)
+			return
+		}
+		if errors.Is(err, ErrStorageFull) {
+			// 放弃整个上传，释放已占用的空间
+			if rmErr := store.RemoveChunks(uploadID); rmErr != nil {
+				chunkUploadLog.Error("Failed to remove chunks after storage full", "uploadId", uploadID, "error", rmErr)
+			}
+			store.uploads.markFailed(uploadID, UploadFailureStorageFull, err)
+			c.JSON(http.StatusInsufficientStorage, gin.H{"success": false, "message": "Storage is full, upload rejected"})
 			return
+		}
+		if resend {
+			// 重发的分片只写了一部分，原来的内容已被覆盖，需要重新上传
+			if updateErr := store.uploads.ClearChunk(uploadID, chunkNumber); updateErr != nil {
+				chunkUploadLog.Error("Failed to clear chunk after failed resend", "uploadId", uploadID, "chunk", chunkNumber, "error", updateErr)
+			}
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Internal server error saving chunk file"})
+		return
+	}
+	chunkSum := hex.EncodeToString(hasher.Sum(nil))
+
+	// 客户端声明的分片摘要不一致说明传输中损坏，整个上传标记为失败 (已写入的数据随之删除)
+	if declaredSum != "" && declaredSum != chunkSum {
+		cause := fmt.Errorf("chunk %d: declared sha256 %s, received %s", chunkNumber, declaredSum, chunkSum)
+		chunkUploadLog.Warn("Checksum mismatch", "uploadId", uploadID, "error", cause)
+		failUpload(store, uploadID, UploadFailureChecksumMismatch, cause)
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"success": false, "message": fmt.Sprintf("Chunk %d checksum mismatch, upload failed", chunkNumber), "state": UploadStateFailed})
+		return
+	}
+	if resend && received.SHA256 != chunkSum {
+		chunkUploadLog.Info("Chunk resent with different content, replaced it", "uploadId", uploadID, "chunk", chunkNumber)
+	}
+	chunkUploadLog.Debug("Wrote chunk", "uploadId", uploadID, "chunk", chunkNumber, "bytes", bytesWritten, "offset", offset)
+	metricChunksReceived.Inc()
+	metricChunkBytes.Add(float64(bytesWritten))
 
+	// 在位图中记录分片，并保存大小和摘要；第一个分片把会话从 initialized 变为 receiving
+	chunk := UploadChunk{Size: bytesWritten, SHA256: chunkSum}
+	session, err = store.uploads.RecordChunk(uploadID, chunkNumber, chunk)
+	if err != nil {
+		chunkUploadLog.Error("Failed to update upload session", "uploadId", uploadID, "error", err)
+		var stateErr *uploadStateError
+		if errors.As(err, &stateErr) && stateErr.State == UploadStateCancelled {
+			rejectCancelledChunk(c, uploadID, chunkNumber)
+		} else if errors.As(err, &stateErr) {
+			c.JSON(http.StatusConflict, gin.H{"success": false, "message": fmt.Sprintf("Upload is %s, no more chunks accepted", stateErr.State), "state": stateErr.State})
+		} else if errors.Is(err, errUploadTooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"success": false, "message": "Upload exceeds the declared file size or the server limit"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Internal server error updating upload session"})
+		}
+		return
+	}
+	totalChunks := session.TotalChunks
+	chunkEvent := newUploadEvent(UploadEventChunkReceived, session)
+	chunkEvent.ChunkNumber = chunkNumber
+	store.uploads.events.publish(uploadID, chunkEvent)
+
+	// 位图中 1..totalChunks 全部置位后文件已经完整，只需完成并校验
+	receivedChunks := session.Received.count()
+	if session.hasAllChunks() {
+		// 状态从 receiving 变为 merging；并发到达的最后几个分片中只有一个能触发完成
+		merging, err := store.uploads.Update(uploadID, func(s *UploadSession) error {
+			if s.State != UploadStateReceiving {
+				return &uploadStateError{State: s.State}
+			}
+			s.State = UploadStateMerging
+			return nil
+		})
+		if err == nil {
+			store.uploads.events.publish(uploadID, newUploadEvent(UploadEventMergeStarted, merging))
+			chunkUploadLog.Info("All chunks received, finishing file", "uploadId", uploadID, "totalChunks", totalChunks)
+			// 异步完成文件并校验摘要，使用初始化时声明的文件名和大小；关闭服务时等待它完成
+			backgroundJobs.Go("finalize", func() {
+				FinalizeUpload(config, uploadID, session.FileName, totalChunks, session.FileSize, session.SHA256)
+			})
+		} else {
+			chunkUploadLog.Debug("All chunks received, finalize not started here", "uploadId", uploadID, "error", err)
 		}
 
-		// 如果不是最后一个分片，返回当前分片上传成功响应
 		c.JSON(http.StatusOK, ChunkResponse{
 			Success:   true,
-			Message:   fmt.Sprintf("Chunk %d of %d received (%d/%d total received)", chunkNumber, totalChunks, receivedChunks, totalChunks),
+			Message:   "All chunks received, finishing upload",
 			UploadID:  uploadID,
-			Completed: false,
+			Completed: false, // 完成和校验是异步的
 		})
+		return
+	}
 
-	} // Close returned handler
+	c.JSON(http.StatusOK, ChunkResponse{
+		Success:   true,
+		Message:   fmt.Sprintf("Chunk %d of %d received (%d/%d total received)", chunkNumber, totalChunks, receivedChunks, totalChunks),
+		UploadID:  uploadID,
+		Completed: false,
+	})
+}
+
+// rejectCancelledChunk 告诉客户端上传已被取消 (410 Gone)，重试没有意义
+func rejectCancelledChunk(c *gin.Context, uploadID string, chunkNumber int) {
+	chunkUploadLog.Info("Rejected chunk: upload was cancelled", "uploadId", uploadID, "chunk", chunkNumber)
+	c.JSON(http.StatusGone, gin.H{"success": false, "message": "Upload was cancelled", "state": UploadStateCancelled})
 }
 
-// CheckUploadStatusHandler 检查文件合并状态 (Exported)
+// CheckUploadStatusHandler 检查上传状态 (Exported)
 // CheckUploadStatusHandler checks the status of a chunked upload (merged or in progress).
-func CheckUploadStatusHandler(config *Config) gin.HandlerFunc { // Accept config
-	return func(c *gin.Context) { // Return the actual handler
-		// log.Printf("[CheckStatus] Handler started") // Reduce verbose logging
+func CheckUploadStatusHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		config := currentConfig()
 		uploadID := c.Query("uploadId") // 使用 c.Query 获取查询参数
 		if uploadID == "" {
-			log.Println("[CheckStatus] Error: Missing uploadId query parameter") // More specific log
+			checkStatusLog.Debug("Missing uploadId query parameter")
 			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Missing 'uploadId' query parameter"})
 			return
 		}
 		// --- Add validation ---
 		if !IsValidUploadID(uploadID) { // --- Use shared validation ---
-			log.Printf("[CheckStatus] Invalid uploadId format received: %s", uploadID)
+			checkStatusLog.Debug("Invalid uploadId format received", "uploadId", uploadID)
 			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid uploadId format"})
 			return
 		}
 		// --- End validation ---
 		// Brace moved down to enclose the entire handler logic
-		// log.Printf("[CheckStatus:%s] Checking status for upload ID", uploadID) // Reduce verbose logging
-
-		uploadStatusDir := filepath.Join(config.Paths.FinalUploadDir, uploadID) // Use config path
-		completeMarkerPath := filepath.Join(uploadStatusDir, ".complete")
-		fileNamePath := filepath.Join(uploadStatusDir, ".filename") // Path to store the original filename
-		// log.Printf("[CheckStatus:%s] Complete marker path: %s", uploadID, completeMarkerPath) // Reduce verbose logging
-		// log.Printf("[CheckStatus:%s] Filename path: %s", uploadID, fileNamePath) // Reduce verbose logging
-
-		// 检查 .complete 文件
-		// log.Printf("[CheckStatus:%s] Checking for complete marker: %s", uploadID, completeMarkerPath) // Reduce verbose logging
-		_, completeStatErr := os.Stat(completeMarkerPath)
-		// log.Printf("[CheckStatus:%s] Stat complete marker result: %v", uploadID, completeStatErr) // Reduce verbose logging
-		if completeStatErr == nil {
-			// .complete 文件存在，表示合并已完成
-			// log.Printf("[CheckStatus:%s] Found .complete marker. Attempting to read filename from: %s", uploadID, fileNamePath) // Reduce verbose logging
-			// 读取原始文件名
-			// Use os.ReadFile instead of ioutil.ReadFile
-			// Use os.ReadFile instead of ioutil.ReadFile
-			fileNameBytes, readFileErr := os.ReadFile(fileNamePath) // Use os.ReadFile
-			// log.Printf("[CheckStatus:%s] Read filename file result: %v", uploadID, readFileErr) // Reduce verbose logging
-			if readFileErr != nil {
-				log.Printf("[CheckStatus:%s] Error reading filename file '%s': %v", uploadID, fileNamePath, readFileErr) // Log error with path
-				// If filename cannot be read after merge, it's an internal inconsistency
-				c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Internal server error: Failed to retrieve filename after merge"})
-				return
-			}
-			originalFileName := string(fileNameBytes)
-			// Construct the relative path using the configured final upload directory
-			// Note: This path is relative to the server root, not necessarily the host filesystem root.
-			// It's intended for the client to know where the file *conceptually* is.
-			finalRelativePath := filepath.Join(config.Paths.FinalUploadDir, uploadID, originalFileName)
-			log.Printf("[CheckStatus:%s] Merge completed. Original filename: '%s'.", uploadID, originalFileName) // Simplified log
-
-			c.JSON(http.StatusOK, ChunkResponse{ // 使用 c.JSON
-				Success:   true,
-				Message:   "File merge completed",
-				UploadID:  uploadID,
-				FilePath:  finalRelativePath, // 返回包含原始文件名的相对路径
-				Completed: true,
-			})
-			return
-		} else if !os.IsNotExist(completeStatErr) {
-			// If there was an error other than "Not Exists" checking the complete marker
-			// Log other stat errors when checking complete marker
-			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Internal server error checking upload status"})
-			return
-		}
-		// If .complete doesn't exist (os.IsNotExist(completeStatErr) is true), check temp dir
-
-		// 检查临时目录是否存在，如果存在说明还在上传或合并中
-		tempChunkDir := filepath.Join(config.Paths.TempChunkDir, uploadID) // Use config path
-		// log.Printf("[CheckStatus:%s] Complete marker not found. Checking temporary chunk directory: %s", uploadID, tempChunkDir) // Reduce verbose logging
-		_, tempStatErr := os.Stat(tempChunkDir)
-		// log.Printf("[CheckStatus:%s] Stat temporary directory result: %v", uploadID, tempStatErr) // Reduce verbose logging
-		if tempStatErr == nil {
-			// 临时目录存在，合并尚未完成或正在进行
-			// log.Printf("[CheckStatus:%s] Temporary directory exists. Reporting merge in progress.", uploadID) // Reduce verbose logging
-			c.JSON(http.StatusOK, ChunkResponse{ // 使用 c.JSON
-				Success:   true,
-				Message:   "File upload/merge in progress",
-				UploadID:  uploadID,
-				Completed: false,
-			})
+		checkStatusLog.Debug("Checking status", "uploadId", uploadID)
+
+		store := GetStorageManager()
+		session, err := store.uploads.Get(uploadID)
+		if err != nil {
+			checkStatusLog.Info("Upload session not found", "uploadId", uploadID)
+			c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Upload not found"})
 			return
 		}
-		// If there was an error other than "Not Exists" checking the temp directory
-		// We would have returned earlier based on the logic before this block.
-		// So if we reach here, it means the temp dir doesn't exist.
-
-		// 如果 .complete 文件和临时目录都不存在，则认为上传未找到或已失败/清理
-		log.Printf("[CheckStatus:%s] Upload status check: Neither complete marker nor temp directory found.", uploadID)
-		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Upload not found, incomplete, or failed"}) // Clearer message
 
+		response := UploadStatusResponse{
+			Success:       session.State != UploadStateFailed && session.State != UploadStateCancelled,
+			UploadID:      uploadID,
+			State:         session.State,
+			FailureReason: session.FailureReason,
+			FailureDetail: session.FailureDetail,
+			FileName:      session.FileName,
+			FileSize:      session.FileSize,
+			TotalChunks:   session.TotalChunks,
+			ReceivedBytes: session.ReceivedBytes,
+			CreatedAt:     session.CreatedAt,
+		}
+		// 已接收的分片编号和大小，客户端重连后只需补发缺少的分片
+		numbers := session.chunkNumbers()
+		response.Chunks = make([]ReceivedChunk, 0, len(numbers))
+		for _, number := range numbers {
+			response.Chunks = append(response.Chunks, ReceivedChunk{Number: number, Size: session.chunkLength(number)})
+		}
+		response.ReceivedChunks = len(response.Chunks)
+		switch session.State {
+		case UploadStateInitialized, UploadStateReceiving:
+			response.Message = "File upload in progress"
+		case UploadStateMerging:
+			response.Message = "Finishing upload"
+		case UploadStateComplete:
+			response.Completed = true
+			response.Digest = session.Digest
+			response.Message = "Upload completed"
+			// 相对于服务器的概念路径，供客户端参考
+			response.FilePath = filepath.Join(config.Paths.FinalUploadDir, uploadID, session.FileName)
+		case UploadStateFailed:
+			response.Message = "Upload failed: " + session.FailureReason
+		case UploadStateCancelled:
+			response.Message = "Upload cancelled"
+		}
+		c.JSON(http.StatusOK, response)
 	} // Close returned handler
 }
 
-// InitUploadHandler initializes the chunk upload process and returns an upload ID.
-func InitUploadHandler(config *Config) gin.HandlerFunc {
-	// 用于追踪活跃上传的映射
-	var (
-		activeUploads = make(map[string]time.Time)
-		uploadsMutex  sync.Mutex
-	)
-
-	// 清理过期的上传记录
-	go func() {
-		for {
-			time.Sleep(time.Hour)
-			uploadsMutex.Lock()
-			now := time.Now()
-			for id, t := range activeUploads {
-				if now.Sub(t) > 24*time.Hour {
-					delete(activeUploads, id)
-				}
+// CancelUploadHandler 处理 DELETE /api/upload/:uploadId，需要 "Authorization: Bearer <cancelToken>"
+// (初始化时返回)。取消后不再接收分片，正在进行的完成过程被中断，已写入的数据全部删除；
+// 会话保留为 cancelled，之后到达的分片会收到明确的错误，直到会话被后台回收。
+func CancelUploadHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uploadID := c.Param("uploadId")
+		if !IsValidUploadID(uploadID) {
+			cancelUploadLog.Debug("Invalid uploadId format received", "uploadId", uploadID)
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid uploadId format"})
+			return
+		}
+
+		store := GetStorageManager()
+		session, err := store.uploads.Get(uploadID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Upload not found"})
+			return
+		}
+		if !tokenMatchesHash(bearerToken(c), session.CancelTokenHash) {
+			cancelUploadLog.Warn("Rejected request with missing or invalid cancel token", "uploadId", uploadID)
+			c.JSON(http.StatusForbidden, gin.H{"success": false, "message": "Invalid cancel token"})
+			return
+		}
+		// 元数据已经保存的上传由管理令牌销毁
+		if _, err := store.GetMetadata(uploadID); err == nil {
+			c.JSON(http.StatusConflict, gin.H{"success": false, "message": "Upload already stored, use the management token to delete it"})
+			return
+		}
+
+		var previous string
+		cancelled, err := store.uploads.Update(uploadID, func(s *UploadSession) error {
+			previous = s.State
+			s.State = UploadStateCancelled
+			s.Received = nil
+			s.Chunks = nil
+			s.ReceivedBytes = 0
+			return nil
+		})
+		if err != nil {
+			cancelUploadLog.Error("Failed to update upload session", "uploadId", uploadID, "error", err)
+			if errors.Is(err, errUploadSessionNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Upload not found"})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to cancel upload"})
 			}
-			uploadsMutex.Unlock()
+			return
 		}
-	}()
 
+		// 先改状态再中断，完成过程结束时不会再把上传标记为 complete
+		store.uploads.interruptFinalize(uploadID)
+		removeUploadData(store, uploadID)
+		store.uploads.events.publish(uploadID, newUploadEvent(UploadEventCancelled, cancelled))
+		cancelUploadLog.Info("Upload cancelled", "uploadId", uploadID, "previousState", previous)
+
+		c.JSON(http.StatusOK, gin.H{"success": true, "message": "Upload cancelled", "uploadId": uploadID, "state": UploadStateCancelled})
+	}
+}
+
+// InitUploadHandler initializes the chunk upload process and returns an upload ID.
+func InitUploadHandler() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		config := currentConfig()
 		var uploadRequest struct {
-			FileName string `json:"fileName"`
-			FileSize int64  `json:"fileSize"`
+			FileName    string `json:"fileName"`
+			FileSize    int64  `json:"fileSize"`    // 加密后的总大小，用于预分配文件
+			ChunkSize   int64  `json:"chunkSize"`   // 可选；多于一个分片时必须等于服务器的分片大小 (upload.chunk_size_mb)
+			TotalChunks int    `json:"totalChunks"` // 可选；必须等于 ceil(fileSize / chunkSize)
+			SHA256      string `json:"sha256"`      // 可选；整个密文的 SHA-256 (十六进制)，上传完成后校验
 		}
 
 		if err := c.ShouldBindJSON(&uploadRequest); err != nil {
-			log.Printf("[InitUpload] Error binding JSON: %v", err)
+			initUploadLog.Debug("Error binding JSON", "error", err)
 			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid request format"})
 			return
 		}
 
-		if uploadRequest.FileName == "" {
-			log.Println("[InitUpload] File name is required but missing")
+		fileName := filepath.Base(uploadRequest.FileName)
+		if uploadRequest.FileName == "" || fileName == "." || fileName == ".." || fileName == "/" {
+			initUploadLog.Debug("File name is required but missing")
 			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "'fileName' is required"})
 			return
 		}
+		if uploadRequest.FileSize <= 0 || uploadRequest.ChunkSize < 0 || uploadRequest.TotalChunks < 0 {
+			initUploadLog.Debug("Invalid fileSize, chunkSize or totalChunks", "fileSize", uploadRequest.FileSize, "chunkSize", uploadRequest.ChunkSize, "totalChunks", uploadRequest.TotalChunks)
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "'fileSize' is required; chunkSize and totalChunks must not be negative"})
+			return
+		}
+
+		if uploadRequest.FileSize > maxUploadBytes(config) {
+			initUploadLog.Info("Declared fileSize exceeds limit", "fileSize", uploadRequest.FileSize, "limitMB", config.Server.MaxFileSizeMB)
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"success": false, "message": fmt.Sprintf("File exceeds the server limit of %d MB", config.Server.MaxFileSizeMB)})
+			return
+		}
 
-		// 生成上传ID
-		uploadID := generateUploadID(uploadRequest.FileName)
+		// 分片大小由服务器决定 (upload.chunk_size_mb)，第 n 个分片写在 (n-1)*chunkSize 处。
+		// 客户端声明的分片大小必须与之一致，除非双方都认为整个文件只有一个分片。
+		chunkSize := config.Upload.chunkSize()
+		totalChunks := int((uploadRequest.FileSize + chunkSize - 1) / chunkSize)
+		if declared := uploadRequest.ChunkSize; declared != 0 && declared != chunkSize && (declared < uploadRequest.FileSize || totalChunks > 1) {
+			initUploadLog.Info("Declared chunkSize does not match server chunk size", "chunkSize", declared, "serverChunkSize", chunkSize)
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": fmt.Sprintf("chunkSize must be %d", chunkSize), "chunkSize": chunkSize})
+			return
+		}
+		if totalChunks > config.Upload.MaxChunks {
+			initUploadLog.Info("fileSize needs more chunks than allowed", "fileSize", uploadRequest.FileSize, "totalChunks", totalChunks, "maxChunks", config.Upload.MaxChunks)
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"success": false, "message": fmt.Sprintf("File needs %d chunks, more than the limit of %d", totalChunks, config.Upload.MaxChunks)})
+			return
+		}
+		if uploadRequest.TotalChunks != 0 && uploadRequest.TotalChunks != totalChunks {
+			initUploadLog.Info("totalChunks does not match fileSize / chunkSize", "totalChunks", uploadRequest.TotalChunks, "fileSize", uploadRequest.FileSize, "chunkSize", chunkSize)
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": fmt.Sprintf("totalChunks must be %d for this fileSize and chunkSize", totalChunks)})
+			return
+		}
 
-		// 检查并记录上传ID
-		uploadsMutex.Lock()
-		if _, exists := activeUploads[uploadID]; exists {
-			// 如果上传ID已存在，生成一个新的
-			uploadID = generateUploadID(uploadRequest.FileName + time.Now().String())
+		expectedSHA256 := strings.ToLower(uploadRequest.SHA256)
+		if expectedSHA256 != "" && !IsValidSHA256(expectedSHA256) {
+			initUploadLog.Debug("Invalid sha256 digest", "sha256", uploadRequest.SHA256)
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid sha256, expected 64 hex characters"})
+			return
 		}
-		activeUploads[uploadID] = time.Now()
-		uploadsMutex.Unlock()
 
-		log.Printf("[InitUpload] Initialized upload for file '%s' with ID: %s", uploadRequest.FileName, uploadID)
+		// 取消令牌只返回一次，服务器只保存摘要
+		cancelToken, err := newSecretToken()
+		if err != nil {
+			initUploadLog.Error("Error generating cancel token", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to initialize upload"})
+			return
+		}
 
-		c.JSON(http.StatusOK, ChunkResponse{
-			Success:  true,
-			Message:  "Upload initialized",
-			UploadID: uploadID,
-		})
+		// 生成上传ID并持久化会话
+		session := &UploadSession{
+			UploadID:        generateUploadID(uploadRequest.FileName),
+			FileName:        fileName,
+			FileSize:        uploadRequest.FileSize,
+			ChunkSize:       chunkSize,
+			TotalChunks:     totalChunks,
+			SHA256:          expectedSHA256,
+			CancelTokenHash: hashToken(cancelToken),
+		}
+		store := GetStorageManager()
+		uploads := store.uploads
+		if err := uploads.Create(session); err != nil {
+			// 上传ID冲突 (几乎不可能) 时重新生成一次
+			session.UploadID = generateUploadID(uploadRequest.FileName + time.Now().String())
+			if err := uploads.Create(session); err != nil {
+				initUploadLog.Error("Error creating upload session", "error", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to initialize upload"})
+				return
+			}
+		}
+
+		// 按声明的大小预分配最终文件，之后每个分片直接写入其中
+		if err := store.PrepareUpload(session.UploadID, fileName, session.FileSize); err != nil {
+			initUploadLog.Error("Error preallocating file", "uploadId", session.UploadID, "size", session.FileSize, "error", err)
+			if delErr := uploads.Delete(session.UploadID); delErr != nil {
+				initUploadLog.Error("Failed to delete upload session", "uploadId", session.UploadID, "error", delErr)
+			}
+			if errors.Is(err, ErrStorageFull) {
+				c.JSON(http.StatusInsufficientStorage, gin.H{"success": false, "message": "Storage is full, upload rejected"})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": "Failed to initialize upload"})
+			}
+			return
+		}
+
+		initUploadLog.Info("Initialized upload", "uploadId", session.UploadID, "size", session.FileSize, "totalChunks", session.TotalChunks, "chunkSize", session.ChunkSize)
+
+		response := InitUploadResponse{
+			Success:     true,
+			Message:     "Upload initialized",
+			UploadID:    session.UploadID,
+			CancelToken: cancelToken,
+			ChunkSize:   session.ChunkSize,
+			TotalChunks: session.TotalChunks,
+			MaxChunks:   config.Upload.MaxChunks,
+			MaxFileSize: maxUploadBytes(config),
+			Parallelism: config.Upload.Parallelism,
+		}
+		if config.GC.Enabled {
+			response.SessionTTL = int64(config.Upload.sessionTTL() / time.Second)
+		}
+		c.JSON(http.StatusOK, response)
 	}
 }
 
-// mergeChunks 合并所有分片成一个完整文件
-// MergeChunks merges all chunks into a final file.
-// MergeChunks merges all chunks into a final file.
-func MergeChunks(config *Config, uploadID, fileName string, totalChunks int, expectedSize int64, chunkDir string) { // Accept config
+// FinalizeUpload 在所有分片写入预分配的文件后完成上传：由存储后端使文件可读取
+// (本地改名或对象存储的分段完成)，再读回文件校验大小和摘要。每个上传独立完成，互不等待；
+// 上传被取消时中断并删除已完成的文件。关闭服务超过 drain timeout 时同样中断，
+// 上传标记为 interrupted，客户端需要重新上传。
+func FinalizeUpload(config *Config, uploadID, fileName string, totalChunks int, expectedSize int64, expectedSHA256 string) {
 	startTime := time.Now() // 记录开始时间
-	log.Printf("[%s] MergeChunks: Started. totalChunks = %d, expectedSize = %d, chunkDir = %s", uploadID, totalChunks, expectedSize, chunkDir)
-	// 获取互斥锁
-	mergeMutex.Lock()
-	// 立即设置互斥锁的解锁
-	defer mergeMutex.Unlock()
+	finalizeLog.Info("Started", "uploadId", uploadID, "totalChunks", totalChunks, "expectedSize", expectedSize)
 
-	// 设置其他清理工作的延迟函数
+	store := GetStorageManager()
+	ctx, done := store.uploads.beginFinalize(uploadID)
+	defer done()
+
+	result := "failure"
 	defer func() {
+		if ctx.Err() != nil {
+			if errors.Is(context.Cause(ctx), errServerShutdown) {
+				finalizeLog.Warn("Interrupted by server shutdown", "uploadId", uploadID)
+				failUpload(store, uploadID, UploadFailureInterrupted, errServerShutdown)
+			} else {
+				// 取消请求和完成过程可能交错，再删除一次可能刚完成的文件
+				result = "cancelled"
+				finalizeLog.Info("Interrupted, upload was cancelled", "uploadId", uploadID)
+				removeUploadData(store, uploadID)
+			}
+		}
 		duration := time.Since(startTime)
-		log.Printf("[%s] MergeChunks: Finished. Duration: %s", uploadID, duration)
+		metricMergeDuration.WithLabelValues(result).Observe(duration.Seconds())
+		finalizeLog.Info("Finished", "uploadId", uploadID, "result", result, "duration", duration)
 	}()
 
-	// 创建最终文件所在的目录 uploadDir/uploadID
-	finalDir := filepath.Join(config.Paths.FinalUploadDir, uploadID)                        // Use config path
-	log.Printf("[%s] MergeChunks: Ensuring final directory exists: %s", uploadID, finalDir) // Changed log message slightly
-	if err := os.MkdirAll(finalDir, 0755); err != nil {
-		log.Printf("[%s] MergeChunks: ERROR - Failed to create final directory '%s': %v. Aborting.", uploadID, finalDir, err) // Added ERROR prefix and Aborting.
-		return                                                                                                                // Return handled by defer unlock
+	finalSize, err := store.FinishUpload(uploadID, fileName, totalChunks)
+	if ctx.Err() != nil {
+		return
 	}
-	log.Printf("[%s] MergeChunks: Final directory ensured.", uploadID) // Log success
-
-	// 最终文件路径 uploadDir/uploadID/fileName
-	finalFilePath := filepath.Join(finalDir, fileName)
-	log.Printf("[%s] MergeChunks: Creating final file: %s", uploadID, finalFilePath)
-	finalFile, err := os.Create(finalFilePath)
 	if err != nil {
-		log.Printf("[%s] MergeChunks: ERROR - Failed to create final file '%s': %v. Aborting.", uploadID, finalFilePath, err) // Added ERROR prefix and Aborting.
-		return                                                                                                                // Return handled by defer unlock
+		finalizeLog.Error("Failed to finish final file", "uploadId", uploadID, "error", err)
+		reason := UploadFailureStorageError
+		if errors.Is(err, ErrChunkMissing) {
+			reason = UploadFailureMissingChunk
+		} else if errors.Is(err, ErrStorageFull) {
+			reason = UploadFailureStorageFull
+		}
+		failUpload(store, uploadID, reason, err)
+		return
 	}
-	log.Printf("[%s] MergeChunks: Successfully created final file.", uploadID) // Log success
-	defer finalFile.Close()
-
-	// 按顺序合并所有分片
-	for i := 1; i <= totalChunks; i++ {
-		chunkPath := filepath.Join(chunkDir, fmt.Sprintf("%d", i))
-		log.Printf("[%s] MergeChunks: Processing chunk %d/%d: %s", uploadID, i, totalChunks, chunkPath) // Log which chunk
-
-		// 检查分片文件是否存在
-		var chunkFile *os.File // Declare chunkFile here
-		var statErr error
-		if _, statErr = os.Stat(chunkPath); os.IsNotExist(statErr) {
-			log.Printf("[%s] MergeChunks: ERROR - Chunk file %d not found: %s. Aborting merge.", uploadID, i, chunkPath)
-			finalFile.Close()        // Close the output file
-			os.Remove(finalFilePath) // Attempt cleanup
-			return                   // Return handled by defer unlock
-		} else if statErr != nil {
-			// Log other stat errors
-			log.Printf("[%s] MergeChunks: ERROR - Cannot stat chunk file %d (%s): %v. Aborting merge.", uploadID, i, chunkPath, statErr)
-			finalFile.Close()        // Close the output file
-			os.Remove(finalFilePath) // Attempt cleanup
-			return                   // Return handled by defer unlock
-		}
-
-		// Open the chunk file
-		log.Printf("[%s] MergeChunks: Opening chunk %d: %s", uploadID, i, chunkPath)
-		chunkFile, err = os.Open(chunkPath) // Assign to declared chunkFile
-		if err != nil {
-			log.Printf("[%s] MergeChunks: ERROR - Failed to open chunk file %d (%s): %v. Aborting merge.", uploadID, i, chunkPath, err)
-			finalFile.Close()        // Close the output file
-			os.Remove(finalFilePath) // Attempt cleanup
-			return                   // Return handled by defer unlock
-		}
-
-		// log.Printf("[%s] MergeChunks: Copying chunk %d...", uploadID, i) // Optional: Log before copy
-		// Copy the chunk content
-		log.Printf("[%s] MergeChunks: Copying chunk %d content...", uploadID, i)
-		bytesCopied, err := io.Copy(finalFile, chunkFile)
-		chunkFile.Close() // Close chunk file immediately after copy
-		if err != nil {
-			log.Printf("[%s] MergeChunks: ERROR - Failed to copy chunk %d (%s) to final file: %v. Aborting merge.", uploadID, i, chunkPath, err)
-			finalFile.Close()        // Close the output file
-			os.Remove(finalFilePath) // Attempt cleanup
-			return                   // Return handled by defer unlock
-		}
-		log.Printf("[%s] MergeChunks: Successfully copied %d bytes from chunk %d.", uploadID, bytesCopied, i)
+	finalizeLog.Debug("Final file size", "uploadId", uploadID, "size", finalSize)
 
+	// 最终大小必须与初始化时声明的一致
+	if finalSize != expectedSize {
+		failUpload(store, uploadID, UploadFailureSizeMismatch, fmt.Errorf("declared %d bytes, final file has %d bytes", expectedSize, finalSize))
+		return
 	}
 
-	// 关闭最终文件以确保所有数据都已写入磁盘
-	// Close the final merged file (defer already handles this, but explicit log is good)
-	log.Printf("[%s] MergeChunks: Finished copying all chunks. Closing final file: %s", uploadID, finalFilePath)
-	// finalFile.Close() is handled by defer, no need to call it explicitly here unless for error checking before defer
-
-	// 文件大小验证逻辑已移除 - 我们信任服务器合并后的实际大小
-	// 获取最终文件信息以记录大小
-	// Get final file info (optional but good for verification)
-	log.Printf("[%s] MergeChunks: Getting final file info: %s", uploadID, finalFilePath)
-	finalFileInfo, err := os.Stat(finalFilePath)
+	// 从存储中读回最终文件计算摘要，校验客户端在初始化时声明的整体摘要；
+	// 读取进度以 merge-progress 事件推送给订阅者
+	progress := UploadEvent{
+		Type:           UploadEventMergeProgress,
+		UploadID:       uploadID,
+		State:          UploadStateMerging,
+		ReceivedChunks: totalChunks,
+		TotalChunks:    totalChunks,
+		ReceivedBytes:  expectedSize,
+		FileSize:       expectedSize,
+	}
+	digest, err := blobSHA256(ctx, store, uploadID, fileName, func(hashed int64) {
+		progress.MergedBytes = hashed
+		store.uploads.events.publish(uploadID, progress)
+	})
+	if ctx.Err() != nil {
+		return
+	}
 	if err != nil {
-		log.Printf("[%s] MergeChunks: WARNING - Failed to get final file info for '%s': %v", uploadID, finalFilePath, err)
-		// Proceed without size check if stat fails
-	} else {
-		log.Printf("[%s] MergeChunks: Final file size: %d bytes.", uploadID, finalFileInfo.Size())
-		// 记录一下实际大小和预期大小，但不作为失败条件
-		// 记录文件大小差异（如果需要）
-		if finalFileInfo.Size() != expectedSize {
-			log.Printf("[%s] MergeChunks: INFO - File size mismatch. Client Expected: %d, Server Actual: %d.", uploadID, expectedSize, finalFileInfo.Size())
-		} else {
-			log.Printf("[%s] MergeChunks: Final file size matches expected size.", uploadID)
-		}
+		failUpload(store, uploadID, UploadFailureStorageError, fmt.Errorf("reading final file: %w", err))
+		return
+	}
+	if expectedSHA256 != "" && digest != expectedSHA256 {
+		failUpload(store, uploadID, UploadFailureDigestMismatch, fmt.Errorf("declared sha256 %s, final file %s", expectedSHA256, digest))
+		return
 	}
+	finalizeLog.Debug("Final file sha256", "uploadId", uploadID, "sha256", digest)
 
-	// 创建 .complete 标记文件
-	completeMarkerPath := filepath.Join(finalDir, ".complete")
-	log.Printf("[%s] MergeChunks: Creating completion marker: %s", uploadID, completeMarkerPath)
-	completeFile, err := os.Create(completeMarkerPath)
+	completed, err := store.uploads.Update(uploadID, func(s *UploadSession) error {
+		if s.State != UploadStateMerging {
+			return &uploadStateError{State: s.State}
+		}
+		s.State = UploadStateComplete
+		s.Digest = digest
+		return nil
+	})
 	if err != nil {
-		log.Printf("[%s] MergeChunks: ERROR - Failed to create complete marker file '%s': %v", uploadID, completeMarkerPath, err)
-		// Don't return here, try to create filename marker anyway
-	} else {
-		completeFile.Close() // 显式关闭文件句柄
-		log.Printf("[%s] MergeChunks: Successfully created completion marker.", uploadID)
+		finalizeLog.Error("Failed to mark upload complete", "uploadId", uploadID, "error", err)
+		return
 	}
+	store.uploads.events.publish(uploadID, newUploadEvent(UploadEventCompleted, completed))
+	result = "success"
+}
 
-	// 创建 .filename 文件存储原始文件名
-	fileNamePath := filepath.Join(finalDir, ".filename")
-	log.Printf("[%s] MergeChunks: Creating filename marker: %s", uploadID, fileNamePath)
-	// Use os.WriteFile instead of ioutil.WriteFile
-	// Use os.WriteFile instead of ioutil.WriteFile
-	if err := os.WriteFile(fileNamePath, []byte(fileName), 0640); err != nil { // Use os.WriteFile and restrictive permissions
-		log.Printf("[%s] MergeChunks: ERROR - Failed to write original filename marker '%s': %v", uploadID, fileNamePath, err)
-		// Status check might fail to get filename
-	} else {
-		log.Printf("[%s] MergeChunks: Successfully created filename marker.", uploadID)
+// failUpload 把上传标记为失败，并删除写了一半的文件
+func failUpload(store *StorageManager, uploadID, reason string, cause error) {
+	store.uploads.markFailed(uploadID, reason, cause)
+	removeUploadData(store, uploadID)
+}
+
+// removeUploadData 删除上传写了一半的文件和已完成的文件，失败时留给后台回收
+func removeUploadData(store *StorageManager, uploadID string) {
+	if err := store.RemoveChunks(uploadID); err != nil {
+		uploadSessionLog.Warn("Failed to remove chunks of upload", "uploadId", uploadID, "error", err)
+	}
+	if err := store.RemoveBlob(uploadID); err != nil {
+		uploadSessionLog.Warn("Failed to remove final file of upload", "uploadId", uploadID, "error", err)
 	}
+}
 
-	// 清理临时分片目录
-	log.Printf("[%s] MergeChunks: Cleaning up chunk directory: %s", uploadID, chunkDir)
-	if err := os.RemoveAll(chunkDir); err != nil {
-		log.Printf("[%s] MergeChunks: WARNING - Failed to clean up chunk directory '%s': %v", uploadID, chunkDir, err)
-	} else {
-		log.Printf("[%s] MergeChunks: Successfully cleaned up chunk directory.", uploadID)
+// blobSHA256 计算存储中 id/name 的 SHA-256 (十六进制)。progress 不为 nil 时
+// 每读取 mergeProgressStep 字节 (以及最后不足的部分) 以累计字节数调用一次；ctx 结束时停止读取。
+func blobSHA256(ctx context.Context, store BlobStore, id, name string, progress func(hashed int64)) (string, error) {
+	blob, _, err := store.OpenBlob(id, name)
+	if err != nil {
+		return "", err
 	}
+	defer blob.Close()
+	hasher := sha256.New()
+	var hashed int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		n, err := io.CopyN(hasher, blob, mergeProgressStep)
+		hashed += n
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		if progress != nil && (n > 0 || hashed == 0) {
+			progress(hashed)
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// mergeProgressStep 是完成上传时推送 merge-progress 事件的间隔 (字节)
+const mergeProgressStep = 4 << 20
 
-	// Final log is handled by the defer function
+// maxUploadBytes 返回单个上传 (加密后) 允许的最大字节数
+func maxUploadBytes(config *Config) int64 {
+	return int64(config.Server.MaxFileSizeMB) * 1024 * 1024
 }
 
 // generateUploadID 根据文件名生成唯一的上传ID
@@ -559,7 +854,7 @@ func cryptoRandBytes(n int) []byte {
 	_, err := io.ReadFull(cryptoRand.Reader, b)
 	if err != nil {
 		// 在密码学安全随机数生成失败时，记录错误并使用更安全的备选方案
-		log.Printf("CRITICAL: crypto/rand failed: %v - using time-based fallback", err)
+		serverLog.Error("crypto/rand failed, using time-based fallback", "error", err)
 		// 使用多个时间源和进程信息来增加熵
 		fallbackSource := []byte(fmt.Sprintf("%d-%d-%d",
 			time.Now().UnixNano(),
@@ -589,16 +884,16 @@ func EnsureUploadDirectoriesExist(config *Config) error { // Rename and return e
 	// Use MkdirAll which creates parent directories if needed and doesn't return error if dir exists
 	// Use more restrictive permissions (e.g., 0750)
 	if err := os.MkdirAll(config.Paths.TempChunkDir, 0750); err != nil {
-		log.Printf("[Startup] Error creating temp chunk directory '%s': %v", config.Paths.TempChunkDir, err)
+		storageLog.Error("Error creating temp chunk directory", "path", config.Paths.TempChunkDir, "error", err)
 		return fmt.Errorf("failed to create temp chunk directory: %w", err)
 	}
-	log.Printf("[Startup] Ensured temp chunk directory exists: %s", config.Paths.TempChunkDir)
+	storageLog.Debug("Ensured temp chunk directory exists", "path", config.Paths.TempChunkDir)
 
 	if err := os.MkdirAll(config.Paths.FinalUploadDir, 0750); err != nil {
-		log.Printf("[Startup] Error creating final upload directory '%s': %v", config.Paths.FinalUploadDir, err)
+		storageLog.Error("Error creating final upload directory", "path", config.Paths.FinalUploadDir, "error", err)
 		return fmt.Errorf("failed to create final upload directory: %w", err)
 	}
-	log.Printf("[Startup] Ensured final upload directory exists: %s", config.Paths.FinalUploadDir)
+	storageLog.Debug("Ensured final upload directory exists", "path", config.Paths.FinalUploadDir)
 	return nil
 }
 
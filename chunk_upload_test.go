@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// initTestUpload 调用 /api/upload/init，body 为 JSON 请求体
+func initTestUpload(t *testing.T, body string) (*httptest.ResponseRecorder, InitUploadResponse) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/upload/init", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := serveTestRequest(http.MethodPost, "/api/upload/init", InitUploadHandler(), req)
+	var response InitUploadResponse
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("decode init response %s: %v", w.Body.String(), err)
+		}
+	}
+	return w, response
+}
+
+// putChunk 通过 PUT /api/upload/:uploadId/chunks/:n 上传一个分片，headers 依次为名称和值
+func putChunk(uploadID string, n int, data []byte, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPut, "/api/upload/"+uploadID+"/chunks/"+strconv.Itoa(n), bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	return serveTestRequest(http.MethodPut, "/api/upload/:uploadId/chunks/:n", RawChunkUploadHandler(), req)
+}
+
+// uploadStatus 返回 /api/upload/status 报告的上传状态
+func uploadStatus(t *testing.T, uploadID string) UploadStatusResponse {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/api/upload/status?uploadId="+uploadID, nil)
+	w := serveTestRequest(http.MethodGet, "/api/upload/status", CheckUploadStatusHandler(), req)
+	var status UploadStatusResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("decode status response %s: %v", w.Body.String(), err)
+	}
+	return status
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestUploadIntegrityChecks(t *testing.T) {
+	content := []byte("encrypted file contents")
+	cases := []struct {
+		name       string
+		fileSHA256 string // 初始化时声明的整体摘要
+		chunkSum   string // X-Chunk-Sha256
+		wantCode   int
+		wantState  string
+		wantReason string
+	}{
+		{"verified", sha256Hex(content), sha256Hex(content), http.StatusOK, UploadStateComplete, ""},
+		{"chunk checksum mismatch", sha256Hex(content), sha256Hex([]byte("other")), http.StatusUnprocessableEntity, UploadStateFailed, UploadFailureChecksumMismatch},
+		{"digest mismatch", sha256Hex([]byte("other")), sha256Hex(content), http.StatusOK, UploadStateFailed, UploadFailureDigestMismatch},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			setupTestStorage(t, StorageModePersistent)
+			w, upload := initTestUpload(t, `{"fileName": "file.bin", "fileSize": `+strconv.Itoa(len(content))+`, "sha256": "`+tc.fileSHA256+`"}`)
+			if w.Code != http.StatusOK {
+				t.Fatalf("init returned %d: %s", w.Code, w.Body.String())
+			}
+			if w := putChunk(upload.UploadID, 1, content, "X-Chunk-Sha256", tc.chunkSum); w.Code != tc.wantCode {
+				t.Fatalf("chunk returned %d, want %d: %s", w.Code, tc.wantCode, w.Body.String())
+			}
+			waitBackgroundJobs(t)
+
+			status := uploadStatus(t, upload.UploadID)
+			if status.State != tc.wantState || status.FailureReason != tc.wantReason {
+				t.Fatalf("status = %s (%s), want %s (%s)", status.State, status.FailureReason, tc.wantState, tc.wantReason)
+			}
+			if tc.wantState != UploadStateComplete {
+				return
+			}
+			if status.Digest != sha256Hex(content) {
+				t.Fatalf("status digest = %q", status.Digest)
+			}
+
+			// 元数据保存完成时的摘要，下载时作为 Digest 和 ETag 返回
+			body := `{"id": "` + upload.UploadID + `", "iv": "iv", "salt": "salt", "originalFilename": "file.bin", "contentType": "application/octet-stream"}`
+			req := httptest.NewRequest(http.MethodPost, "/api/store/metadata", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			if w := serveTestRequest(http.MethodPost, "/api/store/metadata", StoreMetadataHandler(), req); w.Code != http.StatusOK {
+				t.Fatalf("store metadata returned %d: %s", w.Code, w.Body.String())
+			}
+			w = download(upload.UploadID)
+			sum := sha256.Sum256(content)
+			if w.Code != http.StatusOK || w.Body.String() != string(content) {
+				t.Fatalf("download: %d %q", w.Code, w.Body.String())
+			}
+			if got, want := w.Header().Get("Digest"), "sha-256="+base64.StdEncoding.EncodeToString(sum[:]); got != want {
+				t.Fatalf("Digest = %q, want %q", got, want)
+			}
+			if got, want := w.Header().Get("ETag"), `"`+sha256Hex(content)+`"`; got != want {
+				t.Fatalf("ETag = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestRawChunkUpload(t *testing.T) {
+	cfg := setupTestStorage(t, StorageModePersistent)
+	chunkSize := int(cfg.Upload.chunkSize())
+	content := bytes.Repeat([]byte("0123456789"), (chunkSize+20)/10)
+	w, upload := initTestUpload(t, `{"fileName": "file.bin", "fileSize": `+strconv.Itoa(len(content))+`}`)
+	if w.Code != http.StatusOK || upload.TotalChunks != 2 {
+		t.Fatalf("init returned %d: %s", w.Code, w.Body.String())
+	}
+
+	// 请求体必须是带 Content-Length 的 application/octet-stream
+	if w := putChunk(upload.UploadID, 1, content[:chunkSize], "Content-Type", "multipart/form-data"); w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("chunk with a multipart Content-Type returned %d", w.Code)
+	}
+	req := httptest.NewRequest(http.MethodPut, "/api/upload/"+upload.UploadID+"/chunks/1", bytes.NewReader(content[:chunkSize]))
+	req.ContentLength = -1
+	if w := serveTestRequest(http.MethodPut, "/api/upload/:uploadId/chunks/:n", RawChunkUploadHandler(), req); w.Code != http.StatusLengthRequired {
+		t.Fatalf("chunk without Content-Length returned %d", w.Code)
+	}
+	req = httptest.NewRequest(http.MethodPut, "/api/upload/"+upload.UploadID+"/chunks/1", bytes.NewReader(content[:chunkSize]))
+	req.ContentLength = maxUploadBytes(cfg) + 1
+	if w := serveTestRequest(http.MethodPut, "/api/upload/:uploadId/chunks/:n", RawChunkUploadHandler(), req); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("chunk with an oversized Content-Length returned %d", w.Code)
+	}
+
+	// 分片可以乱序到达，各自写到自己的偏移处
+	if w := putChunk(upload.UploadID, 2, content[chunkSize:]); w.Code != http.StatusOK {
+		t.Fatalf("chunk 2 returned %d: %s", w.Code, w.Body.String())
+	}
+	if w := putChunk(upload.UploadID, 1, content[:chunkSize]); w.Code != http.StatusOK {
+		t.Fatalf("chunk 1 returned %d: %s", w.Code, w.Body.String())
+	}
+	waitBackgroundJobs(t)
+
+	if status := uploadStatus(t, upload.UploadID); status.State != UploadStateComplete || status.Digest != sha256Hex(content) {
+		t.Fatalf("status = %s (%s), digest %q", status.State, status.FailureReason, status.Digest)
+	}
+}
+
+func TestMultipartChunkUpload(t *testing.T) {
+	setupTestStorage(t, StorageModePersistent)
+	content := []byte("encrypted file contents")
+	w, upload := initTestUpload(t, `{"fileName": "file.bin", "fileSize": `+strconv.Itoa(len(content))+`}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("init returned %d: %s", w.Code, w.Body.String())
+	}
+
+	// 旧客户端仍然可以用 multipart/form-data 上传分片
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, value := range map[string]string{
+		"uploadId":    upload.UploadID,
+		"chunkNumber": "1",
+		"totalChunks": "1",
+		"fileName":    "file.bin",
+		"fileSize":    strconv.Itoa(len(content)),
+		"chunkSha256": sha256Hex(content),
+	} {
+		form.WriteField(name, value)
+	}
+	part, _ := form.CreateFormFile("chunk", "blob")
+	part.Write(content)
+	form.Close()
+	req := httptest.NewRequest(http.MethodPost, "/api/upload/chunk", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if w := serveTestRequest(http.MethodPost, "/api/upload/chunk", ChunkUploadHandler(), req); w.Code != http.StatusOK {
+		t.Fatalf("multipart chunk returned %d: %s", w.Code, w.Body.String())
+	}
+	waitBackgroundJobs(t)
+
+	if status := uploadStatus(t, upload.UploadID); status.State != UploadStateComplete || status.Digest != sha256Hex(content) {
+		t.Fatalf("status = %s (%s), digest %q", status.State, status.FailureReason, status.Digest)
+	}
+}
+
+func TestUploadSizeLimits(t *testing.T) {
+	cfg := setupTestStorage(t, StorageModePersistent)
+	limit := maxUploadBytes(cfg)
+	if w, _ := initTestUpload(t, `{"fileName": "file.bin", "fileSize": `+strconv.FormatInt(limit+1, 10)+`}`); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("init over the limit returned %d", w.Code)
+	}
+
+	chunkSize := int(cfg.Upload.chunkSize())
+	content := bytes.Repeat([]byte{'x'}, chunkSize+10)
+	w, upload := initTestUpload(t, `{"fileName": "file.bin", "fileSize": `+strconv.Itoa(len(content))+`}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("init returned %d: %s", w.Code, w.Body.String())
+	}
+	// 分片编号在 1..totalChunks 之内，大小与初始化时确定的布局一致
+	for _, tc := range []struct {
+		number int
+		data   []byte
+	}{
+		{0, content[:chunkSize]},
+		{3, content[chunkSize:]},
+		{2, content[chunkSize-10:]},
+		{1, content},
+	} {
+		if w := putChunk(upload.UploadID, tc.number, tc.data); w.Code != http.StatusBadRequest {
+			t.Fatalf("chunk %d of %d bytes returned %d", tc.number, len(tc.data), w.Code)
+		}
+	}
+	if status := uploadStatus(t, upload.UploadID); status.ReceivedBytes != 0 || status.State != UploadStateInitialized {
+		t.Fatalf("status after rejected chunks = %+v", status)
+	}
+
+	// 累计字节数不能超过声明的大小
+	if _, err := GetStorageManager().uploads.RecordChunk(upload.UploadID, 1, UploadChunk{Size: int64(len(content)) + 1}); !errors.Is(err, errUploadTooLarge) {
+		t.Fatalf("RecordChunk over the declared size = %v, want errUploadTooLarge", err)
+	}
+}
+
+func TestCancelUpload(t *testing.T) {
+	cfg := setupTestStorage(t, StorageModePersistent)
+	chunkSize := int(cfg.Upload.chunkSize())
+	content := bytes.Repeat([]byte{'x'}, chunkSize+10)
+	w, upload := initTestUpload(t, `{"fileName": "file.bin", "fileSize": `+strconv.Itoa(len(content))+`}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("init returned %d: %s", w.Code, w.Body.String())
+	}
+	if w := putChunk(upload.UploadID, 1, content[:chunkSize]); w.Code != http.StatusOK {
+		t.Fatalf("chunk 1 returned %d: %s", w.Code, w.Body.String())
+	}
+	uploadDir := filepath.Join(cfg.Paths.FinalUploadDir, upload.UploadID)
+	if _, err := os.Stat(uploadDir); err != nil {
+		t.Fatalf("upload directory missing before cancel: %v", err)
+	}
+
+	cancel := func(authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodDelete, "/api/upload/"+upload.UploadID, nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		return serveTestRequest(http.MethodDelete, "/api/upload/:uploadId", CancelUploadHandler(), req)
+	}
+	for _, authorization := range []string{"", "Bearer wrong"} {
+		if w := cancel(authorization); w.Code != http.StatusForbidden {
+			t.Fatalf("cancel with Authorization %q returned %d", authorization, w.Code)
+		}
+	}
+
+	// 取消会中断正在进行的完成过程
+	ctx, done := GetStorageManager().uploads.beginFinalize(upload.UploadID)
+	defer done()
+	if w := cancel("Bearer " + upload.CancelToken); w.Code != http.StatusOK {
+		t.Fatalf("cancel returned %d: %s", w.Code, w.Body.String())
+	}
+	if !errors.Is(context.Cause(ctx), errUploadCancelled) {
+		t.Fatalf("finalize context after cancel: %v", context.Cause(ctx))
+	}
+
+	// 之后的分片得到明确的 410，已写入的数据已被删除
+	if w := putChunk(upload.UploadID, 2, content[chunkSize:]); w.Code != http.StatusGone {
+		t.Fatalf("chunk after cancel returned %d: %s", w.Code, w.Body.String())
+	}
+	if status := uploadStatus(t, upload.UploadID); status.State != UploadStateCancelled || status.ReceivedBytes != 0 {
+		t.Fatalf("status after cancel = %+v", status)
+	}
+	if _, err := os.Stat(uploadDir); !os.IsNotExist(err) {
+		t.Fatalf("upload directory after cancel: %v", err)
+	}
+}
+
+func TestInitUploadAdvertisesParameters(t *testing.T) {
+	cfg := setupTestStorage(t, StorageModePersistent)
+	cfg.Upload.MaxChunks = 4
+	cfg.Upload.Parallelism = 2
+	cfg.Upload.SessionTTL = "1h"
+	cfg.GC.Enabled = true
+	chunkSize := cfg.Upload.chunkSize()
+
+	w, upload := initTestUpload(t, `{"fileName": "file.bin", "fileSize": `+strconv.FormatInt(2*chunkSize+10, 10)+`}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("init returned %d: %s", w.Code, w.Body.String())
+	}
+	if upload.ChunkSize != chunkSize || upload.TotalChunks != 3 || upload.MaxChunks != 4 || upload.MaxFileSize != maxUploadBytes(cfg) || upload.Parallelism != 2 || upload.SessionTTL != 3600 {
+		t.Fatalf("init response = %+v", upload)
+	}
+
+	for _, tc := range []struct {
+		body string
+		want int
+	}{
+		{`"fileSize": ` + strconv.FormatInt(2*chunkSize, 10) + `, "chunkSize": ` + strconv.FormatInt(2*chunkSize, 10), http.StatusBadRequest},
+		{`"fileSize": ` + strconv.FormatInt(2*chunkSize, 10) + `, "totalChunks": 3`, http.StatusBadRequest},
+		{`"fileSize": ` + strconv.FormatInt(4*chunkSize+1, 10), http.StatusRequestEntityTooLarge},
+		// 只有一个分片时客户端可以声明更大的分片大小
+		{`"fileSize": 10, "chunkSize": ` + strconv.FormatInt(2*chunkSize, 10) + `, "totalChunks": 1`, http.StatusOK},
+	} {
+		if w, _ := initTestUpload(t, `{"fileName": "file.bin", `+tc.body+`}`); w.Code != tc.want {
+			t.Fatalf("init with %s returned %d, want %d: %s", tc.body, w.Code, tc.want, w.Body.String())
+		}
+	}
+
+	// 同时写入的分片超过 parallelism 时返回 429
+	uploads := GetStorageManager().uploads
+	for i := 0; i < cfg.Upload.Parallelism; i++ {
+		if !uploads.acquireChunkSlot(upload.UploadID, cfg.Upload.Parallelism) {
+			t.Fatalf("acquireChunkSlot %d failed", i+1)
+		}
+		defer uploads.releaseChunkSlot(upload.UploadID)
+	}
+	w = putChunk(upload.UploadID, 1, bytes.Repeat([]byte{'x'}, int(chunkSize)))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("chunk over the parallelism limit returned %d", w.Code)
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
 	"strings" // Added for string manipulation
@@ -33,6 +32,89 @@ type ExpirationConfig struct {
 	DefaultDuration    string             `yaml:"default_duration"`    // Default primary expiration (e.g., "24h")
 	AvailableDurations []string           `yaml:"available_durations"` // Options for "free" mode
 	AccessWindow       AccessWindowConfig `yaml:"access_window"`       // Access window settings
+	BurnWorkers        int                `yaml:"burn_workers"`        // Max concurrent burns of expired data
+}
+
+// S3Config holds settings for an S3-compatible object storage backend.
+type S3Config struct {
+	Endpoint        string `yaml:"endpoint"`                        // e.g. "https://s3.amazonaws.com" or "http://127.0.0.1:9000"
+	Region          string `yaml:"region"`                          // Optional region
+	Bucket          string `yaml:"bucket"`                          // Bucket holding the encrypted blobs
+	Prefix          string `yaml:"prefix"`                          // Optional key prefix, e.g. "uploads/"
+	AccessKeyID     string `yaml:"access_key_id" secret:"true"`     // Falls back to AWS_/MINIO_ env vars or IAM when empty
+	SecretAccessKey string `yaml:"secret_access_key" secret:"true"` //
+	SessionToken    string `yaml:"session_token" secret:"true"`     // Optional
+	ForcePathStyle  bool   `yaml:"force_path_style"`                // Use path-style URLs (MinIO and most local stand-ins)
+}
+
+// MemoryStorageConfig holds settings for storage mode "memory".
+type MemoryStorageConfig struct {
+	MaxSizeMB int `yaml:"max_size_mb"` // 元数据、分片与加密文件总共可占用的内存上限
+}
+
+// UploadConfig holds the chunked upload parameters advertised by /api/upload/init.
+type UploadConfig struct {
+	ChunkSizeMB int    `yaml:"chunk_size_mb"` // 除最后一个分片外每个分片的大小 (默认 5)
+	MaxChunks   int    `yaml:"max_chunks"`    // 单个上传最多的分片数 (默认 10000)
+	Parallelism int    `yaml:"parallelism"`   // 每个上传同时上传的分片数上限 (默认 4)
+	SessionTTL  string `yaml:"session_ttl"`   // 未完成、失败或已取消的上传在最后一次活动后保留多久 (默认 "24h")，由后台回收执行
+}
+
+// chunkSize 返回分片大小 (字节)
+func (u UploadConfig) chunkSize() int64 {
+	return int64(u.ChunkSizeMB) * 1024 * 1024
+}
+
+// sessionTTL 返回解析后的上传会话 TTL (已在加载配置时校验)
+func (u UploadConfig) sessionTTL() time.Duration {
+	ttl, _ := time.ParseDuration(u.SessionTTL)
+	return ttl
+}
+
+// shutdownTimeout 返回解析后的关闭等待时间 (已在加载配置时校验)
+func (c *Config) shutdownTimeout() time.Duration {
+	timeout, _ := time.ParseDuration(c.Server.ShutdownTimeout)
+	return timeout
+}
+
+// GCConfig holds settings for the reaper of abandoned uploads and orphaned blobs/metadata.
+// Abandoned uploads are reclaimed after upload.session_ttl.
+type GCConfig struct {
+	Enabled     bool   `yaml:"enabled"`      // 是否启用后台回收
+	Interval    string `yaml:"interval"`     // 两次回收之间的间隔 (默认 "15m")
+	OrphanGrace string `yaml:"orphan_grace"` // 已上传完成但一直没有保存元数据的文件保留多久 (默认 "1h")
+}
+
+// durations 返回解析后的回收间隔和孤立文件宽限期 (已在加载配置时校验)
+func (gc GCConfig) durations() (interval, orphanGrace time.Duration) {
+	interval, _ = time.ParseDuration(gc.Interval)
+	orphanGrace, _ = time.ParseDuration(gc.OrphanGrace)
+	return interval, orphanGrace
+}
+
+// AdminConfig holds settings for the operator-only /api/admin endpoints.
+type AdminConfig struct {
+	Token string `yaml:"token" secret:"true"` // Bearer token for /api/admin/*; admin endpoints are disabled when empty
+}
+
+// MetricsConfig holds settings for the Prometheus /metrics endpoint.
+type MetricsConfig struct {
+	Enabled bool   `yaml:"enabled"`             // 是否提供 /metrics
+	Listen  string `yaml:"listen"`              // 独立监听地址，例如 "127.0.0.1:9100"；为空时挂在主服务上
+	Token   string `yaml:"token" secret:"true"` // Bearer token；挂在主服务上时必填
+}
+
+// StorageConfig 选择元数据与加密文件的存储后端
+type StorageConfig struct {
+	Mode    string              `yaml:"mode"`    // "persistent" (默认) 或 "memory" (只保存在内存中，重启即全部销毁)
+	Backend string              `yaml:"backend"` // "filesystem" (默认) 或 "s3" (加密文件保存在对象存储，元数据仍在本地)
+	S3      S3Config            `yaml:"s3"`      // Settings for backend "s3"
+	Memory  MemoryStorageConfig `yaml:"memory"`  // Settings for mode "memory"
+}
+
+// InMemory 报告是否启用了纯内存模式 (不向磁盘写入任何数据)
+func (s StorageConfig) InMemory() bool {
+	return s.Mode == StorageModeMemory
 }
 
 type Config struct {
@@ -51,11 +133,12 @@ type Config struct {
 		// LogFilePath string `yaml:"log_file_path"` // Keep this under Logging section
 	} `yaml:"paths"`
 	Server struct {
-		Host           string   `yaml:"host"`
-		Port           int      `yaml:"port"`
-		MaxFileSizeMB  int      `yaml:"max_file_size_mb"`          // 新增：最大文件上传大小 (MB)
-		AllowedOrigins []string `yaml:"allowed_origins,omitempty"` // 新增：允许的 CORS 来源
-		TLS            struct {
+		Host            string   `yaml:"host"`
+		Port            int      `yaml:"port"`
+		MaxFileSizeMB   int      `yaml:"max_file_size_mb"`          // 新增：最大文件上传大小 (MB)
+		AllowedOrigins  []string `yaml:"allowed_origins,omitempty"` // 新增：允许的 CORS 来源
+		ShutdownTimeout string   `yaml:"shutdown_timeout"`          // 收到 SIGTERM 后等待请求和后台任务结束的时间 (默认 "30s")
+		TLS             struct {
 			Enabled  bool   `yaml:"enabled"`
 			Domain   string `yaml:"domain"`
 			Email    string `yaml:"email"`
@@ -66,7 +149,12 @@ type Config struct {
 		EncryptionKeyLength int    `yaml:"encryption_key_length"`
 		EncryptionAlgorithm string `yaml:"encryption_algorithm"`
 	} `yaml:"security"`
+	Admin      AdminConfig      `yaml:"admin"`      // 管理接口设置
+	Metrics    MetricsConfig    `yaml:"metrics"`    // Prometheus 指标
+	Storage    StorageConfig    `yaml:"storage"`    // 存储后端设置
 	Expiration ExpirationConfig `yaml:"expiration"` // Added expiration settings
+	Upload     UploadConfig     `yaml:"upload"`     // 分片上传参数
+	GC         GCConfig         `yaml:"gc"`         // 回收被放弃的上传和孤立文件
 	Frontend   struct {
 		Theme        string `yaml:"theme"`
 		MatrixEffect bool   `yaml:"matrix_effect"`
@@ -118,14 +206,21 @@ type Config struct {
 		GenerateShortLink string `yaml:"generate_short_link"`
 	} `yaml:"api_endpoints"`
 	Logging struct {
-		Level    string `yaml:"level"`
-		Format   string `yaml:"format"`
+		Level    string `yaml:"level"`  // debug、info (默认)、warn 或 error
+		Format   string `yaml:"format"` // "text" (默认) 或 "json"
 		Handlers struct {
-			Console struct{} `yaml:"console"`
+			Console struct{} `yaml:"console"` // 总是输出到 stderr
 			File    struct {
-				Path string `yaml:"path"`
+				Path       string `yaml:"path"`        // 同时写入的日志文件，为空时不写文件
+				MaxSizeMB  int    `yaml:"max_size_mb"` // 超过此大小后轮转 (默认 100)
+				MaxAge     string `yaml:"max_age"`     // 打开超过此时间后轮转 (默认 "24h")
+				MaxBackups int    `yaml:"max_backups"` // 保留的旧日志文件数 (默认 7)
 			} `yaml:"file"`
 		} `yaml:"handlers"`
+		AccessLog bool   `yaml:"access_log"`                // 每个请求记录一行访问日志 (方法、路由模板、状态码、耗时、字节数)
+		RedactIDs bool   `yaml:"redact_ids"`                // 日志中以带密钥的哈希代替数据 ID、上传 ID 和短链接
+		IDHashKey string `yaml:"id_hash_key" secret:"true"` // 计算哈希的密钥，为空时每次启动随机生成
+		ClientIP  string `yaml:"client_ip"`                 // 客户端 IP 的记录方式: "truncate" (默认)、"full" 或 "drop"
 	} `yaml:"logging"`
 	Messages struct {
 		EncryptionSuccess string `yaml:"encryption_success"`
@@ -145,6 +240,8 @@ type Config struct {
 		Error              string `yaml:"error"`
 		Success            string `yaml:"success"`
 	} `yaml:"ui_text"`
+
+	sources map[string]string // 每个配置项的来源 (flag、env、file 或 default)，见 logConfigSources
 }
 
 func LoadConfig(configFile string) (*Config, error) {
@@ -165,11 +262,23 @@ func LoadConfig(configFile string) (*Config, error) {
 	if err != nil {
 		return nil, fmt.Errorf("解析配置文件失败: %w", err)
 	}
+	sources, err := fileConfigSources(data)
+	if err != nil {
+		return nil, fmt.Errorf("解析配置文件失败: %w", err)
+	}
+
+	// 环境变量和命令行 -set 覆盖配置文件
+	if err := applyConfigOverrides(&config, sources); err != nil {
+		return nil, fmt.Errorf("应用配置覆盖失败: %w", err)
+	}
 
 	// 验证和补充配置
+	before := config
 	if err := validateAndNormalizeConfig(&config); err != nil {
 		return nil, fmt.Errorf("配置验证失败: %w", err)
 	}
+	markDefaultSources(&before, &config, sources)
+	config.sources = sources
 
 	return &config, nil
 }
@@ -179,53 +288,141 @@ func validateAndNormalizeConfig(config *Config) error {
 	// 验证并设置默认路径
 	if config.Paths.DataStorageDir == "" {
 		config.Paths.DataStorageDir = "storage"
-		log.Println("警告: 未指定数据存储目录，使用默认值: storage")
+		configLog.Warn("未指定数据存储目录，使用默认值: storage")
 	}
 
 	if config.Paths.TempChunkDir == "" {
 		config.Paths.TempChunkDir = "temp-files"
-		log.Println("警告: 未指定临时分片目录，使用默认值: temp-files")
+		configLog.Warn("未指定临时分片目录，使用默认值: temp-files")
 	}
 
 	if config.Paths.FinalUploadDir == "" {
 		config.Paths.FinalUploadDir = "uploads"
-		log.Println("警告: 未指定最终上传目录，使用默认值: uploads")
+		configLog.Warn("未指定最终上传目录，使用默认值: uploads")
+	}
+
+	// 验证并设置存储模式
+	if config.Storage.Mode == "" {
+		config.Storage.Mode = StorageModePersistent
+	}
+	switch config.Storage.Mode {
+	case StorageModePersistent:
+	case StorageModeMemory:
+		if config.Storage.Memory.MaxSizeMB <= 0 {
+			config.Storage.Memory.MaxSizeMB = 256
+			configLog.Warn("未指定内存存储上限，使用默认值: 256MB")
+		}
+	default:
+		return fmt.Errorf("无效的存储模式 (storage.mode): %s，必须是 'persistent' 或 'memory'", config.Storage.Mode)
+	}
+
+	// 验证并设置存储后端
+	if config.Storage.Backend == "" {
+		config.Storage.Backend = StorageBackendFilesystem
+	}
+	switch config.Storage.Backend {
+	case StorageBackendFilesystem:
+	case StorageBackendS3:
+		if config.Storage.S3.Endpoint == "" {
+			return fmt.Errorf("使用 s3 存储后端时必须指定 storage.s3.endpoint")
+		}
+		if config.Storage.S3.Bucket == "" {
+			return fmt.Errorf("使用 s3 存储后端时必须指定 storage.s3.bucket")
+		}
+	default:
+		return fmt.Errorf("无效的存储后端 (storage.backend): %s，必须是 'filesystem' 或 's3'", config.Storage.Backend)
 	}
 
 	// 验证并设置服务器配置
 	if config.Server.Port <= 0 || config.Server.Port > 65535 {
 		config.Server.Port = 3003
-		log.Println("警告: 端口号无效，使用默认端口: 3003")
+		configLog.Warn("端口号无效，使用默认端口: 3003")
 	}
 
 	if config.Server.MaxFileSizeMB <= 0 {
 		config.Server.MaxFileSizeMB = 100
-		log.Println("警告: 未指定最大文件大小，使用默认值: 100MB")
+		configLog.Warn("未指定最大文件大小，使用默认值: 100MB")
+	}
+
+	if config.Server.ShutdownTimeout == "" {
+		config.Server.ShutdownTimeout = "30s"
+	}
+	if d, err := time.ParseDuration(config.Server.ShutdownTimeout); err != nil || d <= 0 {
+		return fmt.Errorf("无效的关闭等待时间格式 (server.shutdown_timeout: %s)", config.Server.ShutdownTimeout)
 	}
 
 	// 验证并设置安全配置
 	if config.Security.EncryptionKeyLength <= 0 {
 		config.Security.EncryptionKeyLength = 256
-		log.Println("警告: 未指定加密密钥长度，使用默认值: 256位")
+		configLog.Warn("未指定加密密钥长度，使用默认值: 256位")
 	}
 
 	if config.Security.EncryptionAlgorithm == "" {
 		config.Security.EncryptionAlgorithm = "AES-GCM"
-		log.Println("警告: 未指定加密算法，使用默认值: AES-GCM")
+		configLog.Warn("未指定加密算法，使用默认值: AES-GCM")
+	}
+
+	// 指标接口不能在公网上无鉴权地暴露
+	if config.Metrics.Enabled && config.Metrics.Listen == "" && config.Metrics.Token == "" {
+		return fmt.Errorf("启用 metrics 时必须设置 metrics.listen (独立监听地址) 或 metrics.token")
+	}
+
+	// 分片上传参数的默认值: 5MB 分片，最多 10000 个，每个上传同时 4 个分片，未完成的上传保留 24 小时
+	if config.Upload.ChunkSizeMB <= 0 {
+		config.Upload.ChunkSizeMB = 5
+	}
+	if config.Storage.Backend == StorageBackendS3 && config.Upload.ChunkSizeMB < 5 {
+		return fmt.Errorf("使用 s3 存储后端时 upload.chunk_size_mb 不能小于 5 (对象存储的分段下限)")
+	}
+	if config.Upload.MaxChunks <= 0 {
+		config.Upload.MaxChunks = 10000
+	}
+	if config.Storage.Backend == StorageBackendS3 && config.Upload.MaxChunks > s3MaxParts {
+		return fmt.Errorf("使用 s3 存储后端时 upload.max_chunks 不能大于 %d (对象存储的分段数上限)", s3MaxParts)
+	}
+	if config.Upload.Parallelism <= 0 {
+		config.Upload.Parallelism = 4
+	}
+	if config.Upload.SessionTTL == "" {
+		config.Upload.SessionTTL = "24h"
+	}
+	if d, err := time.ParseDuration(config.Upload.SessionTTL); err != nil || d <= 0 {
+		return fmt.Errorf("无效的上传会话 TTL 格式 (upload.session_ttl: %s)", config.Upload.SessionTTL)
+	}
+
+	// 回收任务的默认值: 每 15 分钟一次，没有元数据的文件保留 1 小时
+	if config.GC.Enabled {
+		if config.GC.Interval == "" {
+			config.GC.Interval = "15m"
+		}
+		if config.GC.OrphanGrace == "" {
+			config.GC.OrphanGrace = "1h"
+		}
+		for key, value := range map[string]string{
+			"gc.interval":     config.GC.Interval,
+			"gc.orphan_grace": config.GC.OrphanGrace,
+		} {
+			if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+				return fmt.Errorf("无效的回收时间格式 (%s: %s)", key, value)
+			}
+		}
 	}
 
 	// Validate and set default expiration settings
 	if config.Expiration.Enabled {
+		if config.Expiration.BurnWorkers <= 0 {
+			config.Expiration.BurnWorkers = 4
+		}
 		if config.Expiration.Mode == "" {
 			config.Expiration.Mode = "free" // Default to free mode
-			log.Println("警告: 未指定有效期模式 (expiration.mode)，使用默认值: free")
+			configLog.Warn("未指定有效期模式 (expiration.mode)，使用默认值: free")
 		}
 		if config.Expiration.Mode != "forced" && config.Expiration.Mode != "free" {
 			return fmt.Errorf("无效的有效期模式 (expiration.mode): %s，必须是 'forced' 或 'free'", config.Expiration.Mode)
 		}
 		if config.Expiration.DefaultDuration == "" {
 			config.Expiration.DefaultDuration = "24h" // Default to 24 hours
-			log.Println("警告: 未指定默认有效期 (expiration.default_duration)，使用默认值: 24h")
+			configLog.Warn("未指定默认有效期 (expiration.default_duration)，使用默认值: 24h")
 		}
 		// Validate DefaultDuration format
 		if _, err := time.ParseDuration(config.Expiration.DefaultDuration); err != nil {
@@ -236,7 +433,7 @@ func validateAndNormalizeConfig(config *Config) error {
 		if config.Expiration.Mode == "free" {
 			if len(config.Expiration.AvailableDurations) == 0 {
 				config.Expiration.AvailableDurations = []string{"1h", "24h", "168h"} // Default options
-				log.Println("警告: 未指定可用有效期选项 (expiration.available_durations)，使用默认值: [1h, 24h, 168h]")
+				configLog.Warn("未指定可用有效期选项 (expiration.available_durations)，使用默认值: [1h, 24h, 168h]")
 			}
 			for _, dur := range config.Expiration.AvailableDurations {
 				if _, err := time.ParseDuration(dur); err != nil {
@@ -249,7 +446,7 @@ func validateAndNormalizeConfig(config *Config) error {
 		if config.Expiration.AccessWindow.Enabled {
 			if config.Expiration.AccessWindow.DefaultDuration == "" {
 				config.Expiration.AccessWindow.DefaultDuration = "10m" // Default access window
-				log.Println("警告: 未指定默认访问窗口期 (expiration.access_window.default_duration)，使用默认值: 10m")
+				configLog.Warn("未指定默认访问窗口期 (expiration.access_window.default_duration)，使用默认值: 10m")
 			}
 			if _, err := time.ParseDuration(config.Expiration.AccessWindow.DefaultDuration); err != nil {
 				return fmt.Errorf("无效的默认访问窗口期格式 (expiration.access_window.default_duration: %s): %w", config.Expiration.AccessWindow.DefaultDuration, err)
@@ -272,19 +469,19 @@ func validateAndNormalizeConfig(config *Config) error {
 			}
 		}
 	} else {
-		log.Println("信息: 有效期功能未启用 (expiration.enabled is false or not set)")
+		configLog.Info("有效期功能未启用 (expiration.enabled is false or not set)")
 	}
 	if config.Expiration.Enabled {
 		if config.Expiration.Mode == "" {
 			config.Expiration.Mode = "free" // Default to free mode
-			log.Println("警告: 未指定有效期模式 (expiration.mode)，使用默认值: free")
+			configLog.Warn("未指定有效期模式 (expiration.mode)，使用默认值: free")
 		}
 		if config.Expiration.Mode != "forced" && config.Expiration.Mode != "free" {
 			return fmt.Errorf("无效的有效期模式 (expiration.mode): %s，必须是 'forced' 或 'free'", config.Expiration.Mode)
 		}
 		if config.Expiration.DefaultDuration == "" {
 			config.Expiration.DefaultDuration = "24h" // Default to 24 hours
-			log.Println("警告: 未指定默认有效期 (expiration.default_duration)，使用默认值: 24h")
+			configLog.Warn("未指定默认有效期 (expiration.default_duration)，使用默认值: 24h")
 		}
 		// Validate DefaultDuration format
 		if _, err := time.ParseDuration(config.Expiration.DefaultDuration); err != nil {
@@ -295,7 +492,7 @@ func validateAndNormalizeConfig(config *Config) error {
 		if config.Expiration.Mode == "free" {
 			if len(config.Expiration.AvailableDurations) == 0 {
 				config.Expiration.AvailableDurations = []string{"1h", "24h", "168h"} // Default options
-				log.Println("警告: 未指定可用有效期选项 (expiration.available_durations)，使用默认值: [1h, 24h, 168h]")
+				configLog.Warn("未指定可用有效期选项 (expiration.available_durations)，使用默认值: [1h, 24h, 168h]")
 			}
 			for _, dur := range config.Expiration.AvailableDurations {
 				if _, err := time.ParseDuration(dur); err != nil {
@@ -308,7 +505,7 @@ func validateAndNormalizeConfig(config *Config) error {
 		if config.Expiration.AccessWindow.Enabled {
 			if config.Expiration.AccessWindow.DefaultDuration == "" {
 				config.Expiration.AccessWindow.DefaultDuration = "10m" // Default access window
-				log.Println("警告: 未指定默认访问窗口期 (expiration.access_window.default_duration)，使用默认值: 10m")
+				configLog.Warn("未指定默认访问窗口期 (expiration.access_window.default_duration)，使用默认值: 10m")
 			}
 			if _, err := time.ParseDuration(config.Expiration.AccessWindow.DefaultDuration); err != nil {
 				return fmt.Errorf("无效的默认访问窗口期格式 (expiration.access_window.default_duration: %s): %w", config.Expiration.AccessWindow.DefaultDuration, err)
@@ -331,7 +528,45 @@ func validateAndNormalizeConfig(config *Config) error {
 			}
 		}
 	} else {
-		log.Println("信息: 有效期功能未启用 (expiration.enabled is false or not set)")
+		configLog.Info("有效期功能未启用 (expiration.enabled is false or not set)")
+	}
+
+	// 验证并设置日志配置
+	if config.Logging.Level == "" {
+		config.Logging.Level = "info"
+	}
+	if _, err := parseLogLevel(config.Logging.Level); err != nil {
+		return fmt.Errorf("无效的日志级别 (logging.level: %s)，必须是 debug、info、warn 或 error", config.Logging.Level)
+	}
+	config.Logging.Format = strings.ToLower(config.Logging.Format)
+	if config.Logging.Format != LogFormatText && config.Logging.Format != LogFormatJSON {
+		if config.Logging.Format != "" {
+			configLog.Warn("不支持的日志格式，使用默认值: text", "format", config.Logging.Format)
+		}
+		config.Logging.Format = LogFormatText
+	}
+	config.Logging.ClientIP = strings.ToLower(config.Logging.ClientIP)
+	switch config.Logging.ClientIP {
+	case "":
+		config.Logging.ClientIP = LogClientIPTruncate
+	case LogClientIPTruncate, LogClientIPFull, LogClientIPDrop:
+	default:
+		return fmt.Errorf("无效的客户端 IP 记录方式 (logging.client_ip: %s)，必须是 truncate、full 或 drop", config.Logging.ClientIP)
+	}
+	if config.Logging.Handlers.File.Path != "" {
+		file := &config.Logging.Handlers.File
+		if file.MaxSizeMB <= 0 {
+			file.MaxSizeMB = 100
+		}
+		if file.MaxAge == "" {
+			file.MaxAge = "24h"
+		}
+		if d, err := time.ParseDuration(file.MaxAge); err != nil || d <= 0 {
+			return fmt.Errorf("无效的日志轮转时间格式 (logging.handlers.file.max_age: %s)", file.MaxAge)
+		}
+		if file.MaxBackups <= 0 {
+			file.MaxBackups = 7
+		}
 	}
 
 	// 规范化路径（确保所有路径都是绝对路径）
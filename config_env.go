@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// 配置项的来源，优先级从高到低: 命令行 -set、环境变量、配置文件、默认值
+const (
+	configSourceFlag    = "flag"
+	configSourceEnv     = "env"
+	configSourceFile    = "file"
+	configSourceDefault = "default"
+)
+
+// configEnvPrefix 是覆盖配置项的环境变量前缀: server.port 对应 BIU_SERVER_PORT，
+// BIU_SERVER_PORT_FILE 则从文件读取 (适合 Docker secrets 等挂载的敏感配置)。
+const configEnvPrefix = "BIU_"
+
+// configFlagOverrides 是命令行 -set key=value 指定的配置项，优先于环境变量和配置文件
+var configFlagOverrides configOverrides
+
+// configOverrides 实现 flag.Value，-set 可以重复使用
+type configOverrides []string
+
+func (o *configOverrides) String() string {
+	return strings.Join(*o, ",")
+}
+
+func (o *configOverrides) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return fmt.Errorf("格式应为 key=value，例如 server.port=3003")
+	}
+	*o = append(*o, value)
+	return nil
+}
+
+// configField 是配置中的一个叶子字段
+type configField struct {
+	key    string        // YAML 路径，例如 "expiration.default_duration"
+	value  reflect.Value // 可写的字段值
+	secret bool          // 带有 `secret:"true"` 标签，日志中隐藏
+}
+
+// configFields 按声明顺序列出 c 的所有叶子字段，嵌套的结构体逐层展开
+func configFields(c *Config) []configField {
+	var fields []configField
+	var walk func(v reflect.Value, prefix string)
+	walk = func(v reflect.Value, prefix string) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			sf := t.Field(i)
+			name, _, _ := strings.Cut(sf.Tag.Get("yaml"), ",")
+			if !sf.IsExported() || name == "" || name == "-" {
+				continue
+			}
+			if sf.Type.Kind() == reflect.Struct {
+				walk(v.Field(i), prefix+name+".")
+				continue
+			}
+			fields = append(fields, configField{
+				key:    prefix + name,
+				value:  v.Field(i),
+				secret: sf.Tag.Get("secret") == "true",
+			})
+		}
+	}
+	walk(reflect.ValueOf(c).Elem(), "")
+	return fields
+}
+
+// configEnvName 返回配置项对应的环境变量名，例如 server.max_file_size_mb -> BIU_SERVER_MAX_FILE_SIZE_MB
+func configEnvName(key string) string {
+	return configEnvPrefix + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// setConfigValue 把字符串形式的值写入字段: 字符串原样使用，字符串列表以逗号分隔
+// (也可以写成 YAML 的 [a, b])，其他类型 (数字、布尔值、规则列表等) 按 YAML 解析
+func setConfigValue(field reflect.Value, raw string) error {
+	switch {
+	case field.Kind() == reflect.String:
+		field.SetString(raw)
+		return nil
+	case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(raw), "["):
+		items := []string{}
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+		return nil
+	}
+	target := reflect.New(field.Type())
+	if err := yaml.Unmarshal([]byte(raw), target.Interface()); err != nil {
+		return err
+	}
+	field.Set(target.Elem())
+	return nil
+}
+
+// fileConfigSources 记录配置文件中出现的配置项
+func fileConfigSources(data []byte) (map[string]string, error) {
+	var doc map[string]any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	sources := make(map[string]string)
+	var walk func(m map[string]any, prefix string)
+	walk = func(m map[string]any, prefix string) {
+		for name, value := range m {
+			if nested, ok := value.(map[string]any); ok {
+				walk(nested, prefix+name+".")
+				continue
+			}
+			sources[prefix+name] = configSourceFile
+		}
+	}
+	walk(doc, "")
+	return sources, nil
+}
+
+// applyConfigOverrides 依次应用环境变量 (BIU_<KEY> 或 BIU_<KEY>_FILE) 和命令行 -set，
+// 并在 sources 中记录被覆盖的配置项
+func applyConfigOverrides(c *Config, sources map[string]string) error {
+	byKey := make(map[string]configField)
+	for _, f := range configFields(c) {
+		byKey[f.key] = f
+
+		name := configEnvName(f.key)
+		raw, ok := os.LookupEnv(name)
+		if path, fromFile := os.LookupEnv(name + "_FILE"); fromFile {
+			if ok {
+				return fmt.Errorf("%s 与 %s_FILE 不能同时设置", name, name)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("读取 %s_FILE 失败: %w", name, err)
+			}
+			raw, ok = strings.TrimRight(string(data), "\r\n"), true
+		}
+		if !ok {
+			continue
+		}
+		if err := setConfigValue(f.value, raw); err != nil {
+			return fmt.Errorf("无效的环境变量 %s: %w", name, err)
+		}
+		sources[f.key] = configSourceEnv
+	}
+
+	for _, override := range configFlagOverrides {
+		key, raw, _ := strings.Cut(override, "=")
+		f, ok := byKey[key]
+		if !ok {
+			return fmt.Errorf("未知的配置项 (-set %s)", key)
+		}
+		if err := setConfigValue(f.value, raw); err != nil {
+			return fmt.Errorf("无效的配置项 -set %s: %w", override, err)
+		}
+		sources[key] = configSourceFlag
+	}
+	return nil
+}
+
+// markDefaultSources 把没有来源、但被 validateAndNormalizeConfig 补上的配置项记为默认值
+func markDefaultSources(before, after *Config, sources map[string]string) {
+	original := configFields(before)
+	for i, f := range configFields(after) {
+		if sources[f.key] == "" && !reflect.DeepEqual(original[i].value.Interface(), f.value.Interface()) {
+			sources[f.key] = configSourceDefault
+		}
+	}
+}
+
+// logConfigSources 在一行日志中列出每个生效的配置项及其来源，敏感配置项只显示是否已设置
+func logConfigSources(c *Config) {
+	configLog.Info("Effective configuration", "settings", strings.Join(configSourceEntries(c), ", "))
+}
+
+// configSourceEntries 按声明顺序为每个叶子配置项返回 "key=value (source)"。
+// 没有记录来源的配置项既不在配置文件中，也没有被覆盖或补上默认值，使用的是零值默认值。
+func configSourceEntries(c *Config) []string {
+	var entries []string
+	for _, f := range configFields(c) {
+		source := c.sources[f.key]
+		if source == "" {
+			source = configSourceDefault
+		}
+		value := fmt.Sprintf("%v", f.value.Interface())
+		if f.secret && !f.value.IsZero() {
+			value = "******"
+		}
+		entries = append(entries, fmt.Sprintf("%s=%s (%s)", f.key, value, source))
+	}
+	return entries
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestConfig 把 yaml 写入临时目录中的 config.yaml 并返回路径
+func writeTestConfig(t *testing.T, yaml string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0640); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	return path
+}
+
+func TestConfigSourceEntriesListEveryField(t *testing.T) {
+	path := writeTestConfig(t, "server:\n  port: 3010\nadmin:\n  token: \"file-secret\"\n")
+	t.Setenv("BIU_GC_INTERVAL", "5m")
+	loaded, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+
+	entries := configSourceEntries(loaded)
+	if len(entries) != len(configFields(loaded)) {
+		t.Fatalf("%d entries for %d fields", len(entries), len(configFields(loaded)))
+	}
+	joined := strings.Join(entries, ", ")
+	for _, want := range []string{
+		"server.port=3010 (file)",
+		"admin.token=****** (file)",
+		"gc.interval=5m (env)",
+		"storage.s3.secret_access_key= (default)", // 未设置的配置项同样列出
+	} {
+		if !strings.Contains(joined, want) {
+			t.Errorf("entries missing %q", want)
+		}
+	}
+	if strings.Contains(joined, "file-secret") {
+		t.Errorf("secret value leaked into the log: %s", joined)
+	}
+}
+
+// setTestFlagOverrides 模拟命令行 -set，测试结束后恢复
+func setTestFlagOverrides(t *testing.T, overrides ...string) {
+	t.Helper()
+	previous := configFlagOverrides
+	configFlagOverrides = overrides
+	t.Cleanup(func() { configFlagOverrides = previous })
+}
+
+func TestConfigOverridePrecedence(t *testing.T) {
+	path := writeTestConfig(t, "server:\n  port: 3010\n  max_file_size_mb: 10\nupload:\n  parallelism: 3\n")
+	secretPath := filepath.Join(t.TempDir(), "admin-token")
+	if err := os.WriteFile(secretPath, []byte("mounted-secret\n"), 0640); err != nil {
+		t.Fatalf("write secret: %v", err)
+	}
+	t.Setenv("BIU_SERVER_PORT", "3020")
+	t.Setenv("BIU_SERVER_MAX_FILE_SIZE_MB", "20")
+	t.Setenv("BIU_ADMIN_TOKEN_FILE", secretPath)
+	setTestFlagOverrides(t, "server.port=3030")
+
+	// 命令行 -set 优先于环境变量，环境变量优先于配置文件；_FILE 读取文件内容并去掉末尾换行
+	loaded, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	for _, tc := range []struct {
+		key    string
+		got    any
+		want   any
+		source string
+	}{
+		{"server.port", loaded.Server.Port, 3030, configSourceFlag},
+		{"server.max_file_size_mb", loaded.Server.MaxFileSizeMB, 20, configSourceEnv},
+		{"upload.parallelism", loaded.Upload.Parallelism, 3, configSourceFile},
+		{"admin.token", loaded.Admin.Token, "mounted-secret", configSourceEnv},
+		{"upload.max_chunks", loaded.Upload.MaxChunks, 10000, configSourceDefault},
+	} {
+		if tc.got != tc.want || loaded.sources[tc.key] != tc.source {
+			t.Errorf("%s = %v (%s), want %v (%s)", tc.key, tc.got, loaded.sources[tc.key], tc.want, tc.source)
+		}
+	}
+}
+
+func TestConfigOverrideErrors(t *testing.T) {
+	path := writeTestConfig(t, "server:\n  port: 3010\n")
+	cases := []struct {
+		name  string
+		env   map[string]string
+		flags []string
+	}{
+		{"env and _FILE", map[string]string{"BIU_ADMIN_TOKEN": "a", "BIU_ADMIN_TOKEN_FILE": path}, nil},
+		{"missing _FILE", map[string]string{"BIU_ADMIN_TOKEN_FILE": filepath.Join(t.TempDir(), "missing")}, nil},
+		{"invalid env value", map[string]string{"BIU_SERVER_PORT": "not-a-port"}, nil},
+		{"unknown -set key", nil, []string{"server.no_such_key=1"}},
+		{"invalid -set value", nil, []string{"server.port=abc"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			for name, value := range tc.env {
+				t.Setenv(name, value)
+			}
+			setTestFlagOverrides(t, tc.flags...)
+			if _, err := LoadConfig(path); err == nil {
+				t.Fatalf("LoadConfig succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// expiryRetryDelay 是销毁失败后重新排队前的等待时间
+const expiryRetryDelay = 1 * time.Minute
+
+// expiryDeadline 返回数据的实际到期时间: ExpiresAt 与 AccessWindowEndsAt 中较早的一个
+func expiryDeadline(data *StoredData) (time.Time, bool) {
+	var deadline time.Time
+	if data.ExpiresAt != nil {
+		deadline = *data.ExpiresAt
+	}
+	if data.AccessWindowEndsAt != nil && (deadline.IsZero() || data.AccessWindowEndsAt.Before(deadline)) {
+		deadline = *data.AccessWindowEndsAt
+	}
+	return deadline, !deadline.IsZero()
+}
+
+// expiryReason 区分数据是因为主有效期还是访问窗口到期而被销毁
+func expiryReason(data *StoredData) string {
+	if data.AccessWindowEndsAt != nil && (data.ExpiresAt == nil || data.AccessWindowEndsAt.Before(*data.ExpiresAt)) {
+		return burnReasonAccessWindow
+	}
+	return burnReasonExpired
+}
+
+// expiryEntry 是到期索引中的一项
+type expiryEntry struct {
+	id       string
+	deadline time.Time
+	index    int // Position in the heap, maintained by expiryHeap
+}
+
+// expiryHeap 是按到期时间排序的最小堆，实现 heap.Interface
+type expiryHeap []*expiryEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x any) {
+	entry := x.(*expiryEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	n := len(old)
+	entry := old[n-1]
+	old[n-1] = nil
+	entry.index = -1
+	*h = old[:n-1]
+	return entry
+}
+
+// expiryIndex 在内存中记录所有带有到期时间的数据，避免定期扫描整个存储。
+// 由 StorageManager 在写入、更新和删除元数据时维护，启动时从存储重建。
+type expiryIndex struct {
+	mu      sync.Mutex
+	heap    expiryHeap
+	entries map[string]*expiryEntry
+	wake    chan struct{} // 最早到期时间变化时通知调度器
+}
+
+func newExpiryIndex() *expiryIndex {
+	return &expiryIndex{
+		entries: make(map[string]*expiryEntry),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Track 根据元数据更新 id 的到期时间，没有到期时间的数据会从索引中移除
+func (idx *expiryIndex) Track(id string, data *StoredData) {
+	deadline, ok := expiryDeadline(data)
+	if !ok {
+		idx.Remove(id)
+		return
+	}
+	idx.schedule(id, deadline)
+}
+
+// schedule 把 id 的到期时间设为 deadline
+func (idx *expiryIndex) schedule(id string, deadline time.Time) {
+	idx.mu.Lock()
+	if entry, ok := idx.entries[id]; ok {
+		entry.deadline = deadline
+		heap.Fix(&idx.heap, entry.index)
+	} else {
+		entry = &expiryEntry{id: id, deadline: deadline}
+		heap.Push(&idx.heap, entry)
+		idx.entries[id] = entry
+	}
+	earliest := idx.heap[0].id == id
+	idx.mu.Unlock()
+
+	if earliest {
+		idx.notify()
+	}
+}
+
+// Remove 从索引中移除 id
+func (idx *expiryIndex) Remove(id string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if entry, ok := idx.entries[id]; ok {
+		heap.Remove(&idx.heap, entry.index)
+		delete(idx.entries, id)
+	}
+}
+
+// Len 返回索引中的数据条数
+func (idx *expiryIndex) Len() int {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return len(idx.entries)
+}
+
+func (idx *expiryIndex) notify() {
+	select {
+	case idx.wake <- struct{}{}:
+	default: // A wake-up is already pending
+	}
+}
+
+// Page 按 id 排序返回排在 after 之后的最多 limit 个 id，后面还有更多时 more 为 true。
+// 用于分批遍历所有数据而不读取整个存储。
+func (idx *expiryIndex) Page(after string, limit int) (ids []string, more bool) {
+	idx.mu.Lock()
+	for id := range idx.entries {
+		if id > after {
+			ids = append(ids, id)
+		}
+	}
+	idx.mu.Unlock()
+
+	sort.Strings(ids)
+	if len(ids) > limit {
+		return ids[:limit], true
+	}
+	return ids, false
+}
+
+// popDue 取出所有在 now 之前到期的 id，并返回下一个到期时间 (没有则为零值)
+func (idx *expiryIndex) popDue(now time.Time) ([]string, time.Time) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	var due []string
+	for len(idx.heap) > 0 && !idx.heap[0].deadline.After(now) {
+		entry := heap.Pop(&idx.heap).(*expiryEntry)
+		delete(idx.entries, entry.id)
+		due = append(due, entry.id)
+	}
+	if len(idx.heap) == 0 {
+		return due, time.Time{}
+	}
+	return due, idx.heap[0].deadline
+}
+
+// Rebuild 从存储后端重新构建索引 (启动时调用)
+func (idx *expiryIndex) Rebuild(store MetadataStore) error {
+	count := 0
+	err := store.IterateMetadata(func(id string, data *StoredData) error {
+		if _, ok := expiryDeadline(data); ok {
+			idx.Track(id, data)
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	cleanupLog.Info("Expiry index rebuilt", "entries", count)
+	return nil
+}
+
+// expiryJob 是一次清理周期中的一个到期数据
+type expiryJob struct {
+	id    string
+	cycle *sync.WaitGroup
+}
+
+// run 在数据到期时把它交给 burn 处理，最多同时运行 workers 个销毁任务。
+// stop 关闭后不再分发，等正在进行的销毁结束后返回；未分发的数据在下次启动重建索引时重新调度。
+func (idx *expiryIndex) run(workers int, burn func(id string), stop <-chan struct{}) {
+	jobs := make(chan expiryJob, workers)
+	var running sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			for job := range jobs {
+				burn(job.id)
+				job.cycle.Done()
+			}
+		}()
+	}
+	defer func() {
+		close(jobs)
+		running.Wait()
+	}()
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		due, next := idx.popDue(time.Now())
+		if len(due) > 0 {
+			// 一个周期从分发开始，到这一批数据全部处理完为止；等待放在后台，不阻塞调度
+			cycleStart := time.Now()
+			cycle := &sync.WaitGroup{}
+			cycle.Add(len(due))
+			for i, id := range due {
+				select {
+				case jobs <- expiryJob{id: id, cycle: cycle}: // Blocks while all workers are busy
+				case <-stop:
+					cycle.Add(i - len(due)) // Not dispatched
+					return
+				}
+			}
+			go func() {
+				cycle.Wait()
+				metricCleanupDuration.Observe(time.Since(cycleStart).Seconds())
+			}()
+		}
+
+		wait := time.Hour
+		if !next.IsZero() {
+			wait = time.Until(next)
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-timer.C:
+		case <-idx.wake:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// startCleanupTask 启动到期销毁调度器，取代原来的每分钟全量扫描
+func startCleanupTask(config *Config) {
+	workers := config.Expiration.BurnWorkers
+	cleanupLog.Info("Starting expiry scheduler", "burnWorkers", workers)
+	index := GetStorageManager().expiry
+	index.run(workers, func(id string) {
+		burnExpiredData(currentConfig(), index, id)
+	}, backgroundJobs.Stopping())
+	cleanupLog.Info("Expiry scheduler stopped")
+}
+
+// burnExpiredData 在确认数据仍然到期后销毁它；销毁失败时稍后重试
+func burnExpiredData(config *Config, index *expiryIndex, id string) {
+	store := GetStorageManager()
+	metadata, err := store.GetMetadata(id)
+	if errors.Is(err, ErrNotFound) {
+		return // Already burned
+	}
+	if err != nil {
+		cleanupLog.Error("Error reading metadata, retrying later", "id", id, "error", err, "retryIn", expiryRetryDelay)
+		index.schedule(id, time.Now().Add(expiryRetryDelay))
+		return
+	}
+
+	// 到期时间可能在排队期间被修改
+	deadline, ok := expiryDeadline(metadata)
+	if !ok || time.Now().Before(deadline) {
+		index.Track(id, metadata)
+		return
+	}
+
+	cleanupLog.Info("Data expired, initiating burn", "id", id, "deadline", deadline)
+	if err := burnData(config, id, expiryReason(metadata)); err != nil {
+		cleanupLog.Error("Error during background burn, retrying later", "id", id, "error", err, "retryIn", expiryRetryDelay)
+		index.schedule(id, time.Now().Add(expiryRetryDelay))
+		return
+	}
+	cleanupLog.Debug("Background burn completed", "id", id)
+	metricCleanupBurned.Inc()
+}
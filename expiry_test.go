@@ -0,0 +1,93 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExpiryIndexPopsInDeadlineOrder(t *testing.T) {
+	idx := newExpiryIndex()
+	base := time.Now()
+	at := func(d time.Duration) *time.Time {
+		deadline := base.Add(d)
+		return &deadline
+	}
+
+	idx.Track("c", &StoredData{ExpiresAt: at(3 * time.Minute)})
+	idx.Track("a", &StoredData{ExpiresAt: at(1 * time.Minute)})
+	idx.Track("b", &StoredData{ExpiresAt: at(2 * time.Minute)})
+	idx.Track("d", &StoredData{ExpiresAt: at(4 * time.Minute)})
+	// 访问窗口早于主有效期时以访问窗口为准
+	idx.Track("e", &StoredData{ExpiresAt: at(time.Hour), AccessWindowEndsAt: at(90 * time.Second)})
+	// 重新 Track 会调整位置，没有到期时间的数据被移出索引
+	idx.Track("c", &StoredData{ExpiresAt: at(30 * time.Second)})
+	idx.Track("d", &StoredData{})
+	idx.Track("never", &StoredData{})
+	idx.Remove("b")
+	idx.Remove("missing")
+
+	if got := idx.Len(); got != 3 {
+		t.Fatalf("Len() = %d, want 3", got)
+	}
+
+	due, next := idx.popDue(base)
+	if len(due) != 0 {
+		t.Fatalf("popDue before any deadline returned %v", due)
+	}
+	if !next.Equal(base.Add(30 * time.Second)) {
+		t.Fatalf("next deadline = %v, want %v", next, base.Add(30*time.Second))
+	}
+
+	due, next = idx.popDue(base.Add(100 * time.Second))
+	if want := []string{"c", "a", "e"}; !reflect.DeepEqual(due, want) {
+		t.Fatalf("popDue = %v, want %v", due, want)
+	}
+	if !next.IsZero() || idx.Len() != 0 {
+		t.Fatalf("index not empty after popping everything: next=%v len=%d", next, idx.Len())
+	}
+}
+
+func TestExpiryIndexNotifiesOnEarlierDeadline(t *testing.T) {
+	idx := newExpiryIndex()
+	base := time.Now()
+	idx.schedule("a", base.Add(time.Hour))
+	<-idx.wake
+
+	// 晚于当前最早到期时间的数据不需要唤醒调度器
+	idx.schedule("b", base.Add(2*time.Hour))
+	select {
+	case <-idx.wake:
+		t.Fatalf("scheduler woken for a later deadline")
+	default:
+	}
+
+	idx.schedule("b", base.Add(time.Minute))
+	select {
+	case <-idx.wake:
+	default:
+		t.Fatalf("scheduler not woken for a new earliest deadline")
+	}
+}
+
+func TestExpiryIndexPage(t *testing.T) {
+	idx := newExpiryIndex()
+	deadline := time.Now().Add(time.Hour)
+	for _, id := range []string{"d", "b", "e", "a", "c"} {
+		idx.schedule(id, deadline)
+	}
+
+	var pages [][]string
+	cursor := ""
+	for {
+		ids, more := idx.Page(cursor, 2)
+		pages = append(pages, ids)
+		if !more {
+			break
+		}
+		cursor = ids[len(ids)-1]
+	}
+	if want := [][]string{{"a", "b"}, {"c", "d"}, {"e"}}; !reflect.DeepEqual(pages, want) {
+		t.Fatalf("pages = %v, want %v", pages, want)
+	}
+}
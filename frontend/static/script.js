@@ -1,6 +1,7 @@
 let isFileMode = false;
 let maxFileSizeMB = 15; // Default, will be updated from config
-const CHUNK_SIZE = 5 * 1024 * 1024; // 5MB chunk size
+const MAX_CHUNK_ATTEMPTS = 6; // 每个分片最多尝试次数 (断点续传)
+const CHUNK_RETRY_BASE_DELAY = 1000; // 重试等待时间，每次翻倍
 let serverConfig = {}; // To store config fetched from server
 let quillInstance = null; // To store the Quill instance
 
@@ -13,6 +14,7 @@ const fileInput = document.getElementById('fileInput');
 const fileSizeWarning = document.getElementById('fileSizeWarning');
 const encryptForm = document.getElementById('encryptForm');
 const submitBtn = document.getElementById('submitBtn');
+const cancelUploadBtn = document.getElementById('cancelUploadBtn');
 const loader = document.getElementById('loader');
 const statusDiv = document.getElementById('status');
 const errorDiv = document.getElementById('error');
@@ -22,12 +24,24 @@ const contentAreaDiv = document.getElementById('content-area');
 const decryptedContentDiv = document.getElementById('decrypted-content');
 const expirationSection = document.getElementById('expiration-section');
 const expirationDurationInput = document.getElementById('expirationDuration'); // Renamed variable for clarity
+const maxViewsInput = document.getElementById('maxViews');
+const burnOnReadCheckbox = document.getElementById('burnOnRead');
 
 // --- New Global Variables for Password Protection ---
 let isPasswordProtected = false;
 let passwordInput = null;
+let loadedResponseData = null; // 首次获取的数据，输入密码后复用，避免重复计入查看次数
+let revealConfirmed = false; // 用户是否已明确点击查看 (链接预览机器人不会点击)
+let activeUpload = null; // 正在进行的文件上传 { uploadId, cancelToken, cancelled }
 
 // --- Utility Functions ---
+
+// 读取"最多查看次数"，未填写或无效时返回 null
+function getMaxViews() {
+    if (!maxViewsInput) return null;
+    const value = parseInt(maxViewsInput.value, 10);
+    return Number.isInteger(value) && value > 0 ? value : null;
+}
 function arrayBufferToBase64(buffer) {
     let binary = '';
     const bytes = new Uint8Array(buffer);
@@ -55,13 +69,26 @@ function showStatus(message, isError = false) {
     targetDiv.classList.remove('hidden');
 }
 
-function showResult(url) {
+function showResult(url, manageToken) {
     hideMessages();
     linkElement.href = url;
     linkElement.textContent = url;
+    const manageTokenNote = document.getElementById('manageTokenNote');
+    if (manageTokenNote) {
+        document.getElementById('manageToken').textContent = manageToken || '';
+        manageTokenNote.classList.toggle('hidden', !manageToken);
+    }
     resultDiv.classList.remove('hidden');
 }
 
+// 销毁请求需要携带服务器随密文下发的销毁令牌
+function burnOnServer(dataId, burnToken) {
+    return fetch(`/api/burn/${dataId}`, {
+        method: 'POST',
+        headers: burnToken ? { 'Authorization': 'Bearer ' + burnToken } : {}
+    });
+}
+
 function hideMessages() {
     statusDiv.classList.add('hidden');
     errorDiv.classList.add('hidden');
@@ -78,6 +105,8 @@ function setLoading(isLoading) {
         loader.classList.add('hidden');
         submitBtn.disabled = false;
         submitBtn.textContent = '加密并生成链接';
+        cancelUploadBtn.classList.add('hidden');
+        activeUpload = null;
     }
 }
 
@@ -230,6 +259,25 @@ async function encryptData(dataBuffer, encryptionKey) {
     }
 }
 
+// 计算 SHA-256，返回十六进制字符串 (与服务器的分片/密文摘要格式一致)
+async function sha256Hex(buffer) {
+    const digest = await window.crypto.subtle.digest('SHA-256', buffer);
+    return Array.from(new Uint8Array(digest)).map(b => b.toString(16).padStart(2, '0')).join('');
+}
+
+// 如果服务器返回了 Digest 响应头，校验下载的密文是否完整
+async function verifyDownloadDigest(response, buffer) {
+    const digestHeader = response.headers.get('Digest');
+    if (!digestHeader || !digestHeader.startsWith('sha-256=')) {
+        return;
+    }
+    const expected = digestHeader.substring('sha-256='.length);
+    const actual = arrayBufferToBase64(await window.crypto.subtle.digest('SHA-256', buffer));
+    if (actual !== expected) {
+        throw new Error('下载的加密文件已损坏 (SHA-256 不匹配)，请重新下载。');
+    }
+}
+
 async function decryptData(encryptedBuffer, iv, encryptionKey) {
     try {
         const decryptedContent = await window.crypto.subtle.decrypt(
@@ -350,15 +398,17 @@ encryptForm.addEventListener('submit', async (event) => {
 async function handleChunkUpload(originalFilename, originalFilesize, contentType, encryptedFileBuffer, iv, salt, masterKeyBase64, encryptedMasterKey) {
     showStatus("正在初始化分片上传...");
 
-    // 1. Initialize Upload - 使用加密后的大小
+    // 1. Initialize Upload - 使用加密后的大小，服务器据此预分配文件并告知分片大小、分片数和并发上限
     let uploadId;
+    let upload;
     try {
         const initResponse = await fetch('/api/upload/init', {
             method: 'POST',
             headers: { 'Content-Type': 'application/json' },
             body: JSON.stringify({
                 fileName: originalFilename,
-                fileSize: encryptedFileBuffer.byteLength  // 使用加密后的实际大小
+                fileSize: encryptedFileBuffer.byteLength,  // 使用加密后的实际大小，服务器据此预分配文件
+                sha256: await sha256Hex(encryptedFileBuffer) // 服务器合并后校验
             })
         });
 
@@ -372,7 +422,22 @@ async function handleChunkUpload(originalFilename, originalFilesize, contentType
         if (!uploadId) {
             throw new Error("未能从服务器获取 Upload ID。");
         }
+        if (!initData.chunkSize || !initData.totalChunks) {
+            throw new Error("服务器没有返回分片参数。");
+        }
         console.log("Upload initialized with ID:", uploadId);
+        upload = {
+            uploadId: uploadId,
+            cancelToken: initData.cancelToken,
+            cancelled: false,
+            chunkSize: initData.chunkSize,                  // 第 n 个分片从 (n-1)*chunkSize 开始
+            totalChunks: initData.totalChunks,
+            parallelism: Math.max(1, initData.parallelism || 1)
+        };
+        activeUpload = upload;
+        if (initData.cancelToken) {
+            cancelUploadBtn.classList.remove('hidden');
+        }
         console.log("Encrypted file size:", encryptedFileBuffer.byteLength);
     } catch (error) {
         showStatus('错误: ' + error.message, true);
@@ -380,43 +445,49 @@ async function handleChunkUpload(originalFilename, originalFilesize, contentType
         return;
     }
 
-    // 2. Upload Chunks
-    const totalChunks = Math.ceil(encryptedFileBuffer.byteLength / CHUNK_SIZE);
-    console.log('Starting chunk upload: ' + totalChunks + ' chunks');
-
-    for (let chunkNumber = 1; chunkNumber <= totalChunks; chunkNumber++) {
-        const start = (chunkNumber - 1) * CHUNK_SIZE;
-        const end = Math.min(start + CHUNK_SIZE, encryptedFileBuffer.byteLength);
-        const chunkBlob = new Blob([encryptedFileBuffer.slice(start, end)]);
-
-        showStatus('正在上传分片 ' + chunkNumber + ' / ' + totalChunks + '...');
-
-        const formData = new FormData();
-        formData.append('uploadId', uploadId);
-        formData.append('chunkNumber', chunkNumber.toString());
-        formData.append('totalChunks', totalChunks.toString());
-        formData.append('fileName', originalFilename); // Send original filename
-        formData.append('fileSize', originalFilesize.toString()); // Send original filesize
-        formData.append('chunk', chunkBlob, 'chunk_' + chunkNumber); // Add chunk blob
-
-        try {
-            const chunkResponse = await fetch('/api/upload/chunk', {
-                method: 'POST',
-                body: formData // Send as FormData
-            });
-
-            if (!chunkResponse.ok) {
-                const errorData = await chunkResponse.json().catch(() => ({ message: '上传分片 ' + chunkNumber + ' 失败' }));
-                throw new Error('上传分片 ' + chunkNumber + ' 失败 (' + chunkResponse.status + '): ' + errorData.message);
-            }
-            const chunkResult = await chunkResponse.json();
-            console.log('Chunk ' + chunkNumber + ' uploaded:', chunkResult.message);
+    // 2. Upload Chunks - 按服务器允许的并发数同时上传多个分片
+    const totalChunks = upload.totalChunks;
+    console.log('Starting chunk upload: ' + totalChunks + ' chunks, ' + upload.parallelism + ' at a time');
+
+    let nextChunk = 1;
+    let uploadedChunks = 0;
+    let failed = false;
+    const worker = async () => {
+        while (nextChunk <= totalChunks && !failed && !upload.cancelled) {
+            const chunkNumber = nextChunk++;
+            const start = (chunkNumber - 1) * upload.chunkSize;
+            const end = Math.min(start + upload.chunkSize, encryptedFileBuffer.byteLength);
+            const chunkBlob = new Blob([encryptedFileBuffer.slice(start, end)]);
+            await uploadChunkWithResume(uploadId, chunkNumber, totalChunks, chunkBlob);
+            uploadedChunks++;
+            showStatus('正在上传分片 ' + uploadedChunks + ' / ' + totalChunks + '...');
+        }
+    };
 
-        } catch (error) {
+    showStatus('正在上传分片 0 / ' + totalChunks + '...');
+    try {
+        const workers = [];
+        for (let i = 0; i < Math.min(upload.parallelism, totalChunks); i++) {
+            workers.push(worker().catch(error => {
+                failed = true;
+                throw error;
+            }));
+        }
+        await Promise.all(workers);
+    } catch (error) {
+        if (upload.cancelled) {
+            showStatus('上传已取消');
+        } else {
             showStatus('错误: ' + error.message, true);
-            setLoading(false);
-            return; // Stop upload process
+            cancelActiveUpload(); // 释放服务器上已上传的分片
         }
+        setLoading(false);
+        return; // Stop upload process
+    }
+    if (upload.cancelled) {
+        showStatus('上传已取消');
+        setLoading(false);
+        return;
     }
 
     // 3. Finalize Upload (Polling and Metadata Storage)
@@ -424,87 +495,173 @@ async function handleChunkUpload(originalFilename, originalFilesize, contentType
     await finalizeUpload(uploadId, iv, salt, originalFilename, contentType, encryptedFileBuffer.byteLength, masterKeyBase64, encryptedMasterKey); // Pass contentType and encrypted size
 }
 
-async function finalizeUpload(uploadId, iv, salt, originalFilename, contentType, fileSize, masterKeyBase64, encryptedMasterKey) {
-    const pollInterval = 3000; // Poll every 3 seconds
-    let attempts = 0;
-    const maxAttempts = 20; // Max 1 minute of polling
-
-    const poll = async () => {
-        attempts++;
-        if (attempts > maxAttempts) {
-            throw new Error("服务器合并超时。请稍后再试。");
+// 取消正在进行的文件上传: 服务器停止接收分片、中断合并并删除已上传的数据
+async function cancelActiveUpload() {
+    const upload = activeUpload;
+    if (!upload || upload.cancelled || !upload.cancelToken) {
+        return;
+    }
+    upload.cancelled = true;
+    try {
+        const response = await fetch('/api/upload/' + upload.uploadId, {
+            method: 'DELETE',
+            headers: { 'Authorization': 'Bearer ' + upload.cancelToken }
+        });
+        if (!response.ok) {
+            console.warn('Cancelling upload ' + upload.uploadId + ' failed: ' + response.status);
         }
+    } catch (error) {
+        console.warn('Cancelling upload ' + upload.uploadId + ' failed:', error);
+    }
+}
+
+cancelUploadBtn.addEventListener('click', () => {
+    showStatus('正在取消上传...');
+    cancelActiveUpload();
+});
 
+// 上传单个分片。网络中断或服务器错误时等待后重试，重试前先查询服务器已接收的分片，
+// 已经收到的分片不再重发 (断点续传)。
+async function uploadChunkWithResume(uploadId, chunkNumber, totalChunks, chunkBlob) {
+    const chunkSha256 = await sha256Hex(await chunkBlob.arrayBuffer());
+    for (let attempt = 1; ; attempt++) {
+        let retryable = true;
+        let lastError;
         try {
-            const statusResponse = await fetch('/api/upload/status?uploadId=' + uploadId);
-            if (!statusResponse.ok) {
-                // If status is 404, it might mean the merge failed and cleaned up, or still processing
-                if (statusResponse.status === 404) {
-                     console.log('Polling attempt ' + attempts + ': Upload status not found yet.');
-                     setTimeout(poll, pollInterval); // Continue polling
-                     return;
-                }
-                const errorData = await statusResponse.json().catch(() => ({ message: '检查状态失败' }));
-                throw new Error('检查状态失败 (' + statusResponse.status + '): ' + errorData.message);
+            // 分片作为原始请求体上传，服务器直接流式写入存储
+            const chunkResponse = await fetch('/api/upload/' + uploadId + '/chunks/' + chunkNumber, {
+                method: 'PUT',
+                headers: {
+                    'Content-Type': 'application/octet-stream',
+                    'X-Chunk-Sha256': chunkSha256 // 服务器写入时校验
+                },
+                body: chunkBlob
+            });
+
+            if (chunkResponse.ok) {
+                const chunkResult = await chunkResponse.json();
+                console.log('Chunk ' + chunkNumber + ' uploaded:', chunkResult.message);
+                return;
             }
+            const errorData = await chunkResponse.json().catch(() => ({ message: '上传分片 ' + chunkNumber + ' 失败' }));
+            lastError = new Error('上传分片 ' + chunkNumber + ' 失败 (' + chunkResponse.status + '): ' + errorData.message);
+            // 429: 同时上传的分片超过服务器允许的并发数，稍后重试；410: 上传已取消
+            retryable = (chunkResponse.status >= 500 && chunkResponse.status !== 507) || chunkResponse.status === 429;
+        } catch (error) {
+            lastError = error; // Network error
+        }
 
-            const statusData = await statusResponse.json();
-
-            if (statusData.completed) {
-                console.log("Server reported merge completed.");
-                showStatus("文件合并成功，正在存储元数据...");
-
-                // Store metadata using the new endpoint
-                const ivBase64 = arrayBufferToBase64(iv);
-                const saltBase64 = arrayBufferToBase64(salt);
-                const metadataPayload = {
-                	id: uploadId,
-                	iv: ivBase64,
-                	salt: saltBase64,
-                	originalFilename: originalFilename,
-                	contentType: contentType, // Include contentType
-                	fileSize: fileSize,       // Include fileSize (encrypted size)
-                	passwordProtection: encryptedMasterKey,
-                	// Add setDuration if expiration section is visible and has a value
-                	...(expirationSection && !expirationSection.classList.contains('hidden') && expirationDurationInput.value.trim() && { setDuration: expirationDurationInput.value.trim() })
-                };
-
-                const metaResponse = await fetch('/api/store/metadata', {
-                    method: 'POST',
-                    headers: { 'Content-Type': 'application/json' },
-                    body: JSON.stringify(metadataPayload)
-                });
+        if (!retryable || attempt >= MAX_CHUNK_ATTEMPTS) {
+            throw lastError;
+        }
 
-                if (!metaResponse.ok) {
-                    const errorData = await metaResponse.json().catch(() => ({ message: '存储元数据失败' }));
-                    throw new Error('存储元数据失败 (' + metaResponse.status + '): ' + errorData.message);
-                }
+        const delay = CHUNK_RETRY_BASE_DELAY * Math.pow(2, attempt - 1);
+        console.log('Chunk ' + chunkNumber + ' failed (' + lastError.message + '), retrying in ' + delay + 'ms');
+        showStatus('网络中断，' + Math.round(delay / 1000) + ' 秒后继续上传分片 ' + chunkNumber + ' / ' + totalChunks + '...');
+        await new Promise(resolve => setTimeout(resolve, delay));
 
-                const metaResult = await metaResponse.json();
-                console.log("Metadata stored successfully:", metaResult);
+        // 请求可能已经到达服务器，只是响应丢失了
+        const received = await fetchReceivedChunks(uploadId).catch(() => null);
+        if (received && received.get(chunkNumber) === chunkBlob.size) {
+            console.log('Chunk ' + chunkNumber + ' already received by server, skipping');
+            return;
+        }
+    }
+}
 
-                const shareUrl = window.location.origin +
-                    window.location.pathname +
-                    '?id=' + uploadId +
-                    '#' + masterKeyBase64;
+// 查询服务器已接收的分片，返回 分片编号 -> 大小
+async function fetchReceivedChunks(uploadId) {
+    const statusResponse = await fetch('/api/upload/status?uploadId=' + uploadId);
+    if (!statusResponse.ok) {
+        throw new Error('检查状态失败 (' + statusResponse.status + ')');
+    }
+    const statusData = await statusResponse.json();
+    return new Map((statusData.chunks || []).map(chunk => [chunk.number, chunk.size]));
+}
 
-                showResult(shareUrl);
-                setLoading(false); // Upload complete
+async function finalizeUpload(uploadId, iv, salt, originalFilename, contentType, fileSize, masterKeyBase64, encryptedMasterKey) {
+    try {
+        await waitForUploadCompletion(uploadId);
+        console.log("Server reported upload completed.");
+        showStatus("文件合并成功，正在存储元数据...");
 
-            } else {
-                // Still merging, poll again
-                console.log('Polling attempt ' + attempts + ': Merge still in progress.');
-                setTimeout(poll, pollInterval);
-            }
+        // Store metadata using the new endpoint
+        const ivBase64 = arrayBufferToBase64(iv);
+        const saltBase64 = arrayBufferToBase64(salt);
+        const metadataPayload = {
+        	id: uploadId,
+        	iv: ivBase64,
+        	salt: saltBase64,
+        	originalFilename: originalFilename,
+        	contentType: contentType, // Include contentType
+        	fileSize: fileSize,       // Include fileSize (encrypted size)
+        	passwordProtection: encryptedMasterKey,
+        	// Add setDuration if expiration section is visible and has a value
+        	...(expirationSection && !expirationSection.classList.contains('hidden') && expirationDurationInput.value.trim() && { setDuration: expirationDurationInput.value.trim() }),
+        	...(getMaxViews() && { maxViews: getMaxViews() })
+        };
 
-        } catch (error) {
+        const metaResponse = await fetch('/api/store/metadata', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify(metadataPayload)
+        });
+
+        if (!metaResponse.ok) {
+            const errorData = await metaResponse.json().catch(() => ({ message: '存储元数据失败' }));
+            throw new Error('存储元数据失败 (' + metaResponse.status + '): ' + errorData.message);
+        }
+
+        const metaResult = await metaResponse.json();
+        console.log("Metadata stored successfully:", metaResult);
+
+        const shareUrl = window.location.origin +
+            window.location.pathname +
+            '?id=' + uploadId +
+            '#' + masterKeyBase64;
+
+        showResult(shareUrl, metaResult.manageToken);
+        setLoading(false); // Upload complete
+    } catch (error) {
+        if (activeUpload && activeUpload.cancelled) {
+            showStatus('上传已取消');
+        } else {
             showStatus('错误: ' + error.message, true);
-            setLoading(false); // Stop loading on polling error
         }
-    };
+        setLoading(false);
+    }
+}
+
+// 通过服务器推送的事件 (Server-Sent Events) 等待上传完成，不再轮询 /api/upload/status。
+// 连接中断时 EventSource 会自动重连，服务器在重连后先发送当前状态。
+function waitForUploadCompletion(uploadId) {
+    return new Promise((resolve, reject) => {
+        const source = new EventSource('/api/upload/' + uploadId + '/events');
+        const finish = (settle, value) => {
+            source.close();
+            settle(value);
+        };
 
-    // Start polling
-    poll();
+        source.addEventListener('merge-started', () => {
+            showStatus("所有分片已到达，服务器正在校验文件...");
+        });
+        source.addEventListener('merge-progress', event => {
+            const data = JSON.parse(event.data);
+            showStatus('服务器正在校验文件... ' + Math.floor(data.mergedBytes * 100 / data.fileSize) + '%');
+        });
+        source.addEventListener('completed', () => finish(resolve));
+        source.addEventListener('failed', event => {
+            const data = JSON.parse(event.data);
+            finish(reject, new Error('服务器合并失败 (' + data.failureReason + '): ' + (data.failureDetail || '')));
+        });
+        source.addEventListener('cancelled', () => finish(reject, new Error('上传已取消')));
+        source.onerror = () => {
+            // 服务器拒绝连接 (例如上传不存在) 时 EventSource 不会再重连
+            if (source.readyState === EventSource.CLOSED) {
+                finish(reject, new Error('无法获取上传进度，请稍后再试。'));
+            }
+        };
+    });
 }
 
 // --- Decryption on Load ---
@@ -523,19 +680,41 @@ async function handleDecryptionOnLoad() {
     setLoading(true);
 
     try {
-        console.log('Loading data for ID:', dataId);
-        const response = await fetch(`/api/data/${dataId}`);
-
-        if (response.status === 404) {
-            throw new Error('数据不存在或已被销毁');
+        let responseData = loadedResponseData;
+        if (!responseData && !revealConfirmed) {
+            // 先无副作用地查询，等待用户明确点击后再获取密文
+            const peekResponse = await fetch(`/api/data/${dataId}`);
+            if (peekResponse.status === 404) {
+                throw new Error('数据不存在或已被销毁');
+            }
+            if (!peekResponse.ok) {
+                throw new Error(`获取数据失败: ${peekResponse.statusText}`);
+            }
+            const peekData = await peekResponse.json();
+            if (peekData.needPassword) {
+                showPasswordPrompt(dataId);
+            } else {
+                showRevealPrompt(peekData);
+            }
+            setLoading(false);
+            return;
         }
+        if (!responseData) {
+            console.log('Revealing data for ID:', dataId);
+            const response = await fetch(`/api/data/${dataId}/reveal`, { method: 'POST' });
 
-        if (!response.ok) {
-            throw new Error(`获取数据失败: ${response.statusText}`);
-        }
+            if (response.status === 404) {
+                throw new Error('数据不存在或已被销毁');
+            }
+
+            if (!response.ok) {
+                throw new Error(`获取数据失败: ${response.statusText}`);
+            }
 
-        const responseData = await response.json();
-        console.log('Server response received');
+            responseData = await response.json();
+            loadedResponseData = responseData;
+            console.log('Server response received');
+        }
 
         // 如果数据需要密码保护
         if (responseData.passwordProtection) {
@@ -689,6 +868,7 @@ async function handleDecryptionOnLoad() {
         				}
         				const encryptedFileBuffer = await fetchResponse.arrayBuffer();
         				console.log('Encrypted file downloaded, size:', encryptedFileBuffer.byteLength);
+        				await verifyDownloadDigest(fetchResponse, encryptedFileBuffer);
         				fileStatusMsg.textContent = '文件下载完毕，正在解密...';
         				downloadBtn.textContent = '正在解密...';
 
@@ -735,9 +915,20 @@ async function handleDecryptionOnLoad() {
         				URL.revokeObjectURL(objectUrl);
 
         				// 9. Send burn request *after* successful decryption and download trigger
+        				// 设置了查看次数限制时由服务器计数并销毁，不再主动销毁
+        				const remainingViews = fetchResponse.headers.get('X-Remaining-Views');
+        				if (remainingViews !== null) {
+        					fileStatusMsg.innerHTML += Number(remainingViews) > 0
+        						? `<br><small>剩余下载次数: ${escapeHTML(remainingViews)}</small>`
+        						: '<br><small>已达到下载次数上限，服务器记录已删除。</small>';
+        					return;
+        				}
         				console.log('Sending burn request for file metadata after successful processing...');
         				try {
-        					await fetch(`/api/burn/${fileId}`, { method: 'POST' });
+        					const burnResponse = await burnOnServer(fileId, fetchResponse.headers.get('X-Burn-Token'));
+        					if (!burnResponse.ok && burnResponse.status !== 404) {
+        						throw new Error(`HTTP ${burnResponse.status}`);
+        					}
         					console.log('Burn request sent successfully for file metadata.');
         					fileStatusMsg.innerHTML += '<br><small>服务器记录已删除。</small>';
         				} catch (burnError) {
@@ -850,10 +1041,23 @@ async function handleDecryptionOnLoad() {
 
                     setLoading(false);
 
-        			// Send burn request for text data
+        			// Send burn request for text data (unless the server already burned it or is counting views)
+        			if (responseData.burned) {
+        				decryptedContentDiv.innerHTML += '<br><br><small>此消息已在读取时从服务器删除。</small>';
+        				return;
+        			}
+        			if (responseData.remainingViews !== undefined) {
+        				decryptedContentDiv.innerHTML += responseData.remainingViews > 0
+        					? `<br><br><small>剩余查看次数: ${responseData.remainingViews}</small>`
+        					: '<br><br><small>已达到查看次数上限，此消息已从服务器删除。</small>';
+        				return;
+        			}
         			console.log('Sending burn request for text...');
         			try {
-        				await fetch(`/api/burn/${dataId}`, { method: 'POST' });
+        				const burnResponse = await burnOnServer(dataId, responseData.burnToken);
+        				if (!burnResponse.ok && burnResponse.status !== 404) {
+        					throw new Error(`HTTP ${burnResponse.status}`);
+        				}
         				decryptedContentDiv.innerHTML += '<br><br><small>此消息已从服务器删除。</small>';
         			} catch (error) {
         				console.error('Burn request failed for text:', error);
@@ -876,6 +1080,29 @@ async function handleDecryptionOnLoad() {
     }
 }
 
+// 显示数据概况和"查看"按钮，点击后才真正获取密文
+function showRevealPrompt(peekData) {
+    const typeLabel = peekData.type === 'file' ? '文件' : '文本消息';
+    const sizeLabels = { small: '较小', medium: '中等', large: '较大' };
+    let details = `类型: ${typeLabel}，大小: ${sizeLabels[peekData.sizeClass] || '未知'}`;
+    if (peekData.expiresInSeconds !== undefined) {
+        details += `，剩余时间: ${Math.max(1, Math.ceil(peekData.expiresInSeconds / 60))} 分钟`;
+    }
+    if (peekData.remainingViews !== undefined) {
+        details += `，剩余查看次数: ${peekData.remainingViews}`;
+    }
+
+    decryptedContentDiv.innerHTML = `
+        <p>有人给你发送了一条阅后即焚的${typeLabel}。</p>
+        <p><small>${escapeHTML(details)}</small></p>
+        <button id="revealBtn" class="button">查看内容</button>
+    `;
+    document.getElementById('revealBtn').onclick = () => {
+        revealConfirmed = true;
+        handleDecryptionOnLoad();
+    };
+}
+
 // --- Password Protection Functions ---
 function showPasswordPrompt(dataId) {
     const promptDiv = document.createElement('div');
@@ -902,6 +1129,7 @@ function showPasswordPrompt(dataId) {
             return;
         }
         passwordInput = enteredPassword; // Store password globally for this attempt
+        revealConfirmed = true; // Submitting the password is an explicit reveal
         handleDecryptionOnLoad(); // Re-run decryption logic with the password
     };
 
@@ -921,6 +1149,7 @@ async function submitPassword(id) {
         return;
     }
     passwordInput = password; // Store password globally
+    revealConfirmed = true;
     handleDecryptionOnLoad(); // Re-run decryption logic
 }
 
@@ -1064,7 +1293,9 @@ async function handleTextEncryption(masterKeyBase64, salt, encryptionKey, encryp
         	contentType: selectedContentType, // Add the selected content type
         	passwordProtection: encryptedMasterKey,
         	// Add setDuration if expiration section is visible and has a value
-        	...(expirationSection && !expirationSection.classList.contains('hidden') && expirationDurationInput.value.trim() && { setDuration: expirationDurationInput.value.trim() })
+        	...(expirationSection && !expirationSection.classList.contains('hidden') && expirationDurationInput.value.trim() && { setDuration: expirationDurationInput.value.trim() }),
+        	...(getMaxViews() && { maxViews: getMaxViews() }),
+        	...(burnOnReadCheckbox && burnOnReadCheckbox.checked && { burnOnRead: true })
         };
 
         const response = await fetch('/api/store', {
@@ -1090,7 +1321,7 @@ async function handleTextEncryption(masterKeyBase64, salt, encryptionKey, encryp
             '?id=' + resultData.id +
             '#' + masterKeyBase64;
 
-        showResult(shareUrl);
+        showResult(shareUrl, resultData.manageToken);
         setLoading(false);
     } catch (error) {
         console.error("文本加密过程失败:", error);
@@ -1114,6 +1345,7 @@ async function handlePreview(fileId, masterKeyBase64, contentType, filename, ivB
             throw new Error(`获取预览数据失败: ${response.statusText}`);
         }
         const encryptedData = await response.arrayBuffer();
+        await verifyDownloadDigest(response, encryptedData);
 
         // 解密数据
         const iv = base64ToArrayBuffer(ivBase64);
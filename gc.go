@@ -0,0 +1,244 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// gcMetadataBatch 是每次回收最多检查的元数据条数，其余的留给之后的回收
+const gcMetadataBatch = 1000
+
+// 回收的对象类别，用作 biu_gc_reclaimed_total 的 kind 标签
+const (
+	gcKindAbandonedUpload  = "abandoned_upload"  // 超过 upload.session_ttl 仍未完成 (或已失败、已取消) 的上传
+	gcKindOrphanedBlob     = "orphaned_blob"     // 上传完成后超过 orphan_grace 仍没有元数据的加密文件
+	gcKindOrphanedMetadata = "orphaned_metadata" // 加密文件已经不存在的元数据
+)
+
+// uploadReaper 定期回收被放弃的上传、没有元数据的加密文件，以及加密文件已丢失的元数据
+type uploadReaper struct {
+	store *StorageManager
+
+	// seen 记录存储中没有上传会话的残留 (例如旧版本留下的分片目录) 第一次被发现的时间。
+	// 各存储后端无法可靠地给出它们的修改时间，因此从第一次发现时开始计算 TTL 和宽限期。
+	seen map[string]time.Time
+
+	// metadataCursor 是上一次回收检查到的最后一个元数据 id，下一次从它之后继续
+	metadataCursor string
+}
+
+// startGarbageCollector 启动后台回收任务，启动时立即执行一次，关闭服务时退出。
+// 每次回收都读取当前配置，热加载后的间隔、TTL 和宽限期从下一次回收开始生效。
+func startGarbageCollector() {
+	config := currentConfig()
+	interval, orphanGrace := config.GC.durations()
+	uploadTTL := config.Upload.sessionTTL()
+	gcLog.Info("Starting reaper", "interval", interval, "uploadTtl", uploadTTL, "orphanGrace", orphanGrace)
+
+	reaper := &uploadReaper{
+		store: GetStorageManager(),
+		seen:  make(map[string]time.Time),
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		reaper.pass(time.Now())
+		interval, _ := currentConfig().GC.durations()
+		ticker.Reset(interval)
+		select {
+		case <-ticker.C:
+		case <-backgroundJobs.Stopping():
+			gcLog.Info("Reaper stopped")
+			return
+		}
+	}
+}
+
+// pass 执行一次完整的回收，并记录回收了多少对象
+func (r *uploadReaper) pass(now time.Time) {
+	startTime := time.Now()
+	config := currentConfig()
+	_, orphanGrace := config.GC.durations()
+	uploadTTL := config.Upload.sessionTTL()
+	reclaimed := map[string]int{
+		gcKindAbandonedUpload:  0,
+		gcKindOrphanedBlob:     0,
+		gcKindOrphanedMetadata: 0,
+	}
+
+	r.reapSessions(now, uploadTTL, orphanGrace, reclaimed)
+	r.reapLeftovers(now, uploadTTL, orphanGrace, reclaimed)
+	r.reapMetadata(config, reclaimed)
+
+	for kind, count := range reclaimed {
+		metricGCReclaimed.WithLabelValues(kind).Add(float64(count))
+	}
+	duration := time.Since(startTime)
+	metricGCDuration.Observe(duration.Seconds())
+	gcLog.Info("Pass finished", "duration", duration, gcKindAbandonedUpload, reclaimed[gcKindAbandonedUpload],
+		gcKindOrphanedBlob, reclaimed[gcKindOrphanedBlob], gcKindOrphanedMetadata, reclaimed[gcKindOrphanedMetadata])
+}
+
+// reapSessions 回收长时间没有活动的上传会话及其数据:
+// 未完成或失败的上传超过 uploadTTL，已完成但一直没有保存元数据的超过 orphanGrace
+func (r *uploadReaper) reapSessions(now time.Time, uploadTTL, orphanGrace time.Duration, reclaimed map[string]int) {
+	for _, session := range r.store.uploads.List() {
+		id := session.UploadID
+		idle := now.Sub(session.UpdatedAt)
+
+		var kind string
+		switch session.State {
+		case UploadStateInitialized, UploadStateReceiving, UploadStateFailed, UploadStateCancelled:
+			if idle > uploadTTL {
+				kind = gcKindAbandonedUpload
+			}
+		case UploadStateComplete:
+			if idle > orphanGrace && !r.hasMetadata(id) {
+				kind = gcKindOrphanedBlob
+			}
+		}
+		// merging: FinalizeUpload 正在运行，由它决定结果
+		if kind == "" {
+			continue
+		}
+
+		// 会话在此期间有新的活动 (例如收到新的分片) 时不删除
+		removed, err := r.store.uploads.DeleteIf(id, func(current *UploadSession) bool {
+			return current.State == session.State && current.UpdatedAt.Equal(session.UpdatedAt)
+		})
+		if err != nil {
+			gcLog.Error("Failed to delete upload session", "id", id, "error", err)
+			continue
+		}
+		if removed == nil {
+			continue
+		}
+		// StoreMetadata 先保存元数据再删除会话，可能恰好在这之间完成
+		if kind == gcKindOrphanedBlob && r.hasMetadata(id) {
+			gcLog.Info("Metadata was stored concurrently, keeping the file", "id", id)
+			continue
+		}
+
+		if err := r.removeUpload(id); err != nil {
+			gcLog.Error("Failed to remove upload data", "id", id, "state", session.State, "error", err)
+			continue
+		}
+		gcLog.Info("Reclaimed", "id", id, "kind", kind, "state", session.State, "idle", idle.Round(time.Second))
+		reclaimed[kind]++
+	}
+}
+
+// reapLeftovers 回收存储中没有上传会话、也没有元数据的残留:
+// 未完成的上传 (包括旧版本留下的 temp-files/<uploadId>) 和加密文件
+func (r *uploadReaper) reapLeftovers(now time.Time, uploadTTL, orphanGrace time.Duration, reclaimed map[string]int) {
+	present := make(map[string]bool)
+
+	// check 记录残留第一次被发现的时间，超过 limit 后调用 remove
+	check := func(key, id, kind string, limit time.Duration, remove func(id string) error) {
+		present[key] = true
+		firstSeen, ok := r.seen[key]
+		if !ok {
+			r.seen[key] = now
+			return
+		}
+		if now.Sub(firstSeen) <= limit {
+			return
+		}
+		if err := remove(id); err != nil {
+			gcLog.Error("Failed to remove", "id", id, "kind", kind, "error", err)
+			return
+		}
+		delete(r.seen, key)
+		gcLog.Info("Reclaimed without upload session", "id", id, "kind", kind, "firstSeenAgo", now.Sub(firstSeen).Round(time.Second))
+		reclaimed[kind]++
+	}
+
+	uploadIDs := make(map[string]bool)
+	err := r.store.ListUploads(func(uploadID string) error {
+		uploadIDs[uploadID] = true
+		if _, err := r.store.uploads.Get(uploadID); err == nil {
+			return nil // Handled by reapSessions
+		}
+		check("upload:"+uploadID, uploadID, gcKindAbandonedUpload, uploadTTL, r.store.RemoveChunks)
+		return nil
+	})
+	if err != nil {
+		gcLog.Error("Failed to list uploads", "error", err)
+	}
+
+	err = r.store.ListBlobs(func(id string) error {
+		if uploadIDs[id] {
+			return nil // Incomplete upload, handled above
+		}
+		if _, err := r.store.uploads.Get(id); err == nil {
+			return nil
+		}
+		if r.hasMetadata(id) {
+			return nil
+		}
+		check("blob:"+id, id, gcKindOrphanedBlob, orphanGrace, r.store.RemoveBlob)
+		return nil
+	})
+	if err != nil {
+		gcLog.Error("Failed to list blobs", "error", err)
+	}
+
+	// 已经消失的残留不再跟踪
+	for key := range r.seen {
+		if !present[key] {
+			delete(r.seen, key)
+		}
+	}
+}
+
+// reapMetadata 销毁加密文件已经不存在的文件元数据。
+// 不再每次遍历整个存储: 按 id 顺序从到期索引中分批取出 gcMetadataBatch 条检查，
+// 到达末尾后从头开始，所有元数据在若干次回收内都会被检查一遍。
+func (r *uploadReaper) reapMetadata(config *Config, reclaimed map[string]int) {
+	ids, more := r.store.expiry.Page(r.metadataCursor, gcMetadataBatch)
+	if more {
+		r.metadataCursor = ids[len(ids)-1]
+	} else {
+		r.metadataCursor = ""
+	}
+
+	var orphaned []string
+	for _, id := range ids {
+		data, err := r.store.GetMetadata(id)
+		if err != nil {
+			if !errors.Is(err, ErrNotFound) { // Not found: burned since the page was taken
+				gcLog.Error("Failed to read metadata", "id", id, "error", err)
+			}
+			continue
+		}
+		if data.OriginalFilename == "" {
+			continue // Text notes have no blob
+		}
+		if _, err := r.store.StatBlob(id, data.OriginalFilename); errors.Is(err, ErrNotFound) {
+			orphaned = append(orphaned, id)
+		}
+	}
+
+	for _, id := range orphaned {
+		if err := burnData(config, id, burnReasonOrphaned); err != nil {
+			gcLog.Error("Failed to burn metadata without file", "id", id, "error", err)
+			continue
+		}
+		gcLog.Info("Reclaimed", "id", id, "kind", gcKindOrphanedMetadata)
+		reclaimed[gcKindOrphanedMetadata]++
+	}
+}
+
+// hasMetadata 报告 id 是否有元数据；读取出错时保守地当作存在
+func (r *uploadReaper) hasMetadata(id string) bool {
+	_, err := r.store.GetMetadata(id)
+	return !errors.Is(err, ErrNotFound)
+}
+
+// removeUpload 删除上传写了一半的文件和已完成的文件
+func (r *uploadReaper) removeUpload(id string) error {
+	if err := r.store.RemoveChunks(id); err != nil {
+		return err
+	}
+	return r.store.RemoveBlob(id)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReapMetadataBurnsEntriesWithoutBlob(t *testing.T) {
+	cfg := setupTestStorage(t, StorageModePersistent)
+	store := GetStorageManager()
+	expiresAt := time.Now().Add(time.Hour)
+
+	const (
+		orphanedID = "1a2b3c4d-0000-4000-8000-000000000001"
+		fileID     = "1a2b3c4d-0000-4000-8000-000000000002"
+		textID     = "1a2b3c4d-0000-4000-8000-000000000003"
+	)
+	for id, name := range map[string]string{orphanedID: "lost.bin", fileID: "kept.bin", textID: ""} {
+		if err := store.CreateMetadata(id, &StoredData{OriginalFilename: name, ExpiresAt: &expiresAt}); err != nil {
+			t.Fatalf("CreateMetadata: %v", err)
+		}
+	}
+	blob, err := store.CreateBlob(fileID, "kept.bin")
+	if err != nil {
+		t.Fatalf("CreateBlob: %v", err)
+	}
+	blob.Close()
+
+	reaper := &uploadReaper{store: store, seen: make(map[string]time.Time)}
+	reclaimed := map[string]int{}
+	reaper.reapMetadata(cfg, reclaimed)
+
+	if reclaimed[gcKindOrphanedMetadata] != 1 {
+		t.Fatalf("reclaimed %d orphaned metadata entries, want 1", reclaimed[gcKindOrphanedMetadata])
+	}
+	if _, err := store.GetMetadata(orphanedID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("metadata without blob not burned: %v", err)
+	}
+	for _, id := range []string{fileID, textID} {
+		if _, err := store.GetMetadata(id); err != nil {
+			t.Fatalf("GetMetadata(%s): %v", id, err)
+		}
+	}
+	if reaper.metadataCursor != "" {
+		t.Fatalf("cursor = %q after reaching the end, want it reset", reaper.metadataCursor)
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"log"
 	"math/rand"
 	"net/http"
 	"strings"
@@ -14,14 +13,14 @@ const (
 	shortCodeChars  = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 )
 
-func generateShortLink(config *Config) gin.HandlerFunc {
+func generateShortLink() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var request struct {
 			URL string `json:"url" binding:"required"`
 		}
 
 		if err := c.ShouldBindJSON(&request); err != nil {
-			log.Printf("[ShortLink] JSON绑定失败: %v", err)
+			shortLinkLog.Debug("JSON绑定失败", "error", err)
 			c.JSON(http.StatusBadRequest, gin.H{"error": "无效的请求格式"})
 			return
 		}
@@ -31,7 +30,7 @@ func generateShortLink(config *Config) gin.HandlerFunc {
 
 		err := SetShortLink(shortCode, longUrl)
 		if err != nil {
-			log.Printf("[ShortLink] 保存短链接失败: %v", err)
+			shortLinkLog.Error("保存短链接失败", "error", err)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "保存短链接失败"})
 			return
 		}
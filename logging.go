@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 日志输出格式 (logging.format)
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// 客户端 IP 的记录方式 (logging.client_ip)
+const (
+	LogClientIPTruncate = "truncate" // 只记录所在网段: IPv4 /24，IPv6 /48
+	LogClientIPFull     = "full"
+	LogClientIPDrop     = "drop"
+)
+
+// 各子系统的 logger，每条日志带有 subsystem 属性。数据 ID 记录在 id 属性，上传 ID 记录在 uploadId 属性。
+var (
+	accessLog        = subsystemLogger("Access")
+	adminLog         = subsystemLogger("Admin")
+	burnDataLog      = subsystemLogger("BurnData")
+	burnQueueLog     = subsystemLogger("BurnQueue")
+	cancelUploadLog  = subsystemLogger("CancelUpload")
+	checkStatusLog   = subsystemLogger("CheckStatus")
+	chunkUploadLog   = subsystemLogger("ChunkUpload")
+	cleanupLog       = subsystemLogger("CleanupTask")
+	configLog        = subsystemLogger("Config")
+	downloadLog      = subsystemLogger("Download")
+	expirationLog    = subsystemLogger("Expiration")
+	finalizeLog      = subsystemLogger("FinalizeUpload")
+	gcLog            = subsystemLogger("GC")
+	getDataLog       = subsystemLogger("GetData")
+	initUploadLog    = subsystemLogger("InitUpload")
+	manageLog        = subsystemLogger("Manage")
+	metricsLog       = subsystemLogger("Metrics")
+	peekDataLog      = subsystemLogger("PeekData")
+	redirectLog      = subsystemLogger("Redirect")
+	serverLog        = subsystemLogger("Server")
+	shortLinkLog     = subsystemLogger("ShortLink")
+	shutdownLog      = subsystemLogger("Shutdown")
+	storageLog       = subsystemLogger("Storage")
+	storeDataLog     = subsystemLogger("StoreData")
+	storeMetadataLog = subsystemLogger("StoreMetadata")
+	uploadEventsLog  = subsystemLogger("UploadEvents")
+	uploadSessionLog = subsystemLogger("UploadSession")
+	validationLog    = subsystemLogger("Validation")
+)
+
+// subsystemLogger 返回带有 subsystem 属性的 logger。它总是写入当前的默认 handler，
+// 因此在 setupLogging 之前创建 (例如包级变量) 也会使用配置好的级别、格式和输出。
+func subsystemLogger(name string) *slog.Logger {
+	return slog.New(defaultHandler{}).With(slog.String("subsystem", name))
+}
+
+// defaultHandler 把日志转交给 slog.Default() 的 handler，wrap 依次应用 With / WithGroup
+type defaultHandler struct {
+	wrap func(slog.Handler) slog.Handler
+}
+
+func (h defaultHandler) current() slog.Handler {
+	handler := slog.Default().Handler()
+	if h.wrap != nil {
+		handler = h.wrap(handler)
+	}
+	return handler
+}
+
+func (h defaultHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return slog.Default().Handler().Enabled(ctx, level)
+}
+
+func (h defaultHandler) Handle(ctx context.Context, record slog.Record) error {
+	return h.current().Handle(ctx, record)
+}
+
+func (h defaultHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return defaultHandler{wrap: func(handler slog.Handler) slog.Handler {
+		if h.wrap != nil {
+			handler = h.wrap(handler)
+		}
+		return handler.WithAttrs(attrs)
+	}}
+}
+
+func (h defaultHandler) WithGroup(name string) slog.Handler {
+	return defaultHandler{wrap: func(handler slog.Handler) slog.Handler {
+		if h.wrap != nil {
+			handler = h.wrap(handler)
+		}
+		return handler.WithGroup(name)
+	}}
+}
+
+// fatal 记录错误并退出进程，用于启动阶段无法继续的错误
+func fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
+
+// parseLogLevel 解析 logging.level (debug、info、warn / warning、error，不区分大小写)
+func parseLogLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("未知的日志级别: %s", level)
+}
+
+// setupLogging 按 logging 配置创建默认 logger: 输出到 stderr，配置了 handlers.file.path 时
+// 同时写入按大小和时间轮转的日志文件。标准库 log 的输出也会经过它，级别为 info。
+// 所有日志都经过 logRedactor 处理客户端 IP，开启 redact_ids 时隐藏 ID。
+func setupLogging(config *Config) error {
+	level, err := parseLogLevel(config.Logging.Level)
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stderr
+	file := config.Logging.Handlers.File
+	if file.Path != "" {
+		maxAge, _ := time.ParseDuration(file.MaxAge)
+		rotating, err := openRotatingFile(file.Path, int64(file.MaxSizeMB)*1024*1024, maxAge, file.MaxBackups)
+		if err != nil {
+			return err
+		}
+		out = io.MultiWriter(os.Stderr, rotating)
+	}
+
+	redactor := &logRedactor{clientIP: config.Logging.ClientIP}
+	generatedKey := false
+	if config.Logging.RedactIDs {
+		redactor.idHashKey = []byte(config.Logging.IDHashKey)
+		if len(redactor.idHashKey) == 0 {
+			redactor.idHashKey, generatedKey = cryptoRandBytes(32), true
+		}
+	}
+
+	options := &slog.HandlerOptions{Level: level, ReplaceAttr: redactor.replaceAttr}
+	var handler slog.Handler
+	if config.Logging.Format == LogFormatJSON {
+		handler = slog.NewJSONHandler(out, options)
+	} else {
+		handler = slog.NewTextHandler(out, options)
+	}
+	slog.SetDefault(slog.New(handler))
+	if generatedKey {
+		configLog.Warn("logging.id_hash_key is not set, using a random key: hashed IDs will not match across restarts")
+	}
+	return nil
+}
+
+// 日志中可能出现在其他属性 (错误信息、文件名、对象键、URL 等) 里的 ID:
+// 数据 ID 是 UUID，上传 ID 是 32 位十六进制
+var (
+	uuidPattern     = regexp.MustCompile(`(?i)\b[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\b`)
+	uploadIDPattern = regexp.MustCompile(`\b[0-9a-f]{32}\b`)
+)
+
+// idLogKeys 是值本身就是 ID (或短链接) 的日志属性，开启 redact_ids 时整体替换为哈希
+var idLogKeys = map[string]bool{
+	"id":        true,
+	"uploadId":  true,
+	"cleanId":   true,
+	"shortCode": true,
+}
+
+// logRedactor 在日志写出前处理属性: 按 logging.client_ip 截断或去掉 clientIp；
+// idHashKey 不为空时把 ID 替换为 HMAC-SHA256 的前 8 字节 (h:<16 位十六进制>)。
+// 同一个 ID 总是得到同一个哈希，可以据此关联日志，但无法从日志还原 ID 去读取或销毁数据。
+type logRedactor struct {
+	clientIP  string
+	idHashKey []byte
+}
+
+func (r *logRedactor) replaceAttr(groups []string, a slog.Attr) slog.Attr {
+	if a.Key == "clientIp" {
+		switch r.clientIP {
+		case LogClientIPDrop:
+			return slog.Attr{}
+		case LogClientIPTruncate:
+			return slog.String(a.Key, truncateClientIP(a.Value.String()))
+		}
+		return a
+	}
+	if len(r.idHashKey) == 0 {
+		return a
+	}
+
+	switch {
+	case idLogKeys[a.Key]:
+		return slog.String(a.Key, r.hashID(a.Value.String()))
+	case a.Value.Kind() == slog.KindString:
+		return slog.String(a.Key, r.scrubIDs(a.Value.String()))
+	case a.Value.Kind() == slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, r.scrubIDs(err.Error()))
+		}
+	}
+	return a
+}
+
+// hashID 返回 ID 的带密钥哈希
+func (r *logRedactor) hashID(id string) string {
+	if id == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, r.idHashKey)
+	mac.Write([]byte(strings.ToLower(id)))
+	return "h:" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// scrubIDs 把字符串中出现的 ID 替换为哈希
+func (r *logRedactor) scrubIDs(s string) string {
+	s = uuidPattern.ReplaceAllStringFunc(s, r.hashID)
+	return uploadIDPattern.ReplaceAllStringFunc(s, r.hashID)
+}
+
+// truncateClientIP 只保留 IP 所在的网段 (IPv4 /24，IPv6 /48)，无法解析时不记录
+func truncateClientIP(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap()
+	bits := 48
+	if addr.Is4() {
+		bits = 24
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return ""
+	}
+	return prefix.String()
+}
+
+// rotatingFile 是按大小和时间轮转的日志文件: 当前文件超过 maxSize 字节或打开超过 maxAge 后
+// 改名为 <path>.<时间>，只保留最近的 maxBackups 个旧文件
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.path), 0750); err != nil {
+		return fmt.Errorf("创建日志目录失败: %w", err)
+	}
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("打开日志文件失败: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("读取日志文件信息失败: %w", err)
+	}
+	f.file, f.size, f.openedAt = file, info.Size(), time.Now()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tooLarge := f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize
+	tooOld := f.maxAge > 0 && time.Since(f.openedAt) >= f.maxAge
+	if tooLarge || tooOld {
+		if err := f.rotate(); err != nil {
+			// 继续写入当前文件 (如果还开着)，不因轮转失败丢失日志
+			fmt.Fprintf(os.Stderr, "log rotation of %s failed: %v\n", f.path, err)
+		}
+	}
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate 关闭当前文件并改名，打开新文件，再删除超出 maxBackups 的旧文件
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+	backup := f.path + "." + time.Now().Format("20060102-150405.000")
+	if err := os.Rename(f.path, backup); err != nil {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	if f.maxBackups <= 0 {
+		return nil
+	}
+	backups, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return err
+	}
+	sort.Strings(backups) // 时间戳格式保证按时间排序
+	for len(backups) > f.maxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setupTestLogging 用 yaml 中的 logging 配置调用 setupLogging，测试结束后恢复默认 logger
+func setupTestLogging(t *testing.T, yaml string) *Config {
+	t.Helper()
+	loaded, err := LoadConfig(writeTestConfig(t, yaml))
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	previous := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	if err := setupLogging(loaded); err != nil {
+		t.Fatalf("setupLogging: %v", err)
+	}
+	return loaded
+}
+
+func TestLoggingLevelValidation(t *testing.T) {
+	for _, level := range []string{"debug", "INFO", "warning", "Error"} {
+		if _, err := parseLogLevel(level); err != nil {
+			t.Errorf("parseLogLevel(%q): %v", level, err)
+		}
+	}
+	if _, err := LoadConfig(writeTestConfig(t, "logging:\n  level: verbose\n")); err == nil {
+		t.Fatalf("LoadConfig accepted logging.level: verbose")
+	}
+}
+
+func TestSetupLoggingJSONFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "biu.log")
+	// 包级的子系统 logger 在 setupLogging 之前创建，同样使用配置好的级别和格式
+	logger := subsystemLogger("Test")
+	setupTestLogging(t, "logging:\n  level: warn\n  format: json\n  handlers:\n    file:\n      path: \""+path+"\"\n")
+	logger.Info("filtered by level")
+	logger.Warn("written", "key", "value")
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read log file: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("log file has %d lines: %s", len(lines), data)
+	}
+	var record map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("log line is not JSON: %s", lines[0])
+	}
+	if record["level"] != "WARN" || record["msg"] != "written" || record["subsystem"] != "Test" || record["key"] != "value" {
+		t.Fatalf("log record = %v", record)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "biu.log")
+	f, err := openRotatingFile(path, 100, 0, 2)
+	if err != nil {
+		t.Fatalf("openRotatingFile: %v", err)
+	}
+	defer f.file.Close()
+
+	line := []byte(strings.Repeat("x", 59) + "\n")
+	for i := 0; i < 10; i++ {
+		if _, err := f.Write(line); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	// 超过大小后轮转，只保留 maxBackups 个旧文件
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) == 0 || len(backups) > 2 {
+		t.Fatalf("%d backups, want 1..2: %v", len(backups), backups)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() > 100 {
+		t.Fatalf("current log file: %v, %v", info, err)
+	}
+}
+
+func TestTruncateClientIP(t *testing.T) {
+	for ip, want := range map[string]string{
+		"203.0.113.77":          "203.0.113.0/24",
+		"::ffff:203.0.113.77":   "203.0.113.0/24",
+		"2001:db8:1234:5678::1": "2001:db8:1234::/48",
+		"not an ip":             "",
+		"":                      "",
+	} {
+		if got := truncateClientIP(ip); got != want {
+			t.Errorf("truncateClientIP(%q) = %q, want %q", ip, got, want)
+		}
+	}
+}
+
+func TestLogRedactor(t *testing.T) {
+	const (
+		dataID   = "6a8c0e2f-5b7d-4e9f-8a1b-3c4d5e6f7a8b"
+		uploadID = "0123456789abcdef0123456789abcdef"
+	)
+	redactor := &logRedactor{clientIP: LogClientIPTruncate, idHashKey: []byte("test-key")}
+	hashed := redactor.hashID(dataID)
+	if !strings.HasPrefix(hashed, "h:") || len(hashed) != 18 || redactor.hashID(strings.ToUpper(dataID)) != hashed {
+		t.Fatalf("hashID(%s) = %q", dataID, hashed)
+	}
+
+	for _, tc := range []struct {
+		attr slog.Attr
+		want string
+	}{
+		{slog.String("id", dataID), hashed},
+		{slog.String("uploadId", uploadID), redactor.hashID(uploadID)},
+		{slog.String("path", "uploads/"+dataID+"/file.bin"), "uploads/" + hashed + "/file.bin"},
+		{slog.Any("error", os.ErrNotExist), os.ErrNotExist.Error()},
+		{slog.Any("error", &os.PathError{Op: "open", Path: dataID, Err: os.ErrNotExist}), "open " + hashed + ": file does not exist"},
+		{slog.String("clientIp", "203.0.113.77"), "203.0.113.0/24"},
+	} {
+		if got := redactor.replaceAttr(nil, tc.attr); got.Value.String() != tc.want {
+			t.Errorf("replaceAttr(%s) = %q, want %q", tc.attr, got.Value.String(), tc.want)
+		}
+	}
+
+	// 未开启 redact_ids 时 ID 原样记录；client_ip: drop 时去掉属性
+	plain := &logRedactor{clientIP: LogClientIPDrop}
+	if got := plain.replaceAttr(nil, slog.String("id", dataID)); got.Value.String() != dataID {
+		t.Fatalf("id without redact_ids = %q", got.Value.String())
+	}
+	if got := plain.replaceAttr(nil, slog.String("clientIp", "203.0.113.77")); !got.Equal(slog.Attr{}) {
+		t.Fatalf("clientIp with client_ip: drop = %v", got)
+	}
+}
@@ -2,19 +2,15 @@ package main
 
 import (
 	"embed"
-	"encoding/json" // Needed for cleanup task
 	"flag"
 	"fmt"
 	"io"
 	"io/fs"
-	"log"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -31,51 +27,79 @@ var (
 )
 
 func main() {
-	configFile := flag.String("config", "config.yaml", "配置文件路径")
+	defaultConfigPath := "config.yaml"
+	if path := os.Getenv("BIU_CONFIG"); path != "" {
+		defaultConfigPath = path
+	}
+	flag.StringVar(&configPath, "config", defaultConfigPath, "配置文件路径 (也可用环境变量 BIU_CONFIG 指定)")
+	flag.Var(&configFlagOverrides, "set", "覆盖配置项，例如 -set server.port=3003 (可重复，优先于环境变量 BIU_SERVER_PORT 和配置文件)")
 	flag.Parse()
 
 	var err error
 	configLock.Lock()
-	config, err = LoadConfig(*configFile)
+	config, err = LoadConfig(configPath)
 	configLock.Unlock()
 	if err != nil {
-		log.Fatalf("加载配置失败: %v", err)
+		fatal(configLog, "加载配置失败", "error", err)
 	}
-
-	// Ensure necessary directories exist
-	if err := EnsureUploadDirectoriesExist(config); err != nil {
-		log.Fatalf("创建上传目录失败: %v", err)
+	if err := setupLogging(config); err != nil {
+		fatal(configLog, "初始化日志失败", "error", err)
 	}
-	if err := ensureDataStorageDir(); err != nil { // Ensure data storage dir exists
-		log.Fatalf("创建数据存储目录失败: %v", err)
+	logConfigSources(config)
+
+	// Ensure necessary directories exist (memory mode never touches the disk)
+	if !config.Storage.InMemory() {
+		if err := EnsureUploadDirectoriesExist(config); err != nil {
+			fatal(storageLog, "创建上传目录失败", "error", err)
+		}
+		if err := ensureDataStorageDir(); err != nil { // Ensure data storage dir exists
+			fatal(storageLog, "创建数据存储目录失败", "error", err)
+		}
 	}
 
 	// Initialize storage (e.g., load short links)
 	if err := InitStorage(config); err != nil {
-		log.Fatalf("初始化存储失败: %v", err)
+		fatal(storageLog, "初始化存储失败", "error", err)
+	}
+
+	// Retry pending burns in the background (including ones left over from a previous run)
+	backgroundJobs.Go("burn-queue", func() { GetStorageManager().burns.run(backgroundJobs.Stopping()) })
+
+	// Prometheus metrics, either on a separate listener or on the main router (see initRouter)
+	if config.Metrics.Enabled {
+		registerStorageMetrics(config)
+		if config.Metrics.Listen != "" {
+			backgroundJobs.Go("metrics", func() { startMetricsListener(config) })
+		}
 	}
 
 	// Initialize Gin router
 	initRouter() // Call initRouter before starting the server
 
 	// Start background cleanup task if expiration is enabled
-	configLock.RLock()
 	if config.Expiration.Enabled {
-		// Use a reasonable interval, e.g., 1 hour. Adjust as needed.
-		// Shorten interval for testing, e.g., every minute
-		cleanupInterval := 1 * time.Minute
-		log.Printf("Starting background cleanup task with interval %v", cleanupInterval)
-		go startCleanupTask(config, cleanupInterval)
+		// Expired data is burned as soon as it expires, driven by the in-memory expiry index
+		backgroundJobs.Go("cleanup", func() { startCleanupTask(config) })
+	}
+	// Reclaim abandoned uploads and orphaned blobs/metadata
+	if config.GC.Enabled {
+		backgroundJobs.Go("gc", startGarbageCollector)
 	}
-	configLock.RUnlock()
 
-	// Start the HTTP server
+	// Start the HTTP server; SIGINT/SIGTERM drain requests and background jobs before exiting
 	host := "0.0.0.0" // Listen on all interfaces within the container
 	port := strconv.Itoa(config.Server.Port)
-	log.Printf("服务器运行在 %s:%s", host, port)
-	if err := router.Run(fmt.Sprintf("%s:%s", host, port)); err != nil {
-		log.Printf("启动服务器失败: %v", err)
-		os.Exit(1)
+	srv := &http.Server{
+		Addr:    fmt.Sprintf("%s:%s", host, port),
+		Handler: router,
+	}
+
+	// Reload the configuration on SIGHUP (or POST /api/admin/config/reload)
+	backgroundJobs.Go("reload", watchReloadSignal)
+
+	serverLog.Info("服务器运行", "addr", srv.Addr)
+	if err := serveUntilSignal(srv); err != nil {
+		fatal(serverLog, "启动服务器失败", "error", err)
 	}
 }
 
@@ -83,7 +107,10 @@ func initRouter() {
 	routerOnce.Do(func() {
 		gin.SetMode(gin.ReleaseMode)
 		r := gin.New()
-		r.Use(gin.Recovery())
+		r.Use(recoveryMiddleware())
+		if config.Logging.AccessLog {
+			r.Use(accessLogMiddleware())
+		}
 
 		// Disable automatic redirection
 		r.RedirectTrailingSlash = false
@@ -106,15 +133,15 @@ func initRouter() {
 		}
 		configLock.RUnlock()
 
-		corsConfig.AllowMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
-		corsConfig.AllowHeaders = []string{"Origin", "Content-Type", "Accept", "Authorization"}
+		corsConfig.AllowMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+		corsConfig.AllowHeaders = []string{"Origin", "Content-Type", "Accept", "Authorization", "X-Chunk-Sha256"}
 		corsConfig.AllowCredentials = true
 		r.Use(cors.New(corsConfig))
 
 		// Static files from embedded filesystem
 		staticFSBase, err := fs.Sub(embeddedFiles, "frontend")
 		if err != nil {
-			log.Fatalf("无法访问嵌入式前端目录: %v", err)
+			fatal(serverLog, "无法访问嵌入式前端目录", "error", err)
 		}
 		staticFS := http.FS(staticFSBase)
 
@@ -132,32 +159,46 @@ func initRouter() {
 		// API Routes
 		api := r.Group("/api")
 		{
-			configLock.RLock() // Lock for reading config within the group setup
-			cfg := config      // Capture config for handlers
-			configLock.RUnlock()
-
-			api.POST("/store", StoreDataHandler(cfg))              // For text
-			api.POST("/store/metadata", StoreMetadataHandler(cfg)) // For files after upload
-			api.GET("/data/:id", GetDataHandler(cfg))
-			api.POST("/burn/:id", BurnDataHandler(cfg))
-			api.GET("/download/:id", DownloadHandler(cfg))
+			api.POST("/store", StoreDataHandler())              // For text
+			api.POST("/store/metadata", StoreMetadataHandler()) // For files after upload
+			api.GET("/data/:id", PeekDataHandler())             // Side-effect-free existence check
+			api.POST("/data/:id/reveal", GetDataHandler())      // Returns ciphertext, starts access window
+			api.POST("/burn/:id", BurnDataHandler())
+			api.GET("/download/:id", DownloadHandler())
+
+			// Owner management API (requires the token returned when storing)
+			api.GET("/manage/:id", ManageStatusHandler())
+			api.PATCH("/manage/:id", ManageExpirationHandler())
+			api.DELETE("/manage/:id", ManageRevokeHandler())
 
 			// Chunk Upload API
-			api.POST("/upload/init", InitUploadHandler(cfg))
-			api.POST("/upload/chunk", ChunkUploadHandler(cfg))
-			api.GET("/upload/status", CheckUploadStatusHandler(cfg))
+			api.POST("/upload/init", InitUploadHandler())
+			api.POST("/upload/chunk", ChunkUploadHandler())                 // multipart/form-data (older clients)
+			api.PUT("/upload/:uploadId/chunks/:n", RawChunkUploadHandler()) // application/octet-stream, streamed
+			api.GET("/upload/status", CheckUploadStatusHandler())
+			api.GET("/upload/:uploadId/events", UploadEventsHandler()) // Server-Sent Events
+			api.DELETE("/upload/:uploadId", CancelUploadHandler())     // Authorization: Bearer <cancelToken>
 
 			// Short Link API (if enabled/needed)
-			api.POST("/shorten", generateShortLink(cfg))
+			api.POST("/shorten", generateShortLink())
+
+			// Admin API (requires admin.token)
+			admin := api.Group("/admin", requireAdminToken())
+			admin.GET("/burn-queue", BurnQueueHandler())
+			admin.POST("/config/reload", ReloadConfigHandler()) // Same as SIGHUP
+		}
+
+		// Prometheus metrics on the main listener (requires metrics.token)
+		if config.Metrics.Enabled && config.Metrics.Listen == "" {
+			r.GET("/metrics", MetricsHandler())
 		}
 
 		// Short Link Redirect
-		r.GET("/s/:shortCode", redirect(config)) // Pass config directly
+		r.GET("/s/:shortCode", redirect())
 
 		// Frontend Configuration Endpoint
 		r.GET("/config", func(c *gin.Context) {
-			configLock.RLock()
-			defer configLock.RUnlock()
+			config := currentConfig()
 			if config == nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "配置未加载"})
 				return
@@ -213,7 +254,7 @@ func serveIndexHTMLWithSeeker(c *gin.Context, staticFS http.FileSystem) {
 
 	file, err := staticFS.Open("index.html") // Open relative to the staticFS root
 	if err != nil {
-		log.Printf("Error opening index.html from embedded FS: %v", err)
+		serverLog.Error("Error opening index.html from embedded FS", "error", err)
 		c.String(http.StatusInternalServerError, "无法打开主页")
 		return
 	}
@@ -222,14 +263,14 @@ func serveIndexHTMLWithSeeker(c *gin.Context, staticFS http.FileSystem) {
 	// Check if the file implements io.ReadSeeker, required by http.ServeContent
 	seeker, ok := file.(io.ReadSeeker)
 	if !ok {
-		log.Printf("Error: embedded index.html does not implement io.ReadSeeker")
+		serverLog.Error("Embedded index.html does not implement io.ReadSeeker")
 		c.String(http.StatusInternalServerError, "无法提供主页")
 		return
 	}
 
 	stat, err := file.Stat()
 	if err != nil {
-		log.Printf("Error stating index.html from embedded FS: %v", err)
+		serverLog.Error("Error stating index.html from embedded FS", "error", err)
 		c.String(http.StatusInternalServerError, "无法获取主页信息")
 		return
 	}
@@ -240,9 +281,7 @@ func serveIndexHTMLWithSeeker(c *gin.Context, staticFS http.FileSystem) {
 
 // ensureDataStorageDir ensures the primary directory for storing .json metadata files exists.
 func ensureDataStorageDir() error {
-	configLock.RLock()
-	dataDir := config.Paths.DataStorageDir // Use the already absolute path from config validation
-	configLock.RUnlock()
+	dataDir := currentConfig().Paths.DataStorageDir // Use the already absolute path from config validation
 
 	// No need for default logic here as config validation handles it
 	if dataDir == "" {
@@ -254,108 +293,10 @@ func ensureDataStorageDir() error {
 		return fmt.Errorf("创建数据存储目录 '%s' 失败: %w", dataDir, err)
 	}
 
-	log.Printf("数据存储目录已确保存在: %s", dataDir)
+	storageLog.Debug("数据存储目录已确保存在", "path", dataDir)
 	return nil
 }
 
-// startCleanupTask starts a background goroutine to periodically clean up expired data.
-func startCleanupTask(config *Config, interval time.Duration) {
-	log.Printf("[CleanupTask] Starting background cleanup task with interval %v", interval)
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-
-	// Run once immediately at startup, then tick
-	log.Println("[CleanupTask] Running initial cleanup cycle...")
-	cleanupExpiredData(config)
-
-	for range ticker.C {
-		log.Println("[CleanupTask] Running cleanup cycle...")
-		cleanupExpiredData(config)
-	}
-}
-
-// cleanupExpiredData scans the data directory and removes expired entries.
-func cleanupExpiredData(config *Config) {
-	log.Println("[CleanupTask] Starting cleanup cycle...") // Log start of cycle
-	dataDir := config.Paths.DataStorageDir
-	log.Printf("[CleanupTask] Scanning directory: %s", dataDir)
-	// 使用 os.ReadDir 替换 ioutil.ReadDir
-	files, err := os.ReadDir(dataDir) // <--- 使用 os.ReadDir
-	if err != nil {
-		log.Printf("[CleanupTask] Error reading data directory %s: %v", dataDir, err)
-		return
-	}
-	log.Printf("[CleanupTask] Found %d entries in data directory.", len(files))
-
-	now := time.Now()
-	cleanedCount := 0
-	for _, file := range files {
-		// file 现在是 fs.DirEntry 类型
-		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
-			continue // Skip directories and non-json files
-		}
-
-		filePath := filepath.Join(dataDir, file.Name())
-		id := strings.TrimSuffix(file.Name(), ".json")
-
-		// Basic validation of ID format before reading file
-		if !IsValidUUID(id) {
-			log.Printf("[CleanupTask] Skipping file with invalid ID format: %s", file.Name())
-			continue
-		}
-
-		jsonData, err := os.ReadFile(filePath)
-		if err != nil {
-			if os.IsNotExist(err) {
-				continue // File might have been deleted by another process/request
-			}
-			log.Printf("[CleanupTask:%s] Error reading metadata file %s: %v", id, filePath, err)
-			continue
-		}
-
-		// Unmarshal only necessary fields for expiration check
-		var metadata struct {
-			ExpiresAt          *time.Time `json:"expiresAt"`
-			AccessWindowEndsAt *time.Time `json:"accessWindowEndsAt"`
-		}
-		if err := json.Unmarshal(jsonData, &metadata); err != nil {
-			log.Printf("[CleanupTask:%s] Error unmarshaling metadata from %s: %v. Skipping.", id, filePath, err)
-			continue // Skip potentially corrupt file
-		}
-		log.Printf("[CleanupTask:%s] Read ExpiresAt: %v, AccessWindowEndsAt: %v", id, metadata.ExpiresAt, metadata.AccessWindowEndsAt) // Log timestamps
-
-		expired := false
-		// Check primary expiration
-		if metadata.ExpiresAt != nil && now.After(*metadata.ExpiresAt) {
-			log.Printf("[CleanupTask:%s] Primary expiration time (%s) passed. Current time: %s", id, (*metadata.ExpiresAt).Format(time.RFC3339), now.Format(time.RFC3339))
-			expired = true
-		}
-		// Check access window expiration (if applicable and enabled)
-		// No need to check config.Expiration.AccessWindow.Enabled here,
-		// as AccessWindowEndsAt should only be set if it was enabled at creation time.
-		if !expired && metadata.AccessWindowEndsAt != nil && now.After(*metadata.AccessWindowEndsAt) {
-			log.Printf("[CleanupTask:%s] Access window expired at %s. Current time: %s", id, (*metadata.AccessWindowEndsAt).Format(time.RFC3339), now.Format(time.RFC3339))
-			expired = true
-		}
-
-		if expired {
-			log.Printf("[CleanupTask:%s] Data expired. Initiating burn.", id)
-			// Call burnData asynchronously to avoid blocking the cleanup loop for long burns
-			go func(cfg *Config, dataID string) {
-				err := burnData(cfg, dataID) // <--- 检查 burnData 的错误
-				if err != nil {
-					// 记录更详细的错误信息
-					log.Printf("[CleanupTask:Burn:%s] Error during background burn: %v", dataID, err)
-				} else {
-					log.Printf("[CleanupTask:Burn:%s] Background burn completed successfully.", dataID)
-				}
-			}(config, id) // Pass config and id to the goroutine
-			cleanedCount++ // Increment count when burn is initiated
-		}
-	}
-	log.Printf("[CleanupTask] Finished cleanup cycle. Initiated burn for %d entries.", cleanedCount)
-}
-
 // mustSubFS is a helper to handle errors from fs.Sub, panicking on error
 // as this indicates a programming error with the embedded filesystem structure.
 func mustSubFS(fsys fs.FS, dir string) fs.FS {
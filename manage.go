@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newSecretToken 生成一个随机的、可放在 URL 和请求头中的令牌
+func newSecretToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("生成令牌失败: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// hashToken 返回令牌的 SHA-256 十六进制摘要，服务器只保存摘要
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenMatchesHash 以常量时间比较令牌与保存的摘要
+func tokenMatchesHash(token, hash string) bool {
+	if token == "" || hash == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(hash)) == 1
+}
+
+// bearerToken 从 "Authorization: Bearer <token>" 请求头中取出令牌
+func bearerToken(c *gin.Context) string {
+	token, _ := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	return strings.TrimSpace(token)
+}
+
+// loadManagedData 读取元数据并校验管理令牌；失败时已写好响应，返回 nil
+func loadManagedData(c *gin.Context, logger *slog.Logger, id string) *StoredData {
+	if !IsValidUUID(id) {
+		logger.Debug("Invalid ID format received", "id", id)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "无效的数据ID"})
+		return nil
+	}
+
+	metadata, err := GetStorageManager().GetMetadata(id)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "数据不存在或已被销毁"})
+		} else {
+			logger.Error("Error reading metadata", "id", id, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "读取数据失败"})
+		}
+		return nil
+	}
+
+	if !tokenMatchesHash(bearerToken(c), metadata.ManageTokenHash) {
+		logger.Warn("Rejected request with missing or invalid management token", "id", id)
+		c.JSON(http.StatusForbidden, gin.H{"error": "管理令牌无效"})
+		return nil
+	}
+	return metadata
+}
+
+// managedStatus 构建返回给所有者的状态信息 (不包含密文)
+func managedStatus(id string, metadata *StoredData) gin.H {
+	status := gin.H{
+		"id":                 id,
+		"createdAt":          metadata.CreatedAt,
+		"firstAccessedAt":    metadata.FirstAccessedTime,
+		"views":              metadata.Views,
+		"expiresAt":          metadata.ExpiresAt,
+		"accessWindowEndsAt": metadata.AccessWindowEndsAt,
+		"burnOnRead":         metadata.BurnOnRead,
+	}
+	if metadata.OriginalFilename != "" {
+		status["type"] = "file"
+		status["fileSize"] = metadata.FileSize
+	} else {
+		status["type"] = "text"
+	}
+	if remaining := metadata.RemainingViews(); remaining >= 0 {
+		status["maxViews"] = metadata.MaxViews
+		status["remainingViews"] = remaining
+	}
+	return status
+}
+
+// ManageStatusHandler 返回数据的创建时间、首次访问时间、查看次数和到期时间
+func ManageStatusHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		metadata := loadManagedData(c, manageLog, id)
+		if metadata == nil {
+			return
+		}
+		c.JSON(http.StatusOK, managedStatus(id, metadata))
+	}
+}
+
+// ManageRevokeHandler 由所有者提前销毁数据
+func ManageRevokeHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		config := currentConfig()
+		id := c.Param("id")
+		if loadManagedData(c, manageLog, id) == nil {
+			return
+		}
+		if err := burnData(config, id, burnReasonManual); err != nil {
+			manageLog.Error("Revoke failed", "id", id, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to burn data completely."})
+			return
+		}
+		manageLog.Info("Data revoked by owner", "id", id)
+		c.JSON(http.StatusOK, gin.H{"message": "Data successfully burned"})
+	}
+}
+
+// ManageExpirationHandler 由所有者延长或缩短有效期，新的到期时间为 现在 + setDuration
+func ManageExpirationHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		config := currentConfig()
+		id := c.Param("id")
+		if loadManagedData(c, manageLog, id) == nil {
+			return
+		}
+
+		var request struct {
+			SetDuration string `json:"setDuration"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil || request.SetDuration == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "缺少 setDuration"})
+			return
+		}
+
+		// 遵循与创建时相同的有效期策略
+		if !config.Expiration.Enabled {
+			c.JSON(http.StatusConflict, gin.H{"error": "有效期功能未启用"})
+			return
+		}
+		if config.Expiration.Mode == "forced" {
+			c.JSON(http.StatusConflict, gin.H{"error": "服务器使用固定有效期，不允许修改"})
+			return
+		}
+		duration, err := time.ParseDuration(request.SetDuration)
+		if err != nil || duration <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("无效的有效期: %s", request.SetDuration)})
+			return
+		}
+		if max := maxAllowedDuration(config); duration > max {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("有效期不能超过 %s", max)})
+			return
+		}
+
+		expiresAt := time.Now().Add(duration)
+		updated, err := GetStorageManager().UpdateMetadata(id, func(stored *StoredData) error {
+			stored.ExpiresAt = &expiresAt
+			// 访问窗口不能超过主有效期
+			if stored.AccessWindowEndsAt != nil && stored.AccessWindowEndsAt.After(expiresAt) {
+				stored.AccessWindowEndsAt = &expiresAt
+			}
+			return nil
+		})
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "数据不存在或已被销毁"})
+			} else {
+				manageLog.Error("Error updating expiration", "id", id, "error", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "更新有效期失败"})
+			}
+			return
+		}
+
+		manageLog.Info("Expiration changed by owner", "id", id, "expiresAt", expiresAt)
+		c.JSON(http.StatusOK, managedStatus(id, updated))
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestManageExpirationLimits(t *testing.T) {
+	cfg := setupTestStorage(t, StorageModePersistent)
+	cfg.Expiration.Enabled = true
+	cfg.Expiration.Mode = "free"
+	cfg.Expiration.AvailableDurations = []string{"1h", "24h"}
+	cfg.Expiration.DefaultDuration = "72h" // Longer than every option
+
+	const id = "4e6a8c0d-3f5b-4c7d-8e9f-a0b1c2d3e4f5"
+	data := &StoredData{EncryptedData: "ciphertext"}
+	manageToken, err := newOwnerTokens(data)
+	if err != nil {
+		t.Fatalf("newOwnerTokens: %v", err)
+	}
+	if err := GetStorageManager().CreateMetadata(id, data); err != nil {
+		t.Fatalf("CreateMetadata: %v", err)
+	}
+
+	setDuration := func(duration string) int {
+		req := httptest.NewRequest(http.MethodPatch, "/api/manage/"+id, strings.NewReader(`{"setDuration": "`+duration+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+manageToken)
+		return serveTestRequest(http.MethodPatch, "/api/manage/:id", ManageExpirationHandler(), req).Code
+	}
+
+	for duration, want := range map[string]int{
+		"30m":  http.StatusOK,
+		"24h":  http.StatusOK,
+		"72h":  http.StatusOK, // default_duration counts as allowed
+		"73h":  http.StatusBadRequest,
+		"-1h":  http.StatusBadRequest,
+		"soon": http.StatusBadRequest,
+	} {
+		if got := setDuration(duration); got != want {
+			t.Errorf("setDuration %s returned %d, want %d", duration, got, want)
+		}
+	}
+
+	stored, err := GetStorageManager().GetMetadata(id)
+	if err != nil {
+		t.Fatalf("GetMetadata: %v", err)
+	}
+	if limit := time.Now().Add(72 * time.Hour); stored.ExpiresAt == nil || stored.ExpiresAt.After(limit) {
+		t.Fatalf("ExpiresAt = %v, beyond the allowed maximum", stored.ExpiresAt)
+	}
+
+	cfg.Expiration.Mode = "forced"
+	if got := setDuration("1h"); got != http.StatusConflict {
+		t.Fatalf("setDuration in forced mode returned %d, want 409", got)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/subtle"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// 销毁原因，用作 biu_burns_total 的 reason 标签
+const (
+	burnReasonManual       = "manual"        // POST /api/burn 或所有者撤销
+	burnReasonExpired      = "expired"       // 超过 ExpiresAt
+	burnReasonAccessWindow = "access_window" // 超过 AccessWindowEndsAt
+	burnReasonRead         = "read"          // 查看次数用完或读取即焚
+	burnReasonOrphaned     = "orphaned"      // 元数据对应的加密文件已不存在
+)
+
+// metricsRegistry 只包含本服务的指标，不使用全局默认注册表
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	metricItemsStored = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "biu_items_stored_total",
+		Help: "Notes and files stored, by type (text or file).",
+	}, []string{"type"})
+
+	metricReads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "biu_reads_total",
+		Help: "Ciphertext reads (text reveals and file downloads), by type.",
+	}, []string{"type"})
+
+	metricBurns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "biu_burns_total",
+		Help: "Items burned, by reason (manual, expired, access_window, read, orphaned).",
+	}, []string{"reason"})
+
+	metricChunksReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "biu_chunk_uploads_total",
+		Help: "Upload chunks received and stored.",
+	})
+
+	metricChunkBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "biu_chunk_upload_bytes_total",
+		Help: "Bytes of upload chunks received and stored.",
+	})
+
+	metricMergeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "biu_merge_duration_seconds",
+		Help:    "Time spent finishing and verifying completed uploads, by result (success, failure or cancelled).",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 8), // 10ms .. ~164s
+	}, []string{"result"})
+
+	metricCleanupDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "biu_cleanup_cycle_duration_seconds",
+		Help:    "Duration of expiry cleanup cycles, from dispatch until every due item was processed.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8), // 1ms .. ~16s
+	})
+
+	metricCleanupBurned = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "biu_cleanup_items_burned_total",
+		Help: "Expired items burned by the cleanup task.",
+	})
+
+	metricGCReclaimed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "biu_gc_reclaimed_total",
+		Help: "Objects reclaimed by the upload reaper, by kind (abandoned_upload, orphaned_blob, orphaned_metadata).",
+	}, []string{"kind"})
+
+	metricGCDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "biu_gc_pass_duration_seconds",
+		Help:    "Duration of upload reaper passes.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8), // 1ms .. ~16s
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		metricItemsStored,
+		metricReads,
+		metricBurns,
+		metricChunksReceived,
+		metricChunkBytes,
+		metricMergeDuration,
+		metricCleanupDuration,
+		metricCleanupBurned,
+		metricGCReclaimed,
+		metricGCDuration,
+	)
+}
+
+// registerStorageMetrics 注册依赖运行时状态的指标 (磁盘占用、销毁队列、到期索引)
+func registerStorageMetrics(config *Config) {
+	if config.Storage.InMemory() {
+		metricsRegistry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "biu_memory_storage_bytes",
+			Help: "Bytes held by the in-memory storage backend.",
+		}, func() float64 {
+			return float64(GetStorageManager().backend.(*memoryStorage).usedBytes())
+		}))
+	} else {
+		for label, dir := range map[string]string{
+			"final_upload": config.Paths.FinalUploadDir,
+			"temp_chunk":   config.Paths.TempChunkDir,
+		} {
+			dir := dir
+			metricsRegistry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name:        "biu_disk_bytes",
+				Help:        "Bytes on local disk in the upload directories.",
+				ConstLabels: prometheus.Labels{"dir": label},
+			}, func() float64 {
+				return float64(dirSize(dir))
+			}))
+		}
+	}
+
+	metricsRegistry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "biu_burn_queue_depth",
+			Help: "Burns waiting to be completed or retried.",
+		}, func() float64 {
+			return float64(GetStorageManager().burns.Stats().Depth)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "biu_burn_queue_failures_total",
+			Help: "Failed burn attempts since startup.",
+		}, func() float64 {
+			return float64(GetStorageManager().burns.Stats().Failures)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "biu_expiry_index_entries",
+			Help: "Items tracked by the in-memory expiry index.",
+		}, func() float64 {
+			return float64(GetStorageManager().expiry.Len())
+		}),
+	)
+}
+
+// dirSize 返回目录下所有文件的总字节数 (目录不存在时为 0)
+func dirSize(dir string) int64 {
+	var total int64
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil // Files may disappear while walking (burns, merges)
+		}
+		if !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	return total
+}
+
+// metricsHandler 返回 /metrics 的处理器
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// MetricsHandler 在主服务上提供 /metrics，要求 "Authorization: Bearer <metrics.token>"
+func MetricsHandler() gin.HandlerFunc {
+	handler := metricsHandler()
+	return func(c *gin.Context) {
+		config := currentConfig()
+		token := config.Metrics.Token
+		if token != "" && subtle.ConstantTimeCompare([]byte(bearerToken(c)), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+		handler.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+// startMetricsListener 在独立的地址上提供 /metrics (例如只监听内网或 127.0.0.1)，关闭服务时停止
+func startMetricsListener(config *Config) {
+	mux := http.NewServeMux()
+	handler := metricsHandler()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		token := currentConfig().Metrics.Token
+		if token != "" {
+			provided := r.Header.Get("Authorization")
+			if subtle.ConstantTimeCompare([]byte(provided), []byte("Bearer "+token)) != 1 {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+	metricsLog.Info("Serving /metrics on separate listener", "listen", config.Metrics.Listen)
+	srv := &http.Server{Addr: config.Metrics.Listen, Handler: mux}
+	go func() {
+		<-backgroundJobs.Stopping()
+		srv.Close()
+	}()
+	if err := srv.ListenAndServe(); err != nil {
+		metricsLog.Info("Metrics listener stopped", "error", err)
+	}
+}
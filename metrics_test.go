@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrapeMetric 读取 /metrics，返回 series (例如 `biu_reads_total{type="text"}`) 的值，不存在时为 0
+func scrapeMetric(t *testing.T, token, series string) float64 {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	w := serveTestRequest(http.MethodGet, "/metrics", MetricsHandler(), req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("/metrics returned %d: %s", w.Code, w.Body.String())
+	}
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), series+" "); ok {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("parse %s: %v", scanner.Text(), err)
+			}
+			return v
+		}
+	}
+	return 0
+}
+
+func TestMetricsHandlerRequiresToken(t *testing.T) {
+	cfg := setupTestStorage(t, StorageModePersistent)
+	cfg.Metrics.Enabled = true
+	cfg.Metrics.Token = "metrics-secret"
+
+	for _, header := range []string{"", "Bearer wrong", "Basic bWV0cmljcy1zZWNyZXQ="} {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		if w := serveTestRequest(http.MethodGet, "/metrics", MetricsHandler(), req); w.Code != http.StatusUnauthorized {
+			t.Fatalf("/metrics with Authorization %q returned %d", header, w.Code)
+		}
+	}
+}
+
+func TestMetricsCountStoresAndReads(t *testing.T) {
+	cfg := setupTestStorage(t, StorageModePersistent)
+	cfg.Metrics.Enabled = true
+	cfg.Metrics.Token = "metrics-secret"
+	const (
+		stored = `biu_items_stored_total{type="text"}`
+		reads  = `biu_reads_total{type="text"}`
+		burns  = `biu_burns_total{reason="read"}`
+	)
+	before := map[string]float64{}
+	for _, series := range []string{stored, reads, burns} {
+		before[series] = scrapeMetric(t, cfg.Metrics.Token, series)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/store", strings.NewReader(`{"encryptedData": "ciphertext", "iv": "iv", "salt": "salt", "burnOnRead": true}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := serveTestRequest(http.MethodPost, "/api/store", StoreDataHandler(), req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("store returned %d: %s", w.Code, w.Body.String())
+	}
+	var response struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("store response %s: %v", w.Body.String(), err)
+	}
+	if got := revealConcurrently(t, response.ID, 1); got != 1 {
+		t.Fatalf("reveal did not return the data")
+	}
+	waitBackgroundJobs(t)
+
+	for _, series := range []string{stored, reads, burns} {
+		if got := scrapeMetric(t, cfg.Metrics.Token, series); got != before[series]+1 {
+			t.Fatalf("%s = %v, want %v", series, got, before[series]+1)
+		}
+	}
+}
@@ -1,29 +1,29 @@
 package main
 
 import (
-	"log"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 )
 
-func redirect(config *Config) gin.HandlerFunc {
+func redirect() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		shortCode := c.Param("shortCode")
 		if shortCode == "" {
-			log.Printf("[Redirect] 短代码为空")
+			redirectLog.Debug("短代码为空")
 			c.JSON(http.StatusBadRequest, gin.H{"error": "无效的短链接"})
 			return
 		}
 
 		url, exists := GetShortLink(shortCode)
 		if !exists {
-			log.Printf("[Redirect] 未找到短链接: %s", shortCode)
+			redirectLog.Info("未找到短链接", "shortCode", shortCode)
 			c.JSON(http.StatusNotFound, gin.H{"error": "短链接不存在或已过期"})
 			return
 		}
 
-		log.Printf("[Redirect] 重定向 %s 到 %s", shortCode, url)
+		// 目标 URL 的片段中可能带有解密密钥，不写入日志
+		redirectLog.Debug("重定向", "shortCode", shortCode)
 		c.Redirect(http.StatusMovedPermanently, url)
 	}
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// configPath 是启动时加载的配置文件路径，热加载时重新读取
+var configPath string
+
+// reloadLock 保证同一时间只有一次热加载
+var reloadLock sync.Mutex
+
+// currentConfig 返回当前生效的配置。配置加载后不再修改，热加载时整体替换；
+// 处理请求时在开始时读取一次，整个请求使用同一份配置。
+func currentConfig() *Config {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return config
+}
+
+// staticConfigFields 是启动后无法更改的配置项 (监听地址、存储、后台任务等)。
+// 热加载时这些配置项保留旧值，修改它们需要重启。
+var staticConfigFields = []struct {
+	name  string
+	field func(c *Config) any // 返回配置项的指针
+}{
+	{"server.host", func(c *Config) any { return &c.Server.Host }},
+	{"server.port", func(c *Config) any { return &c.Server.Port }},
+	{"server.allowed_origins", func(c *Config) any { return &c.Server.AllowedOrigins }},
+	{"server.tls", func(c *Config) any { return &c.Server.TLS }},
+	{"paths", func(c *Config) any { return &c.Paths }},
+	{"storage", func(c *Config) any { return &c.Storage }},
+	{"metrics.enabled", func(c *Config) any { return &c.Metrics.Enabled }},
+	{"metrics.listen", func(c *Config) any { return &c.Metrics.Listen }},
+	{"expiration.enabled", func(c *Config) any { return &c.Expiration.Enabled }},
+	{"expiration.burn_workers", func(c *Config) any { return &c.Expiration.BurnWorkers }},
+	{"gc.enabled", func(c *Config) any { return &c.GC.Enabled }},
+	{"logging", func(c *Config) any { return &c.Logging }},
+}
+
+// reloadConfig 重新读取并验证配置文件，成功后整体替换当前配置，之后的请求使用新配置。
+// 文件无法读取或验证失败时保留当前配置并返回错误。无法在运行时更改的配置项保留旧值，
+// 返回值列出其中被修改过、需要重启才能生效的配置项。
+func reloadConfig() (restartRequired []string, err error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+
+	next, err := LoadConfig(configPath)
+	if err != nil {
+		configLog.Error("Reload failed, keeping current config", "path", configPath, "error", err)
+		return nil, err
+	}
+
+	current := currentConfig()
+	for _, f := range staticConfigFields {
+		old := reflect.ValueOf(f.field(current)).Elem()
+		changed := reflect.ValueOf(f.field(next)).Elem()
+		if !reflect.DeepEqual(old.Interface(), changed.Interface()) {
+			restartRequired = append(restartRequired, f.name)
+			changed.Set(old)
+		}
+	}
+	// 恢复旧值后的组合可能不再满足验证 (例如 metrics.listen 恢复为空而新的 metrics.token 为空)，
+	// 需要对合并后的配置重新验证
+	if len(restartRequired) > 0 {
+		if err := validateAndNormalizeConfig(next); err != nil {
+			err = fmt.Errorf("需要重启的配置项保留旧值后，配置验证失败: %w", err)
+			configLog.Error("Reload failed, keeping current config", "path", configPath, "restartRequired", strings.Join(restartRequired, ", "), "error", err)
+			return nil, err
+		}
+	}
+
+	configLock.Lock()
+	config = next
+	configLock.Unlock()
+	logConfigSources(next)
+
+	if len(restartRequired) > 0 {
+		configLog.Warn("Reloaded config, but some changes require a restart and were not applied", "path", configPath, "restartRequired", strings.Join(restartRequired, ", "))
+	} else {
+		configLog.Info("Reloaded config", "path", configPath)
+	}
+	return restartRequired, nil
+}
+
+// watchReloadSignal 收到 SIGHUP 时热加载配置，关闭服务时退出
+func watchReloadSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case <-signals:
+			configLog.Info("Received SIGHUP, reloading configuration")
+			reloadConfig()
+		case <-backgroundJobs.Stopping():
+			return
+		}
+	}
+}
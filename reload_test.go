@@ -0,0 +1,80 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+// loadTestConfigFile 把 yaml 作为启动时的配置文件加载为当前配置，测试结束后恢复
+func loadTestConfigFile(t *testing.T, yaml string) string {
+	t.Helper()
+	path := writeTestConfig(t, yaml)
+	loaded, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	configLock.Lock()
+	previous, previousPath := config, configPath
+	config, configPath = loaded, path
+	configLock.Unlock()
+	t.Cleanup(func() {
+		configLock.Lock()
+		config, configPath = previous, previousPath
+		configLock.Unlock()
+	})
+	return path
+}
+
+func TestReloadConfig(t *testing.T) {
+	path := loadTestConfigFile(t, "server:\n  port: 3010\n  max_file_size_mb: 10\n")
+	rewrite := func(yaml string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(yaml), 0640); err != nil {
+			t.Fatalf("write config: %v", err)
+		}
+	}
+
+	// 可以在运行时修改的配置项立即生效，其他配置项保留旧值并列出
+	rewrite("server:\n  port: 3020\n  max_file_size_mb: 20\n")
+	restartRequired, err := reloadConfig()
+	if err != nil {
+		t.Fatalf("reloadConfig: %v", err)
+	}
+	if !reflect.DeepEqual(restartRequired, []string{"server.port"}) {
+		t.Fatalf("restartRequired = %v", restartRequired)
+	}
+	if current := currentConfig(); current.Server.Port != 3010 || current.Server.MaxFileSizeMB != 20 {
+		t.Fatalf("config after reload: port %d, max_file_size_mb %d", current.Server.Port, current.Server.MaxFileSizeMB)
+	}
+
+	// 无法读取的文件不会替换当前配置
+	before := currentConfig()
+	rewrite("server: [")
+	if _, err := reloadConfig(); err == nil {
+		t.Fatalf("reloadConfig accepted invalid YAML")
+	}
+	if currentConfig() != before {
+		t.Fatalf("config replaced by a failed reload")
+	}
+}
+
+func TestReloadConfigValidatesMergedConfig(t *testing.T) {
+	loadTestConfigFile(t, "metrics:\n  enabled: true\n  token: \"metrics-secret\"\n")
+	before := currentConfig()
+
+	// 新文件本身有效 (独立监听时不需要 token)，但 metrics.listen 保留旧值后缺少 token
+	next := writeTestConfig(t, "metrics:\n  enabled: true\n  listen: \"127.0.0.1:9100\"\n")
+	configLock.Lock()
+	configPath = next
+	configLock.Unlock()
+	if _, err := LoadConfig(next); err != nil {
+		t.Fatalf("new config file is invalid on its own: %v", err)
+	}
+	if _, err := reloadConfig(); err == nil {
+		t.Fatalf("reloadConfig accepted a merged config without metrics.token")
+	}
+	if currentConfig() != before {
+		t.Fatalf("config replaced by a failed reload")
+	}
+}
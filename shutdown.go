@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// errServerShutdown 是关闭服务时中断后台任务的原因
+var errServerShutdown = errors.New("server shutting down")
+
+// shutdownRollbackTimeout 是超过 drain timeout 后，等待被中断的任务回滚 (标记失败并删除文件) 的时间
+const shutdownRollbackTimeout = 5 * time.Second
+
+// backgroundJobs 跟踪所有后台任务，关闭服务时等待它们结束
+var backgroundJobs = newJobTracker()
+
+// jobTracker 跟踪后台任务: 完成上传、销毁，以及销毁队列、到期清理、回收等常驻循环
+type jobTracker struct {
+	mu       sync.Mutex
+	running  map[string]int // 按类别统计正在运行的任务
+	finished chan struct{}  // 每当有任务结束时发出信号
+
+	draining  chan struct{} // 开始关闭时关闭: SSE 等长连接据此结束
+	stopping  chan struct{} // HTTP 请求处理完后关闭: 常驻循环据此退出
+	drainOnce sync.Once
+	stopOnce  sync.Once
+}
+
+func newJobTracker() *jobTracker {
+	return &jobTracker{
+		running:  make(map[string]int),
+		finished: make(chan struct{}, 1),
+		draining: make(chan struct{}),
+		stopping: make(chan struct{}),
+	}
+}
+
+// Go 在后台运行 fn 并跟踪它，kind 用于日志 (如 "finalize"、"burn")
+func (t *jobTracker) Go(kind string, fn func()) {
+	t.mu.Lock()
+	t.running[kind]++
+	t.mu.Unlock()
+
+	go func() {
+		defer func() {
+			t.mu.Lock()
+			if t.running[kind]--; t.running[kind] == 0 {
+				delete(t.running, kind)
+			}
+			t.mu.Unlock()
+			select {
+			case t.finished <- struct{}{}:
+			default:
+			}
+		}()
+		fn()
+	}()
+}
+
+// Draining 在服务开始关闭时关闭
+func (t *jobTracker) Draining() <-chan struct{} {
+	return t.draining
+}
+
+// Stopping 在常驻循环应当退出时关闭
+func (t *jobTracker) Stopping() <-chan struct{} {
+	return t.stopping
+}
+
+func (t *jobTracker) beginDrain() {
+	t.drainOnce.Do(func() { close(t.draining) })
+}
+
+func (t *jobTracker) stop() {
+	t.stopOnce.Do(func() { close(t.stopping) })
+}
+
+// Running 返回按类别统计的正在运行的任务数
+func (t *jobTracker) Running() map[string]int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	running := make(map[string]int, len(t.running))
+	for kind, n := range t.running {
+		running[kind] = n
+	}
+	return running
+}
+
+// Wait 等待所有任务结束；ctx 先结束时返回 ctx.Err()
+func (t *jobTracker) Wait(ctx context.Context) error {
+	for {
+		if len(t.Running()) == 0 {
+			return nil
+		}
+		select {
+		case <-t.finished:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// serveUntilSignal 运行 HTTP 服务，收到 SIGINT / SIGTERM 后在 server.shutdown_timeout 内优雅关闭:
+//  1. 停止接受新连接，等待正在处理的请求 (包括下载) 结束，SSE 连接立即结束
+//  2. 通知常驻循环退出，等待正在完成的上传和销毁
+//  3. 仍未结束的上传完成过程被中断，上传标记为 interrupted 并删除文件；
+//     销毁在删除元数据之前已写入持久化队列，下次启动时继续
+//
+// 关闭期间再次收到信号时立即退出。
+func serveUntilSignal(srv *http.Server) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	var drainTimeout time.Duration
+	select {
+	case err := <-serveErr:
+		return err
+	case sig := <-signals:
+		drainTimeout = currentConfig().shutdownTimeout()
+		shutdownLog.Info("Received signal, draining", "signal", sig.String(), "timeout", drainTimeout)
+	}
+	go func() {
+		sig := <-signals
+		shutdownLog.Warn("Received signal again, exiting immediately", "signal", sig.String())
+		os.Exit(1)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	backgroundJobs.beginDrain()
+	if err := srv.Shutdown(ctx); err != nil {
+		shutdownLog.Warn("Requests still running after drain timeout, closing connections", "error", err)
+		srv.Close()
+	}
+
+	backgroundJobs.stop()
+	if err := backgroundJobs.Wait(ctx); err != nil {
+		shutdownLog.Warn("Background jobs still running after drain timeout, interrupting uploads being finished", "running", backgroundJobs.Running())
+		GetStorageManager().uploads.interruptAllFinalize(errServerShutdown)
+
+		rollback, cancelRollback := context.WithTimeout(context.Background(), shutdownRollbackTimeout)
+		defer cancelRollback()
+		if err := backgroundJobs.Wait(rollback); err != nil {
+			shutdownLog.Error("Giving up on background jobs", "running", backgroundJobs.Running())
+		}
+	}
+	shutdownLog.Info("Shutdown complete")
+	return nil
+}
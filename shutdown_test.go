@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestJobTrackerWait(t *testing.T) {
+	jobs := newJobTracker()
+	release := make(chan struct{})
+	jobs.Go("finalize", func() { <-release })
+	jobs.Go("burn", func() {})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := jobs.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Wait with a running job = %v, want DeadlineExceeded", err)
+	}
+	if running := jobs.Running(); !reflect.DeepEqual(running, map[string]int{"finalize": 1}) {
+		t.Fatalf("Running() = %v", running)
+	}
+
+	close(release)
+	if err := jobs.Wait(context.Background()); err != nil {
+		t.Fatalf("Wait: %v", err)
+	}
+
+	// 重复关闭是安全的
+	for i := 0; i < 2; i++ {
+		jobs.beginDrain()
+		jobs.stop()
+	}
+	for _, ch := range []<-chan struct{}{jobs.Draining(), jobs.Stopping()} {
+		select {
+		case <-ch:
+		default:
+			t.Fatalf("channel not closed after beginDrain and stop")
+		}
+	}
+}
+
+// blockingFinishStorage 的 FinishUpload 在 release 关闭前不返回，模拟耗时的完成过程
+type blockingFinishStorage struct {
+	Storage
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingFinishStorage) FinishUpload(uploadID, fileName string, totalChunks int) (int64, error) {
+	close(s.started)
+	<-s.release
+	return s.Storage.FinishUpload(uploadID, fileName, totalChunks)
+}
+
+func TestShutdownInterruptsFinalize(t *testing.T) {
+	setupTestStorage(t, StorageModePersistent)
+	store := GetStorageManager()
+	blocking := &blockingFinishStorage{Storage: store.backend, started: make(chan struct{}), release: make(chan struct{})}
+	store.backend = blocking
+
+	content := []byte("encrypted file contents")
+	w, upload := initTestUpload(t, `{"fileName": "file.bin", "fileSize": `+strconv.Itoa(len(content))+`}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("init returned %d: %s", w.Code, w.Body.String())
+	}
+	if w := putChunk(upload.UploadID, 1, content); w.Code != http.StatusOK {
+		t.Fatalf("chunk returned %d: %s", w.Code, w.Body.String())
+	}
+	<-blocking.started
+
+	// 超过 drain timeout 时中断完成过程，上传标记为 interrupted 并删除文件
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := backgroundJobs.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Wait while finalizing = %v, want DeadlineExceeded", err)
+	}
+	store.uploads.interruptAllFinalize(errServerShutdown)
+	close(blocking.release)
+	waitBackgroundJobs(t)
+
+	if status := uploadStatus(t, upload.UploadID); status.State != UploadStateFailed || status.FailureReason != UploadFailureInterrupted {
+		t.Fatalf("status after shutdown = %s (%s)", status.State, status.FailureReason)
+	}
+	if _, err := store.StatBlob(upload.UploadID, "file.bin"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("final file after shutdown: %v", err)
+	}
+}
@@ -2,21 +2,140 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 )
 
+// ErrNotFound 表示请求的元数据或加密文件不存在
+var ErrNotFound = errors.New("not found")
+
+// ErrChunkMissing 表示完成上传时缺少某个分片
+var ErrChunkMissing = errors.New("chunk missing")
+
+// ErrAlreadyExists 表示要创建的记录已经存在
+var ErrAlreadyExists = errors.New("already exists")
+
+// BlobInfo 描述一个已存储的加密文件
+type BlobInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// MetadataStore 负责 StoredData 记录的持久化
+type MetadataStore interface {
+	// PutMetadata 创建或覆盖 id 对应的记录
+	PutMetadata(id string, data *StoredData) error
+	// CreateMetadata 仅在 id 不存在时创建记录，已存在时返回 ErrAlreadyExists。并发调用时只有一个能成功
+	CreateMetadata(id string, data *StoredData) error
+	// GetMetadata 读取 id 对应的记录，不存在时返回 ErrNotFound
+	GetMetadata(id string) (*StoredData, error)
+	// UpdateMetadata 在同一把锁内读取、修改并写回记录，返回修改后的记录
+	UpdateMetadata(id string, fn func(data *StoredData) error) (*StoredData, error)
+	// DeleteMetadata 删除 id 对应的记录，不存在时返回 ErrNotFound
+	DeleteMetadata(id string) error
+	// TakeMetadata 原子地取走记录: 返回记录并将其删除。并发调用时只有一个能成功，其余返回 ErrNotFound
+	TakeMetadata(id string) (*StoredData, error)
+	// IterateMetadata 遍历所有记录，fn 返回错误时停止遍历
+	IterateMetadata(fn func(id string, data *StoredData) error) error
+}
+
+// BlobStore 负责加密文件 (密文) 的存储，每个 id 下可以有多个命名文件
+type BlobStore interface {
+	// CreateBlob 创建 (或截断) id/name 并返回写入句柄
+	CreateBlob(id, name string) (io.WriteCloser, error)
+	// OpenBlob 打开 id/name 用于读取，不存在时返回 ErrNotFound
+	OpenBlob(id, name string) (io.ReadSeekCloser, BlobInfo, error)
+	// StatBlob 返回 id/name 的信息，不存在时返回 ErrNotFound
+	StatBlob(id, name string) (BlobInfo, error)
+	// RemoveBlob 删除 id 下的所有文件，不存在时不返回错误
+	RemoveBlob(id string) error
+	// ListBlobs 遍历所有存在加密文件的 id
+	ListBlobs(fn func(id string) error) error
+}
+
+// ChunkStore 负责分片上传期间尚未完成的文件。初始化时按声明的大小预分配文件，
+// 每个分片直接写到它在文件中的偏移处，所有分片写完后文件即可读取，不再需要合并。
+type ChunkStore interface {
+	// PrepareUpload 为 uploadID/fileName 预分配 size 字节
+	PrepareUpload(uploadID, fileName string, size int64) error
+	// WriteChunk 把第 chunkNumber 个分片 (从 1 开始) 写到偏移 offset 处，返回写入的字节数
+	WriteChunk(uploadID, fileName string, chunkNumber int, offset int64, r io.Reader, size int64) (int64, error)
+	// FinishUpload 在 1..totalChunks 全部写入后把 uploadID/fileName 变为可读取的加密文件，返回最终大小
+	FinishUpload(uploadID, fileName string, totalChunks int) (int64, error)
+	// RemoveChunks 放弃 uploadID 未完成的上传，不存在时不返回错误
+	RemoveChunks(uploadID string) error
+	// ListUploads 遍历存储中所有未完成的上传 (包括没有上传会话的残留)
+	ListUploads(fn func(uploadID string) error) error
+}
+
+// Storage 是完整的存储后端：元数据 + 加密文件 + 上传分片
+type Storage interface {
+	MetadataStore
+	BlobStore
+	ChunkStore
+}
+
+// 支持的存储后端名称 (config.yaml 中的 storage.backend)
+const (
+	StorageBackendFilesystem = "filesystem"
+	StorageBackendS3         = "s3"
+
+	StorageModePersistent = "persistent"
+	StorageModeMemory     = "memory"
+)
+
+// objectStorage 是只负责加密文件与分片的后端 (元数据仍保存在本地)
+type objectStorage interface {
+	BlobStore
+	ChunkStore
+}
+
+// splitStorage 组合一个元数据后端和一个加密文件后端
+type splitStorage struct {
+	MetadataStore
+	objectStorage
+}
+
+// newStorageBackend 根据配置创建存储后端
+func newStorageBackend(config *Config) (Storage, error) {
+	if config.Storage.InMemory() {
+		return newMemoryStorage(int64(config.Storage.Memory.MaxSizeMB) * 1024 * 1024), nil
+	}
+	fsStore := newFileStorage(config.Paths.DataStorageDir, config.Paths.FinalUploadDir, config.Paths.TempChunkDir)
+	switch config.Storage.Backend {
+	case StorageBackendFilesystem, "":
+		return fsStore, nil
+	case StorageBackendS3:
+		s3Store, err := newS3Storage(config.Storage.S3)
+		if err != nil {
+			return nil, fmt.Errorf("初始化 S3 存储失败: %w", err)
+		}
+		return splitStorage{MetadataStore: fsStore, objectStorage: s3Store}, nil
+	default:
+		return nil, fmt.Errorf("不支持的存储后端: %s", config.Storage.Backend)
+	}
+}
+
 // StorageManager 管理数据存储的结构体
 type StorageManager struct {
 	config    *Config
 	linksLock sync.RWMutex
 	links     map[string]string
 	dataDir   string
+	backend   Storage
+	expiry    *expiryIndex        // 到期索引，随元数据的写入/更新/删除同步维护
+	burns     *burnQueue          // 持久化的销毁队列
+	uploads   *uploadSessionStore // 分片上传会话
 }
 
+// StorageManager 自身实现 Storage，所有处理器都通过它访问存储
+var _ Storage = (*StorageManager)(nil)
+
 var (
 	storageManager *StorageManager
 	managerLock    sync.RWMutex
@@ -31,15 +150,48 @@ func InitStorage(config *Config) error {
 		return nil // 已经初始化
 	}
 
-	dataDir := filepath.Join(config.Paths.DataStorageDir, "data")
-	if err := os.MkdirAll(dataDir, 0750); err != nil {
-		return fmt.Errorf("创建数据目录失败: %w", err)
+	backend, err := newStorageBackend(config)
+	if err != nil {
+		return err
 	}
 
+	dataDir := filepath.Join(config.Paths.DataStorageDir, "data")
 	storageManager = &StorageManager{
 		config:  config,
 		links:   make(map[string]string),
 		dataDir: dataDir,
+		backend: backend,
+		expiry:  newExpiryIndex(),
+	}
+
+	if config.Storage.InMemory() {
+		// 纯内存模式: 短链接和销毁队列同样只保存在内存中
+		storageManager.burns = newBurnQueue("", storageManager)
+		storageManager.uploads = newUploadSessionStore("")
+		storageLog.Info("使用纯内存存储，重启后所有数据都会被销毁", "maxSizeMB", config.Storage.Memory.MaxSizeMB)
+		return nil
+	}
+	storageLog.Info("使用存储后端", "backend", config.Storage.Backend)
+
+	if err := os.MkdirAll(dataDir, 0750); err != nil {
+		return fmt.Errorf("创建数据目录失败: %w", err)
+	}
+
+	// 恢复上次未完成的销毁任务
+	storageManager.burns = newBurnQueue(filepath.Join(dataDir, "burn-queue"), storageManager)
+	if err := storageManager.burns.Load(); err != nil {
+		return err
+	}
+
+	// 恢复上传会话，重启后客户端仍能查询上传状态
+	storageManager.uploads = newUploadSessionStore(filepath.Join(dataDir, "upload-sessions"))
+	if err := storageManager.uploads.Load(); err != nil {
+		return err
+	}
+
+	// 从已有元数据重建到期索引
+	if err := storageManager.expiry.Rebuild(backend); err != nil {
+		return fmt.Errorf("重建到期索引失败: %w", err)
 	}
 
 	// 加载现有短链接
@@ -59,19 +211,19 @@ func (sm *StorageManager) loadLinks() error {
 	defer sm.linksLock.Unlock()
 
 	linksFile := filepath.Join(sm.dataDir, "shortlinks.json")
-	log.Printf("[Storage] 尝试从文件加载链接: %s", linksFile)
+	storageLog.Debug("尝试从文件加载链接", "path", linksFile)
 
 	data, err := os.ReadFile(linksFile)
 	if err != nil {
 		if os.IsNotExist(err) {
-			log.Println("[Storage] 链接文件未找到，从空映射开始。")
+			storageLog.Info("链接文件未找到，从空映射开始")
 			return nil
 		}
 		return fmt.Errorf("读取链接文件失败: %w", err)
 	}
 
 	if len(data) == 0 {
-		log.Println("[Storage] 链接文件为空，从空映射开始。")
+		storageLog.Info("链接文件为空，从空映射开始")
 		return nil
 	}
 
@@ -79,12 +231,16 @@ func (sm *StorageManager) loadLinks() error {
 		return fmt.Errorf("解析链接文件失败: %w", err)
 	}
 
-	log.Printf("[Storage] 成功加载了 %d 个短链接", len(sm.links))
+	storageLog.Info("成功加载短链接", "count", len(sm.links))
 	return nil
 }
 
 // SaveLinks 保存短链接映射到文件
 func (sm *StorageManager) SaveLinks() error {
+	if sm.config.Storage.InMemory() {
+		return nil
+	}
+
 	sm.linksLock.RLock()
 	defer sm.linksLock.RUnlock()
 
@@ -160,30 +316,119 @@ func GetShortLink(shortCode string) (string, bool) {
 	return manager.GetLongURL(shortCode)
 }
 
-// StoreMetadata 存储元数据，包括可选的密码保护
-func StoreMetadata(id string, metadata *StoredMetadata) error {
-	manager := GetStorageManager()
-	if manager == nil {
-		return fmt.Errorf("存储管理器未初始化")
+// PutMetadata 实现 MetadataStore
+func (sm *StorageManager) PutMetadata(id string, data *StoredData) error {
+	if err := sm.backend.PutMetadata(id, data); err != nil {
+		return err
 	}
+	sm.expiry.Track(id, data)
+	return nil
+}
 
-	dataDir := filepath.Join(manager.dataDir, "data")
-	if err := os.MkdirAll(dataDir, 0750); err != nil {
-		return fmt.Errorf("创建数据目录失败: %w", err)
+// CreateMetadata 实现 MetadataStore
+func (sm *StorageManager) CreateMetadata(id string, data *StoredData) error {
+	if err := sm.backend.CreateMetadata(id, data); err != nil {
+		return err
 	}
+	sm.expiry.Track(id, data)
+	return nil
+}
 
-	// ID is passed as a parameter, not part of the metadata struct itself
-	filePath := filepath.Join(dataDir, id+".json")
-	jsonData, err := json.MarshalIndent(metadata, "", "  ")
+// GetMetadata 实现 MetadataStore
+func (sm *StorageManager) GetMetadata(id string) (*StoredData, error) {
+	return sm.backend.GetMetadata(id)
+}
+
+// UpdateMetadata 实现 MetadataStore
+func (sm *StorageManager) UpdateMetadata(id string, fn func(data *StoredData) error) (*StoredData, error) {
+	data, err := sm.backend.UpdateMetadata(id, fn)
 	if err != nil {
-		return fmt.Errorf("序列化元数据失败: %w", err)
+		return nil, err
 	}
+	sm.expiry.Track(id, data)
+	return data, nil
+}
 
-	if err := os.WriteFile(filePath, jsonData, 0640); err != nil {
-		return fmt.Errorf("写入元数据文件失败: %w", err)
+// DeleteMetadata 实现 MetadataStore
+func (sm *StorageManager) DeleteMetadata(id string) error {
+	err := sm.backend.DeleteMetadata(id)
+	if err == nil || errors.Is(err, ErrNotFound) {
+		sm.expiry.Remove(id)
 	}
+	return err
+}
 
-	return nil
+// TakeMetadata 实现 MetadataStore
+func (sm *StorageManager) TakeMetadata(id string) (*StoredData, error) {
+	data, err := sm.backend.TakeMetadata(id)
+	if err == nil || errors.Is(err, ErrNotFound) {
+		sm.expiry.Remove(id)
+	}
+	return data, err
+}
+
+// IterateMetadata 实现 MetadataStore
+func (sm *StorageManager) IterateMetadata(fn func(id string, data *StoredData) error) error {
+	return sm.backend.IterateMetadata(fn)
+}
+
+// CreateBlob 实现 BlobStore
+func (sm *StorageManager) CreateBlob(id, name string) (io.WriteCloser, error) {
+	return sm.backend.CreateBlob(id, name)
+}
+
+// OpenBlob 实现 BlobStore
+func (sm *StorageManager) OpenBlob(id, name string) (io.ReadSeekCloser, BlobInfo, error) {
+	return sm.backend.OpenBlob(id, name)
+}
+
+// StatBlob 实现 BlobStore
+func (sm *StorageManager) StatBlob(id, name string) (BlobInfo, error) {
+	return sm.backend.StatBlob(id, name)
+}
+
+// RemoveBlob 实现 BlobStore
+func (sm *StorageManager) RemoveBlob(id string) error {
+	return sm.backend.RemoveBlob(id)
+}
+
+// ListBlobs 实现 BlobStore
+func (sm *StorageManager) ListBlobs(fn func(id string) error) error {
+	return sm.backend.ListBlobs(fn)
+}
+
+// PrepareUpload 实现 ChunkStore
+func (sm *StorageManager) PrepareUpload(uploadID, fileName string, size int64) error {
+	return sm.backend.PrepareUpload(uploadID, fileName, size)
+}
+
+// WriteChunk 实现 ChunkStore
+func (sm *StorageManager) WriteChunk(uploadID, fileName string, chunkNumber int, offset int64, r io.Reader, size int64) (int64, error) {
+	return sm.backend.WriteChunk(uploadID, fileName, chunkNumber, offset, r, size)
+}
+
+// FinishUpload 实现 ChunkStore
+func (sm *StorageManager) FinishUpload(uploadID, fileName string, totalChunks int) (int64, error) {
+	return sm.backend.FinishUpload(uploadID, fileName, totalChunks)
+}
+
+// RemoveChunks 实现 ChunkStore
+func (sm *StorageManager) RemoveChunks(uploadID string) error {
+	return sm.backend.RemoveChunks(uploadID)
+}
+
+// ListUploads 实现 ChunkStore
+func (sm *StorageManager) ListUploads(fn func(uploadID string) error) error {
+	return sm.backend.ListUploads(fn)
+}
+
+// StoreMetadata 存储元数据，包括可选的密码保护
+func StoreMetadata(id string, metadata *StoredMetadata) error {
+	manager := GetStorageManager()
+	if manager == nil {
+		return fmt.Errorf("存储管理器未初始化")
+	}
+	return manager.PutMetadata(id, metadata)
 }
 
 // GetMetadata 获取元数据，包括密码保护信息
@@ -192,20 +437,5 @@ func GetMetadata(id string) (*StoredMetadata, error) {
 	if manager == nil {
 		return nil, fmt.Errorf("存储管理器未初始化")
 	}
-
-	filePath := filepath.Join(manager.dataDir, "data", id+".json")
-	data, err := os.ReadFile(filePath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, fmt.Errorf("元数据不存在")
-		}
-		return nil, fmt.Errorf("读取元数据文件失败: %w", err)
-	}
-
-	var metadata StoredMetadata
-	if err := json.Unmarshal(data, &metadata); err != nil {
-		return nil, fmt.Errorf("解析元数据失败: %w", err)
-	}
-
-	return &metadata, nil
+	return manager.GetMetadata(id)
 }
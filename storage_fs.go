@@ -0,0 +1,524 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// keyedMutex 为每个 id 提供独立的互斥锁，避免对同一条记录的并发读改写
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedMutexEntry
+}
+
+type keyedMutexEntry struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// Lock 锁定 key，返回对应的解锁函数
+func (km *keyedMutex) Lock(key string) func() {
+	km.mu.Lock()
+	if km.locks == nil {
+		km.locks = make(map[string]*keyedMutexEntry)
+	}
+	entry, ok := km.locks[key]
+	if !ok {
+		entry = &keyedMutexEntry{}
+		km.locks[key] = entry
+	}
+	entry.refs++
+	km.mu.Unlock()
+
+	entry.mu.Lock()
+	return func() {
+		entry.mu.Unlock()
+		km.mu.Lock()
+		entry.refs--
+		if entry.refs == 0 {
+			delete(km.locks, key)
+		}
+		km.mu.Unlock()
+	}
+}
+
+// claimedSuffix 标记已被 TakeMetadata 认领、即将删除的元数据文件
+const claimedSuffix = ".claimed"
+
+// fileStorage 是默认的存储后端：
+//   - 元数据: <DataStorageDir>/<id>.json
+//   - 加密文件: <FinalUploadDir>/<id>/<name>
+//   - 上传中的文件: <FinalUploadDir>/<uploadID>/<name>.part，完成后原地改名为 <name>
+//   - 旧版本留下的上传分片: <TempChunkDir>/<uploadID>/<chunkNumber> (只做清理)
+type fileStorage struct {
+	metaDir  string
+	blobDir  string
+	chunkDir string
+	locks    keyedMutex
+}
+
+var _ Storage = (*fileStorage)(nil)
+
+// newFileStorage 创建基于本地文件系统的存储后端
+func newFileStorage(metaDir, blobDir, chunkDir string) *fileStorage {
+	return &fileStorage{
+		metaDir:  metaDir,
+		blobDir:  blobDir,
+		chunkDir: chunkDir,
+	}
+}
+
+func (fsStore *fileStorage) metadataPath(id string) string {
+	return filepath.Join(fsStore.metaDir, id+".json")
+}
+
+// blobPath 返回 id/name 的路径，拒绝任何可能导致路径穿越的名称
+func (fsStore *fileStorage) blobPath(id, name string) (string, error) {
+	if id == "" || id != filepath.Base(id) || name == "" || name != filepath.Base(name) || name == ".." {
+		return "", fmt.Errorf("无效的文件路径: %s/%s", id, name)
+	}
+	return filepath.Join(fsStore.blobDir, id, name), nil
+}
+
+// writeMetadataFile 先写临时文件再重命名，保证读者不会看到写了一半的 JSON
+func (fsStore *fileStorage) writeMetadataFile(id string, data *StoredData) error {
+	jsonData, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("序列化元数据失败: %w", err)
+	}
+
+	if err := os.MkdirAll(fsStore.metaDir, 0750); err != nil {
+		return fmt.Errorf("创建数据存储目录失败: %w", err)
+	}
+
+	filePath := fsStore.metadataPath(id)
+	tempFile := filePath + ".tmp"
+	if err := os.WriteFile(tempFile, jsonData, 0640); err != nil {
+		return fmt.Errorf("写入元数据文件失败: %w", err)
+	}
+	if err := os.Rename(tempFile, filePath); err != nil {
+		os.Remove(tempFile)
+		return fmt.Errorf("重命名元数据文件失败: %w", err)
+	}
+	return nil
+}
+
+func (fsStore *fileStorage) readMetadataFile(id string) (*StoredData, error) {
+	jsonData, err := os.ReadFile(fsStore.metadataPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("读取元数据文件失败: %w", err)
+	}
+
+	var data StoredData
+	if err := json.Unmarshal(jsonData, &data); err != nil {
+		return nil, fmt.Errorf("解析元数据失败: %w", err)
+	}
+	return &data, nil
+}
+
+// PutMetadata 实现 MetadataStore
+func (fsStore *fileStorage) PutMetadata(id string, data *StoredData) error {
+	unlock := fsStore.locks.Lock(id)
+	defer unlock()
+	return fsStore.writeMetadataFile(id, data)
+}
+
+// CreateMetadata 实现 MetadataStore。先写入临时文件再硬链接到目标路径，目标已存在时链接失败
+// (与 O_EXCL 一样是原子的)，读者不会看到写了一半的文件。
+func (fsStore *fileStorage) CreateMetadata(id string, data *StoredData) error {
+	unlock := fsStore.locks.Lock(id)
+	defer unlock()
+
+	jsonData, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("序列化元数据失败: %w", err)
+	}
+	if err := os.MkdirAll(fsStore.metaDir, 0750); err != nil {
+		return fmt.Errorf("创建数据存储目录失败: %w", err)
+	}
+	filePath := fsStore.metadataPath(id)
+	temp, err := os.CreateTemp(fsStore.metaDir, id+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("写入元数据文件失败: %w", err)
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(jsonData); err != nil {
+		temp.Close()
+		return fmt.Errorf("写入元数据文件失败: %w", err)
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("写入元数据文件失败: %w", err)
+	}
+	if err := os.Chmod(temp.Name(), 0640); err != nil {
+		return fmt.Errorf("写入元数据文件失败: %w", err)
+	}
+	if err := os.Link(temp.Name(), filePath); err != nil {
+		if os.IsExist(err) {
+			return ErrAlreadyExists
+		}
+		return fmt.Errorf("创建元数据文件失败: %w", err)
+	}
+	return nil
+}
+
+// GetMetadata 实现 MetadataStore
+func (fsStore *fileStorage) GetMetadata(id string) (*StoredData, error) {
+	return fsStore.readMetadataFile(id)
+}
+
+// UpdateMetadata 实现 MetadataStore
+func (fsStore *fileStorage) UpdateMetadata(id string, fn func(data *StoredData) error) (*StoredData, error) {
+	unlock := fsStore.locks.Lock(id)
+	defer unlock()
+
+	data, err := fsStore.readMetadataFile(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := fn(data); err != nil {
+		return nil, err
+	}
+	if err := fsStore.writeMetadataFile(id, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// DeleteMetadata 实现 MetadataStore
+func (fsStore *fileStorage) DeleteMetadata(id string) error {
+	unlock := fsStore.locks.Lock(id)
+	defer unlock()
+
+	if err := os.Remove(fsStore.metadataPath(id)); err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("删除元数据文件失败: %w", err)
+	}
+	return nil
+}
+
+// TakeMetadata 实现 MetadataStore。
+// 先把元数据文件重命名为 .claimed：rename 是原子操作，即使多个进程共享同一目录也只有一个能成功。
+func (fsStore *fileStorage) TakeMetadata(id string) (*StoredData, error) {
+	unlock := fsStore.locks.Lock(id)
+	defer unlock()
+
+	claimedPath := fsStore.metadataPath(id) + claimedSuffix
+	if err := os.Rename(fsStore.metadataPath(id), claimedPath); err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("认领元数据文件失败: %w", err)
+	}
+
+	jsonData, readErr := os.ReadFile(claimedPath)
+	if err := os.Remove(claimedPath); err != nil {
+		// 残留的 .claimed 文件会在下一次遍历元数据时被清理
+		storageLog.Warn("Failed to remove claimed metadata file", "id", id, "error", err)
+	}
+	if readErr != nil {
+		return nil, fmt.Errorf("读取元数据文件失败: %w", readErr)
+	}
+
+	var data StoredData
+	if err := json.Unmarshal(jsonData, &data); err != nil {
+		return nil, fmt.Errorf("解析元数据失败: %w", err)
+	}
+	return &data, nil
+}
+
+// removeStaleClaim 删除进程在认领过程中崩溃后留下的 .claimed 文件
+func (fsStore *fileStorage) removeStaleClaim(name string) {
+	id := strings.TrimSuffix(name, ".json"+claimedSuffix)
+	unlock := fsStore.locks.Lock(id)
+	defer unlock()
+	if err := os.Remove(filepath.Join(fsStore.metaDir, name)); err != nil {
+		if !os.IsNotExist(err) { // Otherwise a concurrent TakeMetadata already finished
+			storageLog.Warn("Failed to remove stale claimed metadata file", "id", id, "error", err)
+		}
+		return
+	}
+	storageLog.Info("Removed stale claimed metadata file", "id", id)
+}
+
+// IterateMetadata 实现 MetadataStore
+func (fsStore *fileStorage) IterateMetadata(fn func(id string, data *StoredData) error) error {
+	entries, err := os.ReadDir(fsStore.metaDir)
+	if err != nil {
+		return fmt.Errorf("读取数据存储目录失败: %w", err)
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json"+claimedSuffix) {
+			fsStore.removeStaleClaim(entry.Name())
+			continue
+		}
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue // Skip directories, temp files and non-json files
+		}
+		id := strings.TrimSuffix(entry.Name(), ".json")
+		if !IsValidUUID(id) {
+			storageLog.Warn("Skipping file with invalid ID format", "file", entry.Name())
+			continue
+		}
+
+		data, err := fsStore.readMetadataFile(id)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				continue // Deleted by another request while iterating
+			}
+			storageLog.Warn("Skipping unreadable metadata", "id", id, "error", err)
+			continue
+		}
+		if err := fn(id, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateBlob 实现 BlobStore
+func (fsStore *fileStorage) CreateBlob(id, name string) (io.WriteCloser, error) {
+	blobPath, err := fsStore.blobPath(id, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0750); err != nil {
+		return nil, fmt.Errorf("创建上传目录失败: %w", err)
+	}
+	file, err := os.OpenFile(blobPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("创建文件失败: %w", err)
+	}
+	return file, nil
+}
+
+// OpenBlob 实现 BlobStore
+func (fsStore *fileStorage) OpenBlob(id, name string) (io.ReadSeekCloser, BlobInfo, error) {
+	blobPath, err := fsStore.blobPath(id, name)
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	file, err := os.Open(blobPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, BlobInfo{}, ErrNotFound
+		}
+		return nil, BlobInfo{}, fmt.Errorf("打开文件失败: %w", err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, BlobInfo{}, fmt.Errorf("读取文件信息失败: %w", err)
+	}
+	return file, BlobInfo{Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+// StatBlob 实现 BlobStore
+func (fsStore *fileStorage) StatBlob(id, name string) (BlobInfo, error) {
+	blobPath, err := fsStore.blobPath(id, name)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	stat, err := os.Stat(blobPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return BlobInfo{}, ErrNotFound
+		}
+		return BlobInfo{}, fmt.Errorf("读取文件信息失败: %w", err)
+	}
+	return BlobInfo{Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+// RemoveBlob 实现 BlobStore
+func (fsStore *fileStorage) RemoveBlob(id string) error {
+	if id == "" || id != filepath.Base(id) {
+		return fmt.Errorf("无效的文件路径: %s", id)
+	}
+	if err := os.RemoveAll(filepath.Join(fsStore.blobDir, id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ListBlobs 实现 BlobStore
+func (fsStore *fileStorage) ListBlobs(fn func(id string) error) error {
+	entries, err := os.ReadDir(fsStore.blobDir)
+	if err != nil {
+		return fmt.Errorf("读取上传目录失败: %w", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if err := fn(entry.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fsStore *fileStorage) chunkDirPath(uploadID string) (string, error) {
+	if uploadID == "" || uploadID != filepath.Base(uploadID) {
+		return "", fmt.Errorf("无效的上传ID: %s", uploadID)
+	}
+	return filepath.Join(fsStore.chunkDir, uploadID), nil
+}
+
+// partialSuffix 标记预分配、尚未写完的上传文件
+const partialSuffix = ".part"
+
+// partialPath 返回上传中文件的路径；与最终文件在同一目录，完成时可以原子地改名
+func (fsStore *fileStorage) partialPath(uploadID, fileName string) (string, error) {
+	blobPath, err := fsStore.blobPath(uploadID, fileName)
+	if err != nil {
+		return "", err
+	}
+	return blobPath + partialSuffix, nil
+}
+
+// PrepareUpload 实现 ChunkStore，以稀疏文件的方式把上传中的文件扩展到声明的大小。
+// Truncate 只设置文件大小，并不预留磁盘空间：磁盘在上传过程中写满时，写入分片会失败，
+// 上传以 storage_full 失败，而不是在这里被拒绝。
+func (fsStore *fileStorage) PrepareUpload(uploadID, fileName string, size int64) error {
+	partialPath, err := fsStore.partialPath(uploadID, fileName)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(partialPath), 0750); err != nil {
+		return fmt.Errorf("创建上传目录失败: %w", err)
+	}
+	file, err := os.OpenFile(partialPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return fmt.Errorf("创建文件失败: %w", err)
+	}
+	err = file.Truncate(size)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(partialPath)
+		return fmt.Errorf("预分配文件失败: %w", err)
+	}
+	return nil
+}
+
+// WriteChunk 实现 ChunkStore。每个分片使用独立的文件句柄写入不相交的区间，
+// 不同分片 (以及不同上传) 可以并发写入。
+func (fsStore *fileStorage) WriteChunk(uploadID, fileName string, chunkNumber int, offset int64, r io.Reader, size int64) (int64, error) {
+	partialPath, err := fsStore.partialPath(uploadID, fileName)
+	if err != nil {
+		return 0, err
+	}
+	file, err := os.OpenFile(partialPath, os.O_WRONLY, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, ErrNotFound
+		}
+		return 0, fmt.Errorf("打开上传文件失败: %w", err)
+	}
+	// 最多写入 size 字节，不会覆盖下一个分片
+	bytesWritten, err := io.Copy(io.NewOffsetWriter(file, offset), io.LimitReader(r, size))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("写入分片 %d 失败: %w", chunkNumber, err)
+	}
+	if bytesWritten != size {
+		return 0, fmt.Errorf("分片 %d 大小不符: 声明 %d 字节，实际 %d 字节", chunkNumber, size, bytesWritten)
+	}
+	return bytesWritten, nil
+}
+
+// FinishUpload 实现 ChunkStore，同步到磁盘后把 <name>.part 改名为 <name>
+func (fsStore *fileStorage) FinishUpload(uploadID, fileName string, totalChunks int) (int64, error) {
+	partialPath, err := fsStore.partialPath(uploadID, fileName)
+	if err != nil {
+		return 0, err
+	}
+	file, err := os.OpenFile(partialPath, os.O_WRONLY, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, ErrNotFound
+		}
+		return 0, fmt.Errorf("打开上传文件失败: %w", err)
+	}
+	err = file.Sync()
+	stat, statErr := file.Stat()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = statErr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("同步上传文件失败: %w", err)
+	}
+	if err := os.Rename(partialPath, strings.TrimSuffix(partialPath, partialSuffix)); err != nil {
+		return 0, fmt.Errorf("完成上传文件失败: %w", err)
+	}
+	return stat.Size(), nil
+}
+
+// RemoveChunks 实现 ChunkStore，删除上传中的文件以及旧版本留下的分片目录
+func (fsStore *fileStorage) RemoveChunks(uploadID string) error {
+	chunkDir, err := fsStore.chunkDirPath(uploadID)
+	if err != nil {
+		return err
+	}
+	partials, err := filepath.Glob(filepath.Join(fsStore.blobDir, uploadID, "*"+partialSuffix))
+	if err != nil {
+		return err
+	}
+	for _, partialPath := range partials {
+		if err := os.Remove(partialPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	// 只剩空目录时一并删除 (目录中已有完成的文件时 Remove 会失败，忽略即可)
+	os.Remove(filepath.Join(fsStore.blobDir, uploadID))
+
+	if err := os.RemoveAll(chunkDir); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ListUploads 实现 ChunkStore，包括含有 .part 文件的上传目录和旧版本留下的分片目录
+func (fsStore *fileStorage) ListUploads(fn func(uploadID string) error) error {
+	uploadIDs := make(map[string]bool)
+	partials, err := filepath.Glob(filepath.Join(fsStore.blobDir, "*", "*"+partialSuffix))
+	if err != nil {
+		return err
+	}
+	for _, partialPath := range partials {
+		uploadIDs[filepath.Base(filepath.Dir(partialPath))] = true
+	}
+	entries, err := os.ReadDir(fsStore.chunkDir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("读取分片目录失败: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			uploadIDs[entry.Name()] = true
+		}
+	}
+
+	for uploadID := range uploadIDs {
+		if err := fn(uploadID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrStorageFull 表示内存存储的字节预算已用完
+var ErrStorageFull = errors.New("storage budget exhausted")
+
+// memoryStorage 把所有数据只保存在进程内存中，从不写入磁盘。
+// 进程重启等同于销毁全部数据。所有元数据、上传中的文件和加密文件共享同一个字节预算。
+type memoryStorage struct {
+	mu       sync.Mutex
+	maxBytes int64
+	used     int64
+
+	metadata map[string][]byte              // id -> StoredData JSON
+	blobs    map[string]map[string]*memBlob // id -> name -> 文件
+	uploads  map[string]*memUpload          // uploadID -> 上传中的文件
+}
+
+// memUpload 是一个预分配、尚未写完的上传文件
+type memUpload struct {
+	name string
+	data []byte
+}
+
+// memBlob 是一个保存在内存中的加密文件
+type memBlob struct {
+	data    []byte
+	modTime time.Time
+}
+
+var _ Storage = (*memoryStorage)(nil)
+
+// newMemoryStorage 创建内存存储后端，maxBytes 为所有数据的总字节上限
+func newMemoryStorage(maxBytes int64) *memoryStorage {
+	return &memoryStorage{
+		maxBytes: maxBytes,
+		metadata: make(map[string][]byte),
+		blobs:    make(map[string]map[string]*memBlob),
+		uploads:  make(map[string]*memUpload),
+	}
+}
+
+// reserveLocked 调整已用字节数，超出预算时返回 ErrStorageFull (调用者须持有 mu)
+func (mem *memoryStorage) reserveLocked(delta int64) error {
+	if delta > 0 && mem.used+delta > mem.maxBytes {
+		return ErrStorageFull
+	}
+	mem.used += delta
+	return nil
+}
+
+// usedBytes 返回当前占用的字节数
+func (mem *memoryStorage) usedBytes() int64 {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	return mem.used
+}
+
+// putMetadataLocked 保存序列化后的记录并更新预算 (调用者须持有 mu)
+func (mem *memoryStorage) putMetadataLocked(id string, data *StoredData) error {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("序列化元数据失败: %w", err)
+	}
+	if err := mem.reserveLocked(int64(len(jsonData)) - int64(len(mem.metadata[id]))); err != nil {
+		return err
+	}
+	mem.metadata[id] = jsonData
+	return nil
+}
+
+// getMetadataLocked 反序列化出一份独立的副本，调用者修改它不会影响已存储的数据
+func (mem *memoryStorage) getMetadataLocked(id string) (*StoredData, error) {
+	jsonData, ok := mem.metadata[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	var data StoredData
+	if err := json.Unmarshal(jsonData, &data); err != nil {
+		return nil, fmt.Errorf("解析元数据失败: %w", err)
+	}
+	return &data, nil
+}
+
+// PutMetadata 实现 MetadataStore
+func (mem *memoryStorage) PutMetadata(id string, data *StoredData) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	return mem.putMetadataLocked(id, data)
+}
+
+// CreateMetadata 实现 MetadataStore
+func (mem *memoryStorage) CreateMetadata(id string, data *StoredData) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	if _, ok := mem.metadata[id]; ok {
+		return ErrAlreadyExists
+	}
+	return mem.putMetadataLocked(id, data)
+}
+
+// GetMetadata 实现 MetadataStore
+func (mem *memoryStorage) GetMetadata(id string) (*StoredData, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	return mem.getMetadataLocked(id)
+}
+
+// UpdateMetadata 实现 MetadataStore
+func (mem *memoryStorage) UpdateMetadata(id string, fn func(data *StoredData) error) (*StoredData, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	data, err := mem.getMetadataLocked(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := fn(data); err != nil {
+		return nil, err
+	}
+	if err := mem.putMetadataLocked(id, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// DeleteMetadata 实现 MetadataStore
+func (mem *memoryStorage) DeleteMetadata(id string) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	jsonData, ok := mem.metadata[id]
+	if !ok {
+		return ErrNotFound
+	}
+	mem.used -= int64(len(jsonData))
+	delete(mem.metadata, id)
+	return nil
+}
+
+// TakeMetadata 实现 MetadataStore
+func (mem *memoryStorage) TakeMetadata(id string) (*StoredData, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	data, err := mem.getMetadataLocked(id)
+	if err != nil {
+		return nil, err
+	}
+	mem.used -= int64(len(mem.metadata[id]))
+	delete(mem.metadata, id)
+	return data, nil
+}
+
+// IterateMetadata 实现 MetadataStore，遍历的是调用时刻的快照
+func (mem *memoryStorage) IterateMetadata(fn func(id string, data *StoredData) error) error {
+	mem.mu.Lock()
+	ids := make([]string, 0, len(mem.metadata))
+	for id := range mem.metadata {
+		ids = append(ids, id)
+	}
+	mem.mu.Unlock()
+
+	for _, id := range ids {
+		data, err := mem.GetMetadata(id)
+		if err != nil {
+			continue // Deleted while iterating
+		}
+		if err := fn(id, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateBlob 实现 BlobStore，写入时即占用预算，超出时写入失败
+func (mem *memoryStorage) CreateBlob(id, name string) (io.WriteCloser, error) {
+	if id == "" || name == "" {
+		return nil, fmt.Errorf("无效的文件路径: %s/%s", id, name)
+	}
+
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	files, ok := mem.blobs[id]
+	if !ok {
+		files = make(map[string]*memBlob)
+		mem.blobs[id] = files
+	}
+	if existing, ok := files[name]; ok {
+		mem.used -= int64(len(existing.data)) // Truncate like os.Create
+	}
+	blob := &memBlob{modTime: time.Now()}
+	files[name] = blob
+	return &memBlobWriter{store: mem, blob: blob}, nil
+}
+
+// memBlobWriter 把写入追加到内存中的文件
+type memBlobWriter struct {
+	store *memoryStorage
+	blob  *memBlob
+}
+
+func (w *memBlobWriter) Write(p []byte) (int, error) {
+	w.store.mu.Lock()
+	defer w.store.mu.Unlock()
+	if err := w.store.reserveLocked(int64(len(p))); err != nil {
+		return 0, err
+	}
+	w.blob.data = append(w.blob.data, p...)
+	w.blob.modTime = time.Now()
+	return len(p), nil
+}
+
+func (w *memBlobWriter) Close() error {
+	return nil
+}
+
+// nopSeekCloser 为 bytes.Reader 补上 Close
+type nopSeekCloser struct {
+	*bytes.Reader
+}
+
+func (nopSeekCloser) Close() error { return nil }
+
+// OpenBlob 实现 BlobStore
+func (mem *memoryStorage) OpenBlob(id, name string) (io.ReadSeekCloser, BlobInfo, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	blob, ok := mem.blobs[id][name]
+	if !ok {
+		return nil, BlobInfo{}, ErrNotFound
+	}
+	// 切片在写入完成后不会再被修改 (只会整体替换)，可以直接共享
+	return nopSeekCloser{bytes.NewReader(blob.data)}, BlobInfo{Size: int64(len(blob.data)), ModTime: blob.modTime}, nil
+}
+
+// StatBlob 实现 BlobStore
+func (mem *memoryStorage) StatBlob(id, name string) (BlobInfo, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	blob, ok := mem.blobs[id][name]
+	if !ok {
+		return BlobInfo{}, ErrNotFound
+	}
+	return BlobInfo{Size: int64(len(blob.data)), ModTime: blob.modTime}, nil
+}
+
+// RemoveBlob 实现 BlobStore
+func (mem *memoryStorage) RemoveBlob(id string) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	for _, blob := range mem.blobs[id] {
+		mem.used -= int64(len(blob.data))
+	}
+	delete(mem.blobs, id)
+	return nil
+}
+
+// ListBlobs 实现 BlobStore
+func (mem *memoryStorage) ListBlobs(fn func(id string) error) error {
+	mem.mu.Lock()
+	ids := make([]string, 0, len(mem.blobs))
+	for id := range mem.blobs {
+		ids = append(ids, id)
+	}
+	mem.mu.Unlock()
+
+	for _, id := range ids {
+		if err := fn(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PrepareUpload 实现 ChunkStore，初始化时即按声明的大小占用预算
+func (mem *memoryStorage) PrepareUpload(uploadID, fileName string, size int64) error {
+	if uploadID == "" || fileName == "" {
+		return fmt.Errorf("无效的文件路径: %s/%s", uploadID, fileName)
+	}
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	previous := int64(0)
+	if existing, ok := mem.uploads[uploadID]; ok {
+		previous = int64(len(existing.data))
+	}
+	if err := mem.reserveLocked(size - previous); err != nil {
+		return err
+	}
+	mem.uploads[uploadID] = &memUpload{name: fileName, data: make([]byte, size)}
+	return nil
+}
+
+// WriteChunk 实现 ChunkStore，分片直接读入预分配缓冲区中对应的区间
+func (mem *memoryStorage) WriteChunk(uploadID, fileName string, chunkNumber int, offset int64, r io.Reader, size int64) (int64, error) {
+	mem.mu.Lock()
+	upload, ok := mem.uploads[uploadID]
+	mem.mu.Unlock()
+	if !ok || upload.name != fileName {
+		return 0, ErrNotFound
+	}
+	if offset < 0 || size < 0 || offset+size > int64(len(upload.data)) {
+		return 0, fmt.Errorf("分片 %d 超出文件范围: 偏移 %d，大小 %d", chunkNumber, offset, size)
+	}
+
+	// 不同分片写入互不相交的区间，无需持有锁
+	n, err := io.ReadFull(r, upload.data[offset:offset+size])
+	if err != nil {
+		return 0, fmt.Errorf("分片 %d 大小不符: 声明 %d 字节，实际 %d 字节: %w", chunkNumber, size, n, err)
+	}
+	return int64(n), nil
+}
+
+// FinishUpload 实现 ChunkStore，上传的预算直接转给最终文件
+func (mem *memoryStorage) FinishUpload(uploadID, fileName string, totalChunks int) (int64, error) {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+
+	upload, ok := mem.uploads[uploadID]
+	if !ok || upload.name != fileName {
+		return 0, ErrNotFound
+	}
+	delete(mem.uploads, uploadID)
+
+	files, ok := mem.blobs[uploadID]
+	if !ok {
+		files = make(map[string]*memBlob)
+		mem.blobs[uploadID] = files
+	}
+	if existing, ok := files[fileName]; ok {
+		mem.used -= int64(len(existing.data))
+	}
+	files[fileName] = &memBlob{data: upload.data, modTime: time.Now()}
+	return int64(len(upload.data)), nil
+}
+
+// RemoveChunks 实现 ChunkStore
+func (mem *memoryStorage) RemoveChunks(uploadID string) error {
+	mem.mu.Lock()
+	defer mem.mu.Unlock()
+	if upload, ok := mem.uploads[uploadID]; ok {
+		mem.used -= int64(len(upload.data))
+	}
+	delete(mem.uploads, uploadID)
+	return nil
+}
+
+// ListUploads 实现 ChunkStore
+func (mem *memoryStorage) ListUploads(fn func(uploadID string) error) error {
+	mem.mu.Lock()
+	uploadIDs := make([]string, 0, len(mem.uploads))
+	for uploadID := range mem.uploads {
+		uploadIDs = append(uploadIDs, uploadID)
+	}
+	mem.mu.Unlock()
+
+	for _, uploadID := range uploadIDs {
+		if err := fn(uploadID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
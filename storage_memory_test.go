@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMemoryStorageBudget(t *testing.T) {
+	mem := newMemoryStorage(100)
+
+	// 上传在初始化时按声明的大小占用预算
+	if err := mem.PrepareUpload("upload-1", "file.bin", 60); err != nil {
+		t.Fatalf("PrepareUpload: %v", err)
+	}
+	if err := mem.PrepareUpload("upload-2", "file.bin", 60); !errors.Is(err, ErrStorageFull) {
+		t.Fatalf("PrepareUpload over the budget = %v, want ErrStorageFull", err)
+	}
+	if err := mem.RemoveChunks("upload-1"); err != nil {
+		t.Fatalf("RemoveChunks: %v", err)
+	}
+	if used := mem.usedBytes(); used != 0 {
+		t.Fatalf("usedBytes after RemoveChunks = %d, want 0", used)
+	}
+
+	// 文件在写入时占用预算，超出时写入失败
+	blob, err := mem.CreateBlob("id", "file.bin")
+	if err != nil {
+		t.Fatalf("CreateBlob: %v", err)
+	}
+	if _, err := blob.Write(make([]byte, 100)); err != nil {
+		t.Fatalf("Write within the budget: %v", err)
+	}
+	if _, err := blob.Write([]byte{0}); !errors.Is(err, ErrStorageFull) {
+		t.Fatalf("Write over the budget = %v, want ErrStorageFull", err)
+	}
+	blob.Close()
+	if err := mem.RemoveBlob("id"); err != nil {
+		t.Fatalf("RemoveBlob: %v", err)
+	}
+	if used := mem.usedBytes(); used != 0 {
+		t.Fatalf("usedBytes after RemoveBlob = %d, want 0", used)
+	}
+}
+
+func TestMemoryModeStaysOffDisk(t *testing.T) {
+	cfg := setupTestStorage(t, StorageModeMemory)
+	const id = "4e6a8c0d-3f5b-4c7d-8e9f-1a2b3c4d5e6f"
+	content := []byte("encrypted file contents")
+	storeTestFile(t, id, content, StoredData{})
+	if w := download(id); w.Code != http.StatusOK || w.Body.String() != string(content) {
+		t.Fatalf("download: %d %q", w.Code, w.Body.String())
+	}
+
+	// 预算用完时保存请求返回 507
+	store := GetStorageManager()
+	free := int64(cfg.Storage.Memory.MaxSizeMB)<<20 - store.backend.(*memoryStorage).usedBytes()
+	if err := store.PrepareUpload("fill", "file.bin", free); err != nil {
+		t.Fatalf("PrepareUpload: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/api/store", strings.NewReader(`{"encryptedData": "ciphertext", "iv": "iv", "salt": "salt"}`))
+	req.Header.Set("Content-Type", "application/json")
+	if w := serveTestRequest(http.MethodPost, "/api/store", StoreDataHandler(), req); w.Code != http.StatusInsufficientStorage {
+		t.Fatalf("store with a full budget returned %d: %s", w.Code, w.Body.String())
+	}
+
+	// 纯内存模式不会在磁盘上留下任何内容
+	for _, dir := range []string{cfg.Paths.DataStorageDir, cfg.Paths.FinalUploadDir, cfg.Paths.TempChunkDir} {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Fatalf("%s exists in memory mode: %v", dir, err)
+		}
+	}
+
+	// 重启后所有数据都已销毁
+	managerLock.Lock()
+	storageManager = nil
+	managerLock.Unlock()
+	if err := InitStorage(cfg); err != nil {
+		t.Fatalf("InitStorage: %v", err)
+	}
+	if _, err := GetStorageManager().GetMetadata(id); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetMetadata after restart = %v, want ErrNotFound", err)
+	}
+}
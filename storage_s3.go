@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// s3Storage 将加密文件保存到 S3 兼容的对象存储：
+//   - 加密文件: <prefix><id>/<name>
+//   - 上传分片: 对应 <prefix><uploadID>/<fileName> 的分段上传 (multipart upload)，
+//     每个分片就是一个 part，合并时直接 CompleteMultipartUpload，无需本地合并
+//
+// 分段上传的 ID 缓存在内存中，缓存中没有时 (例如重启后) 通过 ListMultipartUploads 从存储端查回。
+// 只有加密文件在对象存储中，上传会话、分片日志和元数据仍保存在本地，因此 S3 模式同样只能单实例运行。
+type s3Storage struct {
+	core   *minio.Core
+	bucket string
+	prefix string
+
+	uploadsLock sync.Mutex
+	uploads     map[string]s3MultipartUpload // uploadID -> 进行中的分段上传
+}
+
+// s3MultipartUpload 记录一个进行中的分段上传
+type s3MultipartUpload struct {
+	key      string
+	uploadID string
+}
+
+var _ objectStorage = (*s3Storage)(nil)
+
+// s3MaxParts 是一次分段上传最多的 part 数，每个分片是一个 part，因此也是 upload.max_chunks 的上限
+const s3MaxParts = 10000
+
+// newS3Storage 根据配置创建 S3 存储后端
+func newS3Storage(cfg S3Config) (*s3Storage, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("无效的 S3 endpoint: %s", cfg.Endpoint)
+	}
+
+	var creds *credentials.Credentials
+	if cfg.AccessKeyID != "" {
+		creds = credentials.NewStaticV4(cfg.AccessKeyID, cfg.SecretAccessKey, cfg.SessionToken)
+	} else {
+		// 未配置密钥时依次尝试环境变量和实例角色
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+			&credentials.IAM{Client: &http.Client{Transport: http.DefaultTransport}},
+		})
+	}
+
+	bucketLookup := minio.BucketLookupAuto
+	if cfg.ForcePathStyle {
+		bucketLookup = minio.BucketLookupPath
+	}
+
+	core, err := minio.NewCore(endpoint.Host, &minio.Options{
+		Creds:        creds,
+		Secure:       endpoint.Scheme == "https",
+		Region:       cfg.Region,
+		BucketLookup: bucketLookup,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := strings.TrimPrefix(cfg.Prefix, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	return &s3Storage{
+		core:    core,
+		bucket:  cfg.Bucket,
+		prefix:  prefix,
+		uploads: make(map[string]s3MultipartUpload),
+	}, nil
+}
+
+// objectKey 返回 id/name 的对象键，拒绝任何可能逃出前缀的名称
+func (s3Store *s3Storage) objectKey(id, name string) (string, error) {
+	if id == "" || strings.ContainsAny(id, "/\\") || id == ".." || name == "" || strings.ContainsAny(name, "/\\") || name == ".." {
+		return "", fmt.Errorf("无效的文件路径: %s/%s", id, name)
+	}
+	return s3Store.prefix + id + "/" + name, nil
+}
+
+// isS3NotFound 判断错误是否表示对象或分段上传不存在
+func isS3NotFound(err error) bool {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NoSuchUpload", "NotFound":
+		return true
+	}
+	return false
+}
+
+// CreateBlob 实现 BlobStore，写入内容先暂存到本地临时文件，Close 时一次性上传
+func (s3Store *s3Storage) CreateBlob(id, name string) (io.WriteCloser, error) {
+	key, err := s3Store.objectKey(id, name)
+	if err != nil {
+		return nil, err
+	}
+	spool, err := os.CreateTemp("", "biu-s3-*")
+	if err != nil {
+		return nil, fmt.Errorf("创建临时文件失败: %w", err)
+	}
+	return &s3BlobWriter{store: s3Store, key: key, spool: spool}, nil
+}
+
+// s3BlobWriter 暂存写入的内容，Close 时以已知长度上传 (兼容不支持流式签名的 S3 实现)
+type s3BlobWriter struct {
+	store *s3Storage
+	key   string
+	spool *os.File
+}
+
+func (w *s3BlobWriter) Write(p []byte) (int, error) {
+	return w.spool.Write(p)
+}
+
+func (w *s3BlobWriter) Close() error {
+	defer os.Remove(w.spool.Name())
+	defer w.spool.Close()
+
+	size, err := w.spool.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := w.spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = w.store.core.Client.PutObject(context.Background(), w.store.bucket, w.key, w.spool, size, minio.PutObjectOptions{
+		ContentType:          "application/octet-stream",
+		DisableContentSha256: true,
+	})
+	if err != nil {
+		return fmt.Errorf("上传对象失败: %w", err)
+	}
+	return nil
+}
+
+// OpenBlob 实现 BlobStore
+func (s3Store *s3Storage) OpenBlob(id, name string) (io.ReadSeekCloser, BlobInfo, error) {
+	key, err := s3Store.objectKey(id, name)
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	object, err := s3Store.core.Client.GetObject(context.Background(), s3Store.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, BlobInfo{}, fmt.Errorf("打开对象失败: %w", err)
+	}
+	// GetObject 是惰性的，Stat 才会真正访问存储端
+	info, err := object.Stat()
+	if err != nil {
+		object.Close()
+		if isS3NotFound(err) {
+			return nil, BlobInfo{}, ErrNotFound
+		}
+		return nil, BlobInfo{}, fmt.Errorf("读取对象信息失败: %w", err)
+	}
+	return object, BlobInfo{Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+// StatBlob 实现 BlobStore
+func (s3Store *s3Storage) StatBlob(id, name string) (BlobInfo, error) {
+	key, err := s3Store.objectKey(id, name)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	info, err := s3Store.core.Client.StatObject(context.Background(), s3Store.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		if isS3NotFound(err) {
+			return BlobInfo{}, ErrNotFound
+		}
+		return BlobInfo{}, fmt.Errorf("读取对象信息失败: %w", err)
+	}
+	return BlobInfo{Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+// RemoveBlob 实现 BlobStore
+func (s3Store *s3Storage) RemoveBlob(id string) error {
+	if id == "" || strings.ContainsAny(id, "/\\") || id == ".." {
+		return fmt.Errorf("无效的文件路径: %s", id)
+	}
+
+	ctx := context.Background()
+	objects := s3Store.core.Client.ListObjects(ctx, s3Store.bucket, minio.ListObjectsOptions{
+		Prefix:    s3Store.prefix + id + "/",
+		Recursive: true,
+	})
+	for object := range objects {
+		if object.Err != nil {
+			return fmt.Errorf("列出对象失败: %w", object.Err)
+		}
+		err := s3Store.core.Client.RemoveObject(ctx, s3Store.bucket, object.Key, minio.RemoveObjectOptions{})
+		if err != nil && !isS3NotFound(err) {
+			return fmt.Errorf("删除对象 %s 失败: %w", object.Key, err)
+		}
+	}
+	return nil
+}
+
+// ListBlobs 实现 BlobStore
+func (s3Store *s3Storage) ListBlobs(fn func(id string) error) error {
+	objects := s3Store.core.Client.ListObjects(context.Background(), s3Store.bucket, minio.ListObjectsOptions{
+		Prefix:    s3Store.prefix,
+		Recursive: false,
+	})
+	for object := range objects {
+		if object.Err != nil {
+			return fmt.Errorf("列出对象失败: %w", object.Err)
+		}
+		if !strings.HasSuffix(object.Key, "/") {
+			continue // Only "directories" (common prefixes) correspond to IDs
+		}
+		id := path.Base(strings.TrimSuffix(object.Key, "/"))
+		if err := fn(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findMultipartUpload 查找 uploadID 对应的进行中分段上传，create 为 true 时不存在则新建。
+// 查找和新建都不持有 uploadsLock，不同上传不会互相等待存储端的响应；uploadsLock 只保护缓存。
+func (s3Store *s3Storage) findMultipartUpload(ctx context.Context, uploadID, fileName string, create bool) (s3MultipartUpload, error) {
+	s3Store.uploadsLock.Lock()
+	upload, ok := s3Store.uploads[uploadID]
+	s3Store.uploadsLock.Unlock()
+	if ok {
+		return upload, nil
+	}
+
+	// 可能在重启前创建，先从存储端查找
+	prefix := s3Store.prefix + uploadID + "/"
+	keyMarker, uploadIDMarker := "", ""
+	for {
+		result, err := s3Store.core.ListMultipartUploads(ctx, s3Store.bucket, prefix, keyMarker, uploadIDMarker, "", 1000)
+		if isS3NotFound(err) {
+			break // Some S3 stand-ins answer NoSuchUpload instead of an empty list
+		} else if err != nil {
+			return s3MultipartUpload{}, fmt.Errorf("列出分段上传失败: %w", err)
+		}
+		for _, existing := range result.Uploads {
+			if fileName == "" || existing.Key == prefix+fileName {
+				upload, _ := s3Store.rememberUpload(uploadID, s3MultipartUpload{key: existing.Key, uploadID: existing.UploadID})
+				return upload, nil
+			}
+		}
+		if !result.IsTruncated {
+			break
+		}
+		keyMarker, uploadIDMarker = result.NextKeyMarker, result.NextUploadIDMarker
+	}
+
+	if !create {
+		return s3MultipartUpload{}, ErrNotFound
+	}
+
+	key, err := s3Store.objectKey(uploadID, fileName)
+	if err != nil {
+		return s3MultipartUpload{}, err
+	}
+	multipartID, err := s3Store.core.NewMultipartUpload(ctx, s3Store.bucket, key, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+	})
+	if err != nil {
+		return s3MultipartUpload{}, fmt.Errorf("创建分段上传失败: %w", err)
+	}
+	upload, created := s3Store.rememberUpload(uploadID, s3MultipartUpload{key: key, uploadID: multipartID})
+	if !created {
+		// 同一上传的另一个分片同时新建了分段上传并先登记，使用它并放弃这个
+		if err := s3Store.core.AbortMultipartUpload(ctx, s3Store.bucket, key, multipartID); err != nil && !isS3NotFound(err) {
+			storageLog.Warn("Failed to abort duplicate S3 multipart upload", "uploadId", uploadID, "key", key, "error", err)
+		}
+		return upload, nil
+	}
+	storageLog.Debug("Created S3 multipart upload", "uploadId", uploadID, "key", key)
+	return upload, nil
+}
+
+// rememberUpload 缓存 uploadID 对应的分段上传。已有缓存时返回已缓存的分段上传，created 为 false。
+func (s3Store *s3Storage) rememberUpload(uploadID string, upload s3MultipartUpload) (cached s3MultipartUpload, created bool) {
+	s3Store.uploadsLock.Lock()
+	defer s3Store.uploadsLock.Unlock()
+	if existing, ok := s3Store.uploads[uploadID]; ok {
+		return existing, false
+	}
+	s3Store.uploads[uploadID] = upload
+	return upload, true
+}
+
+// listParts 返回分段上传中已上传的所有 part
+func (s3Store *s3Storage) listParts(ctx context.Context, upload s3MultipartUpload) ([]minio.ObjectPart, error) {
+	var parts []minio.ObjectPart
+	marker := 0
+	for {
+		result, err := s3Store.core.ListObjectParts(ctx, s3Store.bucket, upload.key, upload.uploadID, marker, 1000)
+		if err != nil {
+			return nil, fmt.Errorf("列出分段失败: %w", err)
+		}
+		parts = append(parts, result.ObjectParts...)
+		if !result.IsTruncated {
+			return parts, nil
+		}
+		marker = result.NextPartNumberMarker
+	}
+}
+
+// PrepareUpload 实现 ChunkStore，初始化时创建分段上传；对象存储不需要预分配
+func (s3Store *s3Storage) PrepareUpload(uploadID, fileName string, size int64) error {
+	_, err := s3Store.findMultipartUpload(context.Background(), uploadID, fileName, true)
+	return err
+}
+
+// WriteChunk 实现 ChunkStore，每个分片作为编号为 chunkNumber 的 part 上传，
+// part 编号已经决定了它在最终对象中的位置，因此不需要 offset
+func (s3Store *s3Storage) WriteChunk(uploadID, fileName string, chunkNumber int, offset int64, r io.Reader, size int64) (int64, error) {
+	ctx := context.Background()
+	upload, err := s3Store.findMultipartUpload(ctx, uploadID, fileName, true)
+	if err != nil {
+		return 0, err
+	}
+	part, err := s3Store.core.PutObjectPart(ctx, s3Store.bucket, upload.key, upload.uploadID, chunkNumber, r, size, minio.PutObjectPartOptions{
+		DisableContentSha256: true, // Unsigned payload works with every S3-compatible service
+	})
+	if err != nil {
+		return 0, fmt.Errorf("上传分段 %d 失败: %w", chunkNumber, err)
+	}
+	return part.Size, nil
+}
+
+// FinishUpload 实现 ChunkStore，通过 CompleteMultipartUpload 在存储端拼接各个 part
+func (s3Store *s3Storage) FinishUpload(uploadID, fileName string, totalChunks int) (int64, error) {
+	ctx := context.Background()
+	upload, err := s3Store.findMultipartUpload(ctx, uploadID, fileName, false)
+	if err != nil {
+		return 0, err
+	}
+	parts, err := s3Store.listParts(ctx, upload)
+	if err != nil {
+		return 0, err
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+
+	completeParts := make([]minio.CompletePart, 0, len(parts))
+	var totalBytes int64
+	for i, part := range parts {
+		if part.PartNumber != i+1 {
+			return 0, fmt.Errorf("分片 %d 不存在: %w", i+1, ErrChunkMissing)
+		}
+		completeParts = append(completeParts, minio.CompletePart{PartNumber: part.PartNumber, ETag: part.ETag})
+		totalBytes += part.Size
+	}
+	if len(completeParts) != totalChunks {
+		return 0, fmt.Errorf("分片 %d 不存在: %w", len(completeParts)+1, ErrChunkMissing)
+	}
+
+	if _, err := s3Store.core.CompleteMultipartUpload(ctx, s3Store.bucket, upload.key, upload.uploadID, completeParts, minio.PutObjectOptions{}); err != nil {
+		return 0, fmt.Errorf("完成分段上传失败: %w", err)
+	}
+
+	s3Store.uploadsLock.Lock()
+	delete(s3Store.uploads, uploadID)
+	s3Store.uploadsLock.Unlock()
+	return totalBytes, nil
+}
+
+// RemoveChunks 实现 ChunkStore，放弃进行中的分段上传
+func (s3Store *s3Storage) RemoveChunks(uploadID string) error {
+	ctx := context.Background()
+	upload, err := s3Store.findMultipartUpload(ctx, uploadID, "", false)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	s3Store.uploadsLock.Lock()
+	delete(s3Store.uploads, uploadID)
+	s3Store.uploadsLock.Unlock()
+
+	if err := s3Store.core.AbortMultipartUpload(ctx, s3Store.bucket, upload.key, upload.uploadID); err != nil && !isS3NotFound(err) {
+		return fmt.Errorf("放弃分段上传失败: %w", err)
+	}
+	return nil
+}
+
+// ListUploads 实现 ChunkStore，列出前缀下所有进行中的分段上传
+func (s3Store *s3Storage) ListUploads(fn func(uploadID string) error) error {
+	ctx := context.Background()
+	seen := make(map[string]bool)
+	keyMarker, uploadIDMarker := "", ""
+	for {
+		result, err := s3Store.core.ListMultipartUploads(ctx, s3Store.bucket, s3Store.prefix, keyMarker, uploadIDMarker, "", 1000)
+		if isS3NotFound(err) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("列出分段上传失败: %w", err)
+		}
+		for _, upload := range result.Uploads {
+			// 对象键为 <prefix><uploadID>/<fileName>
+			uploadID, _, ok := strings.Cut(strings.TrimPrefix(upload.Key, s3Store.prefix), "/")
+			if !ok || seen[uploadID] {
+				continue
+			}
+			seen[uploadID] = true
+			if err := fn(uploadID); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated {
+			return nil
+		}
+		keyMarker, uploadIDMarker = result.NextKeyMarker, result.NextUploadIDMarker
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 是测试用的 S3 替身，只实现分段上传用到的接口 (路径风格: /<bucket>/<key>)
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	nextID  int
+	uploads map[string]*fakeMultipartUpload // 分段上传 ID -> 上传
+	objects map[string][]byte               // 对象键 -> 内容
+	created int                             // 新建过的分段上传数
+}
+
+type fakeMultipartUpload struct {
+	key   string
+	parts map[int][]byte
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	t.Helper()
+	fake := &fakeS3{
+		bucket:  "biu",
+		uploads: make(map[string]*fakeMultipartUpload),
+		objects: make(map[string][]byte),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+func newTestS3Storage(t *testing.T, server *httptest.Server) *s3Storage {
+	t.Helper()
+	store, err := newS3Storage(S3Config{
+		Endpoint:        server.URL,
+		Bucket:          "biu",
+		Prefix:          "blobs",
+		Region:          "us-east-1",
+		AccessKeyID:     "test",
+		SecretAccessKey: "test",
+		ForcePathStyle:  true,
+	})
+	if err != nil {
+		t.Fatalf("newS3Storage: %v", err)
+	}
+	return store
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (f *fakeS3) writeXML(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(v)
+}
+
+func (f *fakeS3) writeError(w http.ResponseWriter, status int, code string) {
+	type errorResponse struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}
+	f.writeXML(w, status, errorResponse{Code: code, Message: code})
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		f.writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	query := r.URL.Query()
+	_, uploadsQuery := query["uploads"]
+	uploadID := query.Get("uploadId")
+
+	switch {
+	case key == "" && r.Method == http.MethodGet && uploadsQuery:
+		f.listMultipartUploads(w, query.Get("prefix"))
+	case r.Method == http.MethodPost && uploadsQuery:
+		f.nextID++
+		f.created++
+		id := fmt.Sprintf("upload-%d", f.nextID)
+		f.uploads[id] = &fakeMultipartUpload{key: key, parts: make(map[int][]byte)}
+		f.writeXML(w, http.StatusOK, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadID string `xml:"UploadId"`
+		}{Bucket: bucket, Key: key, UploadID: id})
+	case uploadID != "":
+		upload, ok := f.uploads[uploadID]
+		if !ok || upload.key != key {
+			f.writeError(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		f.serveUpload(w, r, uploadID, upload)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			f.writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", etag(data))
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	default:
+		f.writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) serveUpload(w http.ResponseWriter, r *http.Request, uploadID string, upload *fakeMultipartUpload) {
+	switch r.Method {
+	case http.MethodPut:
+		number, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+		if err != nil {
+			f.writeError(w, http.StatusBadRequest, "InvalidArgument")
+			return
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			f.writeError(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		upload.parts[number] = data
+		w.Header().Set("ETag", etag(data))
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet:
+		type part struct {
+			PartNumber int
+			ETag       string
+			Size       int64
+		}
+		result := struct {
+			XMLName  xml.Name `xml:"ListPartsResult"`
+			Bucket   string
+			Key      string
+			UploadID string `xml:"UploadId"`
+			Parts    []part `xml:"Part"`
+		}{Bucket: f.bucket, Key: upload.key, UploadID: uploadID}
+		for number, data := range upload.parts {
+			result.Parts = append(result.Parts, part{PartNumber: number, ETag: etag(data), Size: int64(len(data))})
+		}
+		sort.Slice(result.Parts, func(i, j int) bool { return result.Parts[i].PartNumber < result.Parts[j].PartNumber })
+		f.writeXML(w, http.StatusOK, result)
+	case http.MethodPost:
+		var complete struct {
+			Parts []struct {
+				PartNumber int
+				ETag       string
+			} `xml:"Part"`
+		}
+		if err := xml.NewDecoder(r.Body).Decode(&complete); err != nil {
+			f.writeError(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		var object []byte
+		for i, part := range complete.Parts {
+			data, ok := upload.parts[part.PartNumber]
+			if !ok || part.PartNumber != i+1 || strings.Trim(part.ETag, `"`) != strings.Trim(etag(data), `"`) {
+				f.writeError(w, http.StatusBadRequest, "InvalidPart")
+				return
+			}
+			object = append(object, data...)
+		}
+		f.objects[upload.key] = object
+		delete(f.uploads, uploadID)
+		f.writeXML(w, http.StatusOK, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: f.bucket, Key: upload.key, ETag: etag(object)})
+	case http.MethodDelete:
+		delete(f.uploads, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (f *fakeS3) listMultipartUploads(w http.ResponseWriter, prefix string) {
+	type upload struct {
+		Key      string
+		UploadID string `xml:"UploadId"`
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListMultipartUploadsResult"`
+		Bucket      string
+		Prefix      string
+		IsTruncated bool
+		Uploads     []upload `xml:"Upload"`
+	}{Bucket: f.bucket, Prefix: prefix}
+	for id, u := range f.uploads {
+		if strings.HasPrefix(u.key, prefix) {
+			result.Uploads = append(result.Uploads, upload{Key: u.key, UploadID: id})
+		}
+	}
+	sort.Slice(result.Uploads, func(i, j int) bool { return result.Uploads[i].UploadID < result.Uploads[j].UploadID })
+	f.writeXML(w, http.StatusOK, result)
+}
+
+func (f *fakeS3) pendingUploads() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.uploads)
+}
+
+const testS3UploadID = "0123456789abcdef0123456789abcdef"
+
+func TestS3StorageMultipartUpload(t *testing.T) {
+	fake, server := newFakeS3(t)
+	store := newTestS3Storage(t, server)
+
+	if err := store.PrepareUpload(testS3UploadID, "a.bin", 11); err != nil {
+		t.Fatalf("PrepareUpload: %v", err)
+	}
+	if fake.pendingUploads() != 1 {
+		t.Fatalf("PrepareUpload created %d multipart uploads, want 1", fake.pendingUploads())
+	}
+
+	// 分片可以乱序到达
+	chunks := map[int]string{2: "world", 1: "hello ", 3: "!"}
+	for _, number := range []int{2, 3, 1} {
+		n, err := store.WriteChunk(testS3UploadID, "a.bin", number, 0, strings.NewReader(chunks[number]), int64(len(chunks[number])))
+		if err != nil {
+			t.Fatalf("WriteChunk %d: %v", number, err)
+		}
+		if n != int64(len(chunks[number])) {
+			t.Fatalf("WriteChunk %d wrote %d bytes, want %d", number, n, len(chunks[number]))
+		}
+	}
+
+	size, err := store.FinishUpload(testS3UploadID, "a.bin", 3)
+	if err != nil {
+		t.Fatalf("FinishUpload: %v", err)
+	}
+	if size != 12 {
+		t.Fatalf("FinishUpload size = %d, want 12", size)
+	}
+	if got := string(fake.objects["blobs/"+testS3UploadID+"/a.bin"]); got != "hello world!" {
+		t.Fatalf("object = %q, want %q", got, "hello world!")
+	}
+	if fake.pendingUploads() != 0 {
+		t.Fatalf("%d multipart uploads still pending after complete", fake.pendingUploads())
+	}
+
+	blob, info, err := store.OpenBlob(testS3UploadID, "a.bin")
+	if err != nil {
+		t.Fatalf("OpenBlob: %v", err)
+	}
+	defer blob.Close()
+	data, err := io.ReadAll(blob)
+	if err != nil || !bytes.Equal(data, []byte("hello world!")) || info.Size != 12 {
+		t.Fatalf("OpenBlob = %q (size %d, err %v)", data, info.Size, err)
+	}
+}
+
+func TestS3StorageFinishUploadMissingChunk(t *testing.T) {
+	fake, server := newFakeS3(t)
+	store := newTestS3Storage(t, server)
+
+	if err := store.PrepareUpload(testS3UploadID, "a.bin", 0); err != nil {
+		t.Fatalf("PrepareUpload: %v", err)
+	}
+	for _, number := range []int{1, 3} {
+		if _, err := store.WriteChunk(testS3UploadID, "a.bin", number, 0, strings.NewReader("x"), 1); err != nil {
+			t.Fatalf("WriteChunk %d: %v", number, err)
+		}
+	}
+	if _, err := store.FinishUpload(testS3UploadID, "a.bin", 3); !errors.Is(err, ErrChunkMissing) {
+		t.Fatalf("FinishUpload error = %v, want ErrChunkMissing", err)
+	}
+	if fake.pendingUploads() != 1 {
+		t.Fatalf("incomplete upload was not kept for retry")
+	}
+}
+
+func TestS3StorageRemoveChunksAbortsUpload(t *testing.T) {
+	fake, server := newFakeS3(t)
+	store := newTestS3Storage(t, server)
+
+	if err := store.PrepareUpload(testS3UploadID, "a.bin", 0); err != nil {
+		t.Fatalf("PrepareUpload: %v", err)
+	}
+	if _, err := store.WriteChunk(testS3UploadID, "a.bin", 1, 0, strings.NewReader("x"), 1); err != nil {
+		t.Fatalf("WriteChunk: %v", err)
+	}
+	if err := store.RemoveChunks(testS3UploadID); err != nil {
+		t.Fatalf("RemoveChunks: %v", err)
+	}
+	if fake.pendingUploads() != 0 {
+		t.Fatalf("RemoveChunks did not abort the multipart upload")
+	}
+	// 已经放弃的上传再次删除不报错
+	if err := store.RemoveChunks(testS3UploadID); err != nil {
+		t.Fatalf("second RemoveChunks: %v", err)
+	}
+	if _, err := store.FinishUpload(testS3UploadID, "a.bin", 1); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("FinishUpload after abort error = %v, want ErrNotFound", err)
+	}
+}
+
+// 重启后 (没有缓存) 接收分片时从存储端查回已有的分段上传；同时到达的分片只保留一个分段上传
+func TestS3StorageFindsMultipartUploadAfterRestart(t *testing.T) {
+	fake, server := newFakeS3(t)
+	first := newTestS3Storage(t, server)
+	if err := first.PrepareUpload(testS3UploadID, "a.bin", 0); err != nil {
+		t.Fatalf("PrepareUpload: %v", err)
+	}
+	second := newTestS3Storage(t, server)
+	if _, err := second.WriteChunk(testS3UploadID, "a.bin", 1, 0, strings.NewReader("a"), 1); err != nil {
+		t.Fatalf("WriteChunk after restart: %v", err)
+	}
+	if fake.created != 1 {
+		t.Fatalf("a new multipart upload was created after restart")
+	}
+	if err := first.RemoveChunks(testS3UploadID); err != nil {
+		t.Fatalf("RemoveChunks: %v", err)
+	}
+
+	const otherUploadID = "fedcba9876543210fedcba9876543210"
+	fresh := newTestS3Storage(t, server)
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for number := 1; number <= 8; number++ {
+		wg.Add(1)
+		go func(number int) {
+			defer wg.Done()
+			_, err := fresh.WriteChunk(otherUploadID, "b.bin", number, 0, strings.NewReader("b"), 1)
+			errs <- err
+		}(number)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("concurrent WriteChunk: %v", err)
+		}
+	}
+	if fake.pendingUploads() != 1 {
+		t.Fatalf("%d multipart uploads pending for one upload, want 1", fake.pendingUploads())
+	}
+	if size, err := fresh.FinishUpload(otherUploadID, "b.bin", 8); err != nil || size != 8 {
+		t.Fatalf("FinishUpload = %d, %v; want 8 bytes", size, err)
+	}
+}
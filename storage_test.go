@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testMetadataStores 返回文件和内存两种元数据存储，供各个测试共用
+func testMetadataStores(t *testing.T) map[string]Storage {
+	t.Helper()
+	dir := t.TempDir()
+	return map[string]Storage{
+		"filesystem": newFileStorage(dir+"/meta", dir+"/blobs", dir+"/chunks"),
+		"memory":     newMemoryStorage(1 << 20),
+	}
+}
+
+func TestCreateMetadataOnlyOnce(t *testing.T) {
+	for name, store := range testMetadataStores(t) {
+		t.Run(name, func(t *testing.T) {
+			const id = "6f1c2f4e-8a3b-4c5d-9e0f-112233445566"
+			const writers = 16
+
+			var wg sync.WaitGroup
+			results := make(chan error, writers)
+			for i := 0; i < writers; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					results <- store.CreateMetadata(id, &StoredData{IV: "iv", ManageTokenHash: string(rune('a' + i))})
+				}(i)
+			}
+			wg.Wait()
+			close(results)
+
+			created := 0
+			for err := range results {
+				switch {
+				case err == nil:
+					created++
+				case !errors.Is(err, ErrAlreadyExists):
+					t.Fatalf("CreateMetadata: %v", err)
+				}
+			}
+			if created != 1 {
+				t.Fatalf("%d concurrent CreateMetadata calls succeeded, want 1", created)
+			}
+
+			stored, err := store.GetMetadata(id)
+			if err != nil {
+				t.Fatalf("GetMetadata: %v", err)
+			}
+			if err := store.CreateMetadata(id, &StoredData{ManageTokenHash: "overwrite"}); !errors.Is(err, ErrAlreadyExists) {
+				t.Fatalf("CreateMetadata on existing id = %v, want ErrAlreadyExists", err)
+			}
+			if again, _ := store.GetMetadata(id); again.ManageTokenHash != stored.ManageTokenHash {
+				t.Fatalf("existing metadata was overwritten")
+			}
+		})
+	}
+}
+
+func TestFileStorageUploadWritesChunksAtOffsets(t *testing.T) {
+	dir := t.TempDir()
+	store := newFileStorage(filepath.Join(dir, "meta"), filepath.Join(dir, "blobs"), filepath.Join(dir, "chunks"))
+	const uploadID = "0123456789abcdef0123456789abcdef"
+	if err := store.PrepareUpload(uploadID, "file.bin", 10); err != nil {
+		t.Fatalf("PrepareUpload: %v", err)
+	}
+	// 分片可以乱序写入，各自写到自己的偏移处
+	for _, chunk := range []struct {
+		number int
+		offset int64
+		data   string
+	}{{2, 5, "fghij"}, {1, 0, "abcde"}} {
+		if n, err := store.WriteChunk(uploadID, "file.bin", chunk.number, chunk.offset, strings.NewReader(chunk.data), 5); err != nil || n != 5 {
+			t.Fatalf("WriteChunk(%d) = %d, %v", chunk.number, n, err)
+		}
+	}
+	if size, err := store.FinishUpload(uploadID, "file.bin", 2); err != nil || size != 10 {
+		t.Fatalf("FinishUpload = %d, %v", size, err)
+	}
+
+	blob, _, err := store.OpenBlob(uploadID, "file.bin")
+	if err != nil {
+		t.Fatalf("OpenBlob: %v", err)
+	}
+	content, _ := io.ReadAll(blob)
+	blob.Close()
+	if string(content) != "abcdefghij" {
+		t.Fatalf("blob content = %q", content)
+	}
+
+	// 与其他数据一样，目录为 0750，文件为 0640
+	blobPath, err := store.blobPath(uploadID, "file.bin")
+	if err != nil {
+		t.Fatalf("blobPath: %v", err)
+	}
+	for path, want := range map[string]os.FileMode{blobPath: 0640, filepath.Dir(blobPath): 0750} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+		if got := info.Mode().Perm(); got != want {
+			t.Errorf("%s has mode %o, want %o", path, got, want)
+		}
+	}
+}
+
+func TestMetadataStoreOperations(t *testing.T) {
+	for name, store := range testMetadataStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ids := []string{"7a1b2c3d-0000-4000-8000-000000000001", "7a1b2c3d-0000-4000-8000-000000000002"}
+			for _, id := range ids {
+				if err := store.PutMetadata(id, &StoredData{IV: "iv", MaxViews: 2}); err != nil {
+					t.Fatalf("PutMetadata: %v", err)
+				}
+			}
+
+			updated, err := store.UpdateMetadata(ids[0], func(data *StoredData) error {
+				data.Views++
+				return nil
+			})
+			if err != nil || updated.Views != 1 {
+				t.Fatalf("UpdateMetadata = %+v, %v", updated, err)
+			}
+			if stored, err := store.GetMetadata(ids[0]); err != nil || stored.Views != 1 || stored.IV != "iv" {
+				t.Fatalf("GetMetadata after update = %+v, %v", stored, err)
+			}
+			// fn 返回错误时不做任何修改
+			if _, err := store.UpdateMetadata(ids[0], func(data *StoredData) error {
+				data.Views = 99
+				return errViewsExhausted
+			}); !errors.Is(err, errViewsExhausted) {
+				t.Fatalf("UpdateMetadata error = %v", err)
+			}
+			if stored, _ := store.GetMetadata(ids[0]); stored.Views != 1 {
+				t.Fatalf("failed update was written: views = %d", stored.Views)
+			}
+
+			seen := map[string]bool{}
+			if err := store.IterateMetadata(func(id string, data *StoredData) error {
+				seen[id] = true
+				return nil
+			}); err != nil {
+				t.Fatalf("IterateMetadata: %v", err)
+			}
+			if len(seen) != 2 || !seen[ids[0]] || !seen[ids[1]] {
+				t.Fatalf("IterateMetadata visited %v", seen)
+			}
+
+			if taken, err := store.TakeMetadata(ids[1]); err != nil || taken.IV != "iv" {
+				t.Fatalf("TakeMetadata = %+v, %v", taken, err)
+			}
+			if err := store.DeleteMetadata(ids[0]); err != nil {
+				t.Fatalf("DeleteMetadata: %v", err)
+			}
+			for _, id := range ids {
+				if _, err := store.GetMetadata(id); !errors.Is(err, ErrNotFound) {
+					t.Fatalf("GetMetadata after delete = %v, want ErrNotFound", err)
+				}
+				if _, err := store.UpdateMetadata(id, func(*StoredData) error { return nil }); !errors.Is(err, ErrNotFound) {
+					t.Fatalf("UpdateMetadata after delete = %v, want ErrNotFound", err)
+				}
+			}
+			if err := store.DeleteMetadata(ids[0]); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("second DeleteMetadata = %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestStorageBackendFromConfig(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &Config{}
+	cfg.Paths.DataStorageDir = filepath.Join(dir, "meta")
+	cfg.Paths.FinalUploadDir = filepath.Join(dir, "uploads")
+	cfg.Paths.TempChunkDir = filepath.Join(dir, "chunks")
+
+	for backend, want := range map[string]string{"": "*main.fileStorage", StorageBackendFilesystem: "*main.fileStorage"} {
+		cfg.Storage.Backend = backend
+		store, err := newStorageBackend(cfg)
+		if err != nil {
+			t.Fatalf("newStorageBackend(%q): %v", backend, err)
+		}
+		if got := fmt.Sprintf("%T", store); got != want {
+			t.Fatalf("backend %q is %s, want %s", backend, got, want)
+		}
+	}
+
+	cfg.Storage.Mode = StorageModeMemory
+	if store, err := newStorageBackend(cfg); err != nil || fmt.Sprintf("%T", store) != "*main.memoryStorage" {
+		t.Fatalf("memory mode backend = %T, %v", store, err)
+	}
+
+	cfg.Storage.Mode = StorageModePersistent
+	cfg.Storage.Backend = "ftp"
+	if _, err := newStorageBackend(cfg); err == nil {
+		t.Fatalf("unknown backend accepted")
+	}
+}
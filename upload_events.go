@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 通过 GET /api/upload/:uploadId/events (Server-Sent Events) 推送的上传事件
+const (
+	UploadEventStatus        = "status"         // 连接建立时的当前状态
+	UploadEventChunkReceived = "chunk-received" // 一个分片已写入
+	UploadEventMergeStarted  = "merge-started"  // 所有分片已收到，开始完成文件并校验
+	UploadEventMergeProgress = "merge-progress" // 完成过程中已校验的字节数 (MergedBytes)
+	UploadEventCompleted     = "completed"      // 上传完成，可以保存元数据
+	UploadEventFailed        = "failed"         // 上传失败，见 FailureReason
+	UploadEventCancelled     = "cancelled"      // 上传已被客户端取消
+)
+
+// uploadEventKeepAlive 是 SSE 连接上发送注释行的间隔，同时用于重新检查会话状态
+const uploadEventKeepAlive = 15 * time.Second
+
+// UploadEvent 是推送给客户端的一个上传事件
+type UploadEvent struct {
+	Type           string `json:"type"`
+	UploadID       string `json:"uploadId"`
+	State          string `json:"state"`
+	ChunkNumber    int    `json:"chunkNumber,omitempty"` // chunk-received 时的分片编号
+	ReceivedChunks int    `json:"receivedChunks"`
+	TotalChunks    int    `json:"totalChunks"`
+	ReceivedBytes  int64  `json:"receivedBytes"`
+	FileSize       int64  `json:"fileSize"`
+	MergedBytes    int64  `json:"mergedBytes,omitempty"` // merge-progress 时已校验的字节数
+	Digest         string `json:"digest,omitempty"`
+	FailureReason  string `json:"failureReason,omitempty"`
+	FailureDetail  string `json:"failureDetail,omitempty"`
+}
+
+// newUploadEvent 根据会话的当前状态构造事件
+func newUploadEvent(eventType string, session *UploadSession) UploadEvent {
+	return UploadEvent{
+		Type:           eventType,
+		UploadID:       session.UploadID,
+		State:          session.State,
+		ReceivedChunks: session.Received.count(),
+		TotalChunks:    session.TotalChunks,
+		ReceivedBytes:  session.ReceivedBytes,
+		FileSize:       session.FileSize,
+		Digest:         session.Digest,
+		FailureReason:  session.FailureReason,
+		FailureDetail:  session.FailureDetail,
+	}
+}
+
+// terminal 报告事件之后是否不会再有新的事件
+func (e UploadEvent) terminal() bool {
+	return e.Type == UploadEventCompleted || e.Type == UploadEventFailed || e.Type == UploadEventCancelled
+}
+
+// uploadEventHub 把上传事件分发给订阅了该上传的 SSE 连接，只在进程内有效
+type uploadEventHub struct {
+	mu   sync.Mutex
+	subs map[string]map[chan UploadEvent]struct{} // uploadId -> 订阅者
+}
+
+func newUploadEventHub() *uploadEventHub {
+	return &uploadEventHub{subs: make(map[string]map[chan UploadEvent]struct{})}
+}
+
+// subscribe 订阅 uploadID 的事件，返回的函数用于取消订阅
+func (h *uploadEventHub) subscribe(uploadID string) (<-chan UploadEvent, func()) {
+	ch := make(chan UploadEvent, 64)
+	h.mu.Lock()
+	if h.subs[uploadID] == nil {
+		h.subs[uploadID] = make(map[chan UploadEvent]struct{})
+	}
+	h.subs[uploadID][ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs[uploadID], ch)
+		if len(h.subs[uploadID]) == 0 {
+			delete(h.subs, uploadID)
+		}
+		h.mu.Unlock()
+	}
+}
+
+// publish 把事件发给 uploadID 的所有订阅者。不会阻塞: 跟不上的连接会丢失事件，
+// 它们在下一次保活时重新检查会话状态，因此不会错过终止事件。
+func (h *uploadEventHub) publish(uploadID string, event UploadEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[uploadID] {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// UploadEventsHandler 以 Server-Sent Events 推送上传进度，客户端不再需要轮询 /api/upload/status。
+// 连接建立时先发送当前状态 (status，已经结束时直接发送 completed / failed / cancelled)，
+// 上传结束后服务器关闭连接。
+func UploadEventsHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		uploadID := c.Param("uploadId")
+		if !IsValidUploadID(uploadID) {
+			uploadEventsLog.Debug("Invalid uploadId format received", "uploadId", uploadID)
+			c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Invalid uploadId format"})
+			return
+		}
+
+		// 先订阅再读取会话，读取之后发生的变化都会收到
+		store := GetStorageManager()
+		events, unsubscribe := store.uploads.events.subscribe(uploadID)
+		defer unsubscribe()
+		session, err := store.uploads.Get(uploadID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "Upload not found"})
+			return
+		}
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("X-Accel-Buffering", "no") // 反向代理不要缓冲事件
+		c.Status(http.StatusOK)
+
+		send := func(event UploadEvent) bool {
+			c.SSEvent(event.Type, event)
+			c.Writer.Flush()
+			return event.terminal()
+		}
+		if send(sessionStateEvent(session)) {
+			return
+		}
+
+		ticker := time.NewTicker(uploadEventKeepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case event := <-events:
+				if send(event) {
+					return
+				}
+			case <-ticker.C:
+				// 会话已被删除 (元数据已保存或被回收) 时结束连接
+				session, err := store.uploads.Get(uploadID)
+				if err != nil {
+					return
+				}
+				if event := sessionStateEvent(session); event.terminal() {
+					send(event)
+					return
+				}
+				c.Writer.WriteString(": keep-alive\n\n")
+				c.Writer.Flush()
+			case <-c.Request.Context().Done():
+				return
+			case <-backgroundJobs.Draining():
+				// 关闭服务时结束连接，EventSource 会自动重连到重启后的服务
+				return
+			}
+		}
+	}
+}
+
+// sessionStateEvent 把会话的当前状态表示为事件: 已经结束时是对应的终止事件，否则是 status
+func sessionStateEvent(session *UploadSession) UploadEvent {
+	switch session.State {
+	case UploadStateComplete:
+		return newUploadEvent(UploadEventCompleted, session)
+	case UploadStateFailed:
+		return newUploadEvent(UploadEventFailed, session)
+	case UploadStateCancelled:
+		return newUploadEvent(UploadEventCancelled, session)
+	}
+	return newUploadEvent(UploadEventStatus, session)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// readEventTypes 返回 SSE 流中的事件类型，连续的 merge-progress 只记一次；第一个事件到达时调用 ready
+func readEventTypes(t *testing.T, url string, ready func()) []string {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("events returned %d, Content-Type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	var types []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		eventType, ok := strings.CutPrefix(scanner.Text(), "event:")
+		if !ok {
+			continue
+		}
+		if len(types) > 0 && eventType == UploadEventMergeProgress && types[len(types)-1] == eventType {
+			continue
+		}
+		types = append(types, eventType)
+		if len(types) == 1 && ready != nil {
+			ready()
+		}
+	}
+	return types
+}
+
+func TestUploadEventsStream(t *testing.T) {
+	cfg := setupTestStorage(t, StorageModePersistent)
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/api/upload/:uploadId/events", UploadEventsHandler())
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	chunkSize := int(cfg.Upload.chunkSize())
+	content := bytes.Repeat([]byte{'x'}, chunkSize+10)
+	w, upload := initTestUpload(t, `{"fileName": "file.bin", "fileSize": `+strconv.Itoa(len(content))+`, "sha256": "`+sha256Hex(content)+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("init returned %d: %s", w.Code, w.Body.String())
+	}
+	url := server.URL + "/api/upload/" + upload.UploadID + "/events"
+
+	// 收到当前状态后再上传分片，之后的每一步都以事件推送，上传结束后服务器关闭连接
+	types := readEventTypes(t, url, func() {
+		for number, data := range [][]byte{content[:chunkSize], content[chunkSize:]} {
+			if w := putChunk(upload.UploadID, number+1, data); w.Code != http.StatusOK {
+				t.Errorf("chunk %d returned %d: %s", number+1, w.Code, w.Body.String())
+			}
+		}
+	})
+	want := []string{UploadEventStatus, UploadEventChunkReceived, UploadEventChunkReceived, UploadEventMergeStarted, UploadEventMergeProgress, UploadEventCompleted}
+	if !reflect.DeepEqual(types, want) {
+		t.Fatalf("events = %v, want %v", types, want)
+	}
+
+	// 已经结束的上传直接发送终止事件
+	if types := readEventTypes(t, url, nil); !reflect.DeepEqual(types, []string{UploadEventCompleted}) {
+		t.Fatalf("events after completion = %v", types)
+	}
+}
@@ -0,0 +1,703 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 上传会话的状态: initialized -> receiving -> merging -> complete，任一步都可能进入 failed，
+// 或由客户端通过 DELETE /api/upload/:uploadId 进入 cancelled。
+// 分片直接写入预分配的文件，merging 阶段只剩完成文件并校验整体摘要。
+const (
+	UploadStateInitialized = "initialized"
+	UploadStateReceiving   = "receiving"
+	UploadStateMerging     = "merging"
+	UploadStateComplete    = "complete"
+	UploadStateFailed      = "failed"
+	UploadStateCancelled   = "cancelled"
+)
+
+// 上传失败的原因 (UploadSession.FailureReason)
+const (
+	UploadFailureSizeMismatch = "size_mismatch" // 完成后的大小与初始化时声明的不一致
+	UploadFailureMissingChunk = "missing_chunk" // 完成时缺少分片
+	UploadFailureStorageFull  = "storage_full"  // 存储空间不足
+	UploadFailureStorageError = "storage_error" // 其他存储错误
+	UploadFailureInterrupted  = "interrupted"   // 完成过程中服务器关闭或重启
+
+	UploadFailureChecksumMismatch = "checksum_mismatch" // 分片的 SHA-256 与客户端声明的不一致
+	UploadFailureDigestMismatch   = "digest_mismatch"   // 完成后整个密文的 SHA-256 与初始化时声明的不一致
+)
+
+// errUploadSessionNotFound 表示 uploadId 没有对应的会话 (未初始化或已被清理)
+var errUploadSessionNotFound = errors.New("upload session not found")
+
+// errUploadCancelled 是客户端取消上传时中断完成过程的原因
+var errUploadCancelled = errors.New("upload cancelled")
+
+// errUploadTooLarge 表示累计接收的字节数会超过初始化时声明的大小
+var errUploadTooLarge = errors.New("upload exceeds declared file size")
+
+// UploadSession 是一次分片上传的持久化状态
+type UploadSession struct {
+	UploadID      string    `json:"uploadId"`
+	FileName      string    `json:"fileName"`         // 初始化时声明的文件名 (已去除路径)
+	FileSize      int64     `json:"fileSize"`         // 初始化时声明的密文大小
+	ChunkSize     int64     `json:"chunkSize"`        // 除最后一个分片外每个分片的大小，第 n 个分片写在 (n-1)*ChunkSize 处
+	TotalChunks   int       `json:"totalChunks"`      // 分片数，初始化时确定
+	SHA256        string    `json:"sha256,omitempty"` // 初始化时声明的整个密文的 SHA-256 (可选)
+	Digest        string    `json:"digest,omitempty"` // 上传完成后实际计算的 SHA-256
+	CreatedAt     time.Time `json:"createdAt"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+	State         string    `json:"state"`
+	FailureReason string    `json:"failureReason,omitempty"` // State 为 failed 时的原因代码
+	FailureDetail string    `json:"failureDetail,omitempty"` // 便于排查的详细说明
+
+	CancelTokenHash string `json:"cancelTokenHash,omitempty"` // 初始化时返回的取消令牌的 SHA-256
+
+	// 以下字段由 uploadSessionStore 维护: 分片记录追加写入 <uploadId>.chunks，不随会话文件重写
+	// (旧版本的会话文件中带有 received 和 chunks，加载时迁移到分片日志)
+	Received      chunkBitmap         `json:"received,omitempty"` // 已写入的分片，决定上传何时完成
+	Chunks        map[int]UploadChunk `json:"chunks,omitempty"`   // 已接收分片的大小和摘要，键为分片编号 (从 1 开始)，只在 store 内部保存
+	ReceivedBytes int64               `json:"receivedBytes"`      // 已接收分片的累计字节数，不会超过 FileSize
+}
+
+// UploadChunk 记录一个已接收分片的大小和 SHA-256，用于判断重发的分片是否相同
+type UploadChunk struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// snapshot 返回会话的副本，只复制位图 (每个分片一位)，不带每个分片的摘要 (Chunks)，
+// 因此每次接收分片时的开销与分片数无关。需要某个分片的摘要时使用 uploadSessionStore.Chunk。
+func (session *UploadSession) snapshot() *UploadSession {
+	sessionCopy := *session
+	sessionCopy.Received = append(chunkBitmap(nil), session.Received...)
+	sessionCopy.Chunks = nil
+	return &sessionCopy
+}
+
+// chunkNumbers 返回已接收的分片编号，从小到大排序
+func (session *UploadSession) chunkNumbers() []int {
+	numbers := make([]int, 0, session.Received.count())
+	for number := 1; number <= session.TotalChunks; number++ {
+		if session.Received.has(number) {
+			numbers = append(numbers, number)
+		}
+	}
+	return numbers
+}
+
+// chunkLength 返回第 number 个分片的大小: 除最后一个分片外都是 ChunkSize (见 chunkOffset)
+func (session *UploadSession) chunkLength(number int) int64 {
+	if number == session.TotalChunks {
+		return session.FileSize - int64(number-1)*session.ChunkSize
+	}
+	return session.ChunkSize
+}
+
+// hasAllChunks 报告 1..TotalChunks 是否都已接收
+func (session *UploadSession) hasAllChunks() bool {
+	return session.TotalChunks > 0 && session.Received.count() == session.TotalChunks
+}
+
+// markReceived 记录第 number 个分片已写入
+func (session *UploadSession) markReceived(number int, chunk UploadChunk) {
+	if session.Received == nil {
+		session.Received = newChunkBitmap(session.TotalChunks)
+	}
+	session.Received.set(number)
+	if session.Chunks == nil {
+		session.Chunks = make(map[int]UploadChunk)
+	}
+	session.ReceivedBytes += chunk.Size - session.Chunks[number].Size
+	session.Chunks[number] = chunk
+}
+
+// clearReceived 撤销第 number 个分片的记录 (例如重发时只写入了一部分)
+func (session *UploadSession) clearReceived(number int) {
+	session.Received.clear(number)
+	session.ReceivedBytes -= session.Chunks[number].Size
+	delete(session.Chunks, number)
+}
+
+// chunkOffset 返回第 number 个分片在文件中的偏移，并检查分片的大小与初始化时声明的布局一致：
+// 除最后一个分片外每个分片都是 ChunkSize 字节，最后一个分片正好到文件末尾
+func (session *UploadSession) chunkOffset(number int, size int64) (int64, error) {
+	if number < 1 || number > session.TotalChunks {
+		return 0, fmt.Errorf("chunk number %d out of range 1..%d", number, session.TotalChunks)
+	}
+	offset := int64(number-1) * session.ChunkSize
+	if number == session.TotalChunks {
+		if expected := session.FileSize - offset; size != expected {
+			return 0, fmt.Errorf("final chunk %d is %d bytes, expected %d", number, size, expected)
+		}
+		return offset, nil
+	}
+	if size != session.ChunkSize {
+		return 0, fmt.Errorf("chunk %d is %d bytes, every chunk but the last must be %d bytes", number, size, session.ChunkSize)
+	}
+	return offset, nil
+}
+
+// chunkBitmap 以位记录已写入的分片，第 n 个分片对应第 n-1 位
+type chunkBitmap []byte
+
+func newChunkBitmap(total int) chunkBitmap {
+	return make(chunkBitmap, (total+7)/8)
+}
+
+func (b chunkBitmap) set(number int) {
+	b[(number-1)/8] |= 1 << ((number - 1) % 8)
+}
+
+func (b chunkBitmap) clear(number int) {
+	if b.has(number) {
+		b[(number-1)/8] &^= 1 << ((number - 1) % 8)
+	}
+}
+
+func (b chunkBitmap) has(number int) bool {
+	index := (number - 1) / 8
+	return number >= 1 && index < len(b) && b[index]&(1<<((number-1)%8)) != 0
+}
+
+func (b chunkBitmap) count() int {
+	count := 0
+	for _, word := range b {
+		count += bits.OnesCount8(word)
+	}
+	return count
+}
+
+// uploadSessionStore 保存所有上传会话。每个会话保存为 dir 下的 <uploadId>.json，已接收的分片
+// 逐条追加到 <uploadId>.chunks (分片日志)，因此接收一个分片只需追加一行，与分片总数无关；
+// 进程重启后仍然可以查询。dir 为空时 (纯内存模式) 只保存在内存中。
+//
+// mu 只保护会话表以及 finalizing、inflight，不在持有时读写磁盘；每个会话的修改和持久化
+// 由该会话自己的锁 (uploadSessionEntry.mu) 串行化，不同上传之间互不等待。
+type uploadSessionStore struct {
+	mu       sync.Mutex
+	dir      string
+	sessions map[string]*uploadSessionEntry
+	events   *uploadEventHub // 推送给 SSE 连接的上传事件
+
+	finalizing map[string]context.CancelCauseFunc // 正在完成的上传，取消上传或关闭服务时中断
+	inflight   map[string]int                     // 每个上传正在写入的分片数，不超过 upload.parallelism
+}
+
+// uploadSessionEntry 是会话表中的一项，mu 保护 session 及其文件
+type uploadSessionEntry struct {
+	mu      sync.Mutex
+	session *UploadSession
+	deleted bool // 已从会话表删除，持有旧指针的调用者应视为不存在
+}
+
+// chunkRecord 是分片日志中的一行: 记录第 Number 个分片的大小和摘要，Clear 为 true 时撤销该分片
+type chunkRecord struct {
+	Number int    `json:"n"`
+	Size   int64  `json:"size,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	Clear  bool   `json:"clear,omitempty"`
+}
+
+func newUploadSessionStore(dir string) *uploadSessionStore {
+	return &uploadSessionStore{
+		dir:      dir,
+		sessions: make(map[string]*uploadSessionEntry),
+		events:   newUploadEventHub(),
+
+		finalizing: make(map[string]context.CancelCauseFunc),
+		inflight:   make(map[string]int),
+	}
+}
+
+// Load 读取上次运行时保存的上传会话，重放分片日志，并把每个会话的分片日志压缩为每个分片一行
+func (s *uploadSessionStore) Load() error {
+	if s.dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(s.dir, 0750); err != nil {
+		return fmt.Errorf("创建上传会话目录失败: %w", err)
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("读取上传会话目录失败: %w", err)
+	}
+
+	loaded := make(map[string]*uploadSessionEntry)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(s.dir, entry.Name()))
+		if err != nil {
+			uploadSessionLog.Error("Failed to read session file", "file", entry.Name(), "error", err)
+			continue
+		}
+		var session UploadSession
+		if err := json.Unmarshal(data, &session); err != nil || session.UploadID == "" {
+			uploadSessionLog.Warn("Skipping invalid session file", "file", entry.Name(), "error", err)
+			continue
+		}
+		if err := s.replayJournal(&session); err != nil {
+			uploadSessionLog.Error("Failed to replay chunk journal", "uploadId", session.UploadID, "error", err)
+		}
+		// 上次运行时正在完成的上传不会再继续
+		if session.State == UploadStateMerging {
+			session.State = UploadStateFailed
+			session.FailureReason = UploadFailureInterrupted
+			session.FailureDetail = "server restarted while finishing the upload"
+			session.UpdatedAt = time.Now()
+			uploadSessionLog.Warn("Finishing was interrupted by a restart, marking upload failed", "uploadId", session.UploadID)
+		}
+		if session.State == UploadStateFailed || session.State == UploadStateCancelled {
+			session.Received, session.Chunks, session.ReceivedBytes = nil, nil, 0
+		}
+		if err := s.compact(&session); err != nil {
+			uploadSessionLog.Error("Failed to persist loaded session", "uploadId", session.UploadID, "error", err)
+		}
+		loaded[session.UploadID] = &uploadSessionEntry{session: &session}
+	}
+
+	s.mu.Lock()
+	for id, entry := range loaded {
+		s.sessions[id] = entry
+	}
+	s.mu.Unlock()
+	uploadSessionLog.Info("Loaded upload sessions", "count", len(loaded))
+	return nil
+}
+
+func (s *uploadSessionStore) sessionPath(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+func (s *uploadSessionStore) journalPath(id string) string {
+	return filepath.Join(s.dir, id+".chunks")
+}
+
+// replayJournal 把分片日志中的记录应用到会话上。崩溃时最后一行可能不完整，无法解析的行被跳过。
+// 会话文件不会随每个分片重写，因此 ReceivedBytes 和 UpdatedAt 以分片日志为准。
+func (s *uploadSessionStore) replayJournal(session *UploadSession) error {
+	path := s.journalPath(session.UploadID)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(session.Chunks) == 0 {
+		session.ReceivedBytes = 0 // 由分片记录重新累计
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		var record chunkRecord
+		if line == "" || json.Unmarshal([]byte(line), &record) != nil || record.Number < 1 || record.Number > session.TotalChunks {
+			continue
+		}
+		if record.Clear {
+			session.clearReceived(record.Number)
+		} else {
+			session.markReceived(record.Number, UploadChunk{Size: record.Size, SHA256: record.SHA256})
+		}
+	}
+	if len(session.Chunks) > 0 && session.State == UploadStateInitialized {
+		session.State = UploadStateReceiving
+	}
+	if info, err := os.Stat(path); err == nil && info.ModTime().After(session.UpdatedAt) {
+		session.UpdatedAt = info.ModTime()
+	}
+	return nil
+}
+
+// persistLocked 原子地写入会话文件，不包括分片记录 (调用者须持有会话的锁)
+func (s *uploadSessionStore) persistLocked(session *UploadSession) error {
+	if s.dir == "" {
+		return nil
+	}
+	header := *session
+	header.Received, header.Chunks = nil, nil
+	data, err := json.Marshal(&header)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.sessionPath(session.UploadID), data)
+}
+
+// appendChunkRecord 在分片日志末尾追加一行 (调用者须持有会话的锁)
+func (s *uploadSessionStore) appendChunkRecord(id string, record chunkRecord) error {
+	if s.dir == "" {
+		return nil
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.journalPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// compact 重写分片日志 (每个已接收的分片一行，没有分片时删除) 和会话文件
+func (s *uploadSessionStore) compact(session *UploadSession) error {
+	if s.dir == "" {
+		return nil
+	}
+	if len(session.Chunks) == 0 {
+		if err := os.Remove(s.journalPath(session.UploadID)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return s.persistLocked(session)
+	}
+	numbers := make([]int, 0, len(session.Chunks))
+	for number := range session.Chunks {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+	var journal []byte
+	for _, number := range numbers {
+		chunk := session.Chunks[number]
+		line, err := json.Marshal(chunkRecord{Number: number, Size: chunk.Size, SHA256: chunk.SHA256})
+		if err != nil {
+			return err
+		}
+		journal = append(append(journal, line...), '\n')
+	}
+	if err := writeFileAtomic(s.journalPath(session.UploadID), journal); err != nil {
+		return err
+	}
+	return s.persistLocked(session)
+}
+
+// removeFiles 删除会话文件和分片日志
+func (s *uploadSessionStore) removeFiles(id string) error {
+	if s.dir == "" {
+		return nil
+	}
+	for _, path := range []string{s.journalPath(id), s.sessionPath(id)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic 先写入临时文件再改名，读者不会看到写了一半的文件
+func writeFileAtomic(path string, data []byte) error {
+	tempFile := path + ".tmp"
+	if err := os.WriteFile(tempFile, data, 0640); err != nil {
+		return err
+	}
+	if err := os.Rename(tempFile, path); err != nil {
+		os.Remove(tempFile)
+		return err
+	}
+	return nil
+}
+
+// lockEntry 找到 id 对应的会话并持有它的锁，不存在时返回 errUploadSessionNotFound。
+// 成功时调用者须释放 entry.mu。
+func (s *uploadSessionStore) lockEntry(id string) (*uploadSessionEntry, error) {
+	s.mu.Lock()
+	entry, ok := s.sessions[id]
+	s.mu.Unlock()
+	if !ok {
+		return nil, errUploadSessionNotFound
+	}
+	entry.mu.Lock()
+	if entry.deleted {
+		entry.mu.Unlock()
+		return nil, errUploadSessionNotFound
+	}
+	return entry, nil
+}
+
+// removeEntry 把已标记为 deleted 的 entry 从会话表中移除
+func (s *uploadSessionStore) removeEntry(id string, entry *uploadSessionEntry) {
+	s.mu.Lock()
+	if s.sessions[id] == entry {
+		delete(s.sessions, id)
+	}
+	s.mu.Unlock()
+}
+
+// Create 保存一个新会话，uploadId 已存在时返回错误
+func (s *uploadSessionStore) Create(session *UploadSession) error {
+	now := time.Now()
+	session.CreatedAt = now
+	session.UpdatedAt = now
+	session.State = UploadStateInitialized
+	entry := &uploadSessionEntry{session: session.snapshot()}
+
+	// 先占住 uploadId，再在会话自己的锁内写文件
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	s.mu.Lock()
+	if _, ok := s.sessions[session.UploadID]; ok {
+		s.mu.Unlock()
+		return fmt.Errorf("上传会话已存在: %s", session.UploadID)
+	}
+	s.sessions[session.UploadID] = entry
+	s.mu.Unlock()
+
+	if err := s.persistLocked(entry.session); err != nil {
+		entry.deleted = true
+		s.removeEntry(session.UploadID, entry)
+		return fmt.Errorf("持久化上传会话失败: %w", err)
+	}
+	return nil
+}
+
+// Get 返回会话的副本 (不含每个分片的摘要，见 snapshot)，不存在时返回 errUploadSessionNotFound
+func (s *uploadSessionStore) Get(id string) (*UploadSession, error) {
+	entry, err := s.lockEntry(id)
+	if err != nil {
+		return nil, err
+	}
+	defer entry.mu.Unlock()
+	return entry.session.snapshot(), nil
+}
+
+// Chunk 返回第 number 个分片的记录，分片未接收或会话不存在时 ok 为 false
+func (s *uploadSessionStore) Chunk(id string, number int) (chunk UploadChunk, ok bool) {
+	entry, err := s.lockEntry(id)
+	if err != nil {
+		return UploadChunk{}, false
+	}
+	defer entry.mu.Unlock()
+	if !entry.session.Received.has(number) {
+		return UploadChunk{}, false
+	}
+	chunk, ok = entry.session.Chunks[number]
+	return chunk, ok
+}
+
+// Update 在会话的锁内修改并持久化会话，返回修改后的副本。fn 返回错误时不做任何修改。
+// fn 只能修改会话本身的字段，分片由 RecordChunk / ClearChunk 记录；fn 可以把 Received 和
+// Chunks 整体置为 nil 来丢弃所有分片。
+func (s *uploadSessionStore) Update(id string, fn func(session *UploadSession) error) (*UploadSession, error) {
+	entry, err := s.lockEntry(id)
+	if err != nil {
+		return nil, err
+	}
+	defer entry.mu.Unlock()
+
+	updated := *entry.session
+	if err := fn(&updated); err != nil {
+		return nil, err
+	}
+	updated.UpdatedAt = time.Now()
+	if err := s.persistLocked(&updated); err != nil {
+		return nil, fmt.Errorf("持久化上传会话失败: %w", err)
+	}
+	if len(updated.Chunks) == 0 && len(entry.session.Chunks) > 0 && s.dir != "" {
+		// 会话文件已经不再需要分片日志；删除失败时，下次加载会因状态为 failed / cancelled 忽略它
+		if err := os.Remove(s.journalPath(id)); err != nil && !os.IsNotExist(err) {
+			uploadSessionLog.Warn("Failed to remove chunk journal", "uploadId", id, "error", err)
+		}
+	}
+	entry.session = &updated
+	return updated.snapshot(), nil
+}
+
+// RecordChunk 记录第 number 个分片已写入: 在分片日志中追加一行，并把 initialized 的会话变为 receiving。
+// 会话不再接收分片时返回 *uploadStateError，累计字节数会超过声明的大小时返回 errUploadTooLarge。
+func (s *uploadSessionStore) RecordChunk(id string, number int, chunk UploadChunk) (*UploadSession, error) {
+	entry, err := s.lockEntry(id)
+	if err != nil {
+		return nil, err
+	}
+	defer entry.mu.Unlock()
+
+	session := entry.session
+	if session.State != UploadStateInitialized && session.State != UploadStateReceiving {
+		return nil, &uploadStateError{State: session.State}
+	}
+	if total := session.ReceivedBytes - session.Chunks[number].Size + chunk.Size; total > session.FileSize {
+		return nil, fmt.Errorf("%w: %d > %d bytes", errUploadTooLarge, total, session.FileSize)
+	}
+	if err := s.appendChunkRecord(id, chunkRecord{Number: number, Size: chunk.Size, SHA256: chunk.SHA256}); err != nil {
+		return nil, fmt.Errorf("持久化上传会话失败: %w", err)
+	}
+	if session.State == UploadStateInitialized {
+		receiving := *session
+		receiving.State = UploadStateReceiving
+		if err := s.persistLocked(&receiving); err != nil {
+			return nil, fmt.Errorf("持久化上传会话失败: %w", err)
+		}
+		session.State = UploadStateReceiving
+	}
+	session.markReceived(number, chunk)
+	session.UpdatedAt = time.Now()
+	return session.snapshot(), nil
+}
+
+// ClearChunk 撤销第 number 个分片的记录 (例如重发时只写入了一部分)
+func (s *uploadSessionStore) ClearChunk(id string, number int) error {
+	entry, err := s.lockEntry(id)
+	if err != nil {
+		return err
+	}
+	defer entry.mu.Unlock()
+
+	if !entry.session.Received.has(number) {
+		return nil
+	}
+	if err := s.appendChunkRecord(id, chunkRecord{Number: number, Clear: true}); err != nil {
+		return fmt.Errorf("持久化上传会话失败: %w", err)
+	}
+	entry.session.clearReceived(number)
+	entry.session.UpdatedAt = time.Now()
+	return nil
+}
+
+// List 返回所有会话的副本
+func (s *uploadSessionStore) List() []*UploadSession {
+	s.mu.Lock()
+	entries := make([]*uploadSessionEntry, 0, len(s.sessions))
+	for _, entry := range s.sessions {
+		entries = append(entries, entry)
+	}
+	s.mu.Unlock()
+
+	sessions := make([]*UploadSession, 0, len(entries))
+	for _, entry := range entries {
+		entry.mu.Lock()
+		if !entry.deleted {
+			sessions = append(sessions, entry.session.snapshot())
+		}
+		entry.mu.Unlock()
+	}
+	return sessions
+}
+
+// DeleteIf 在 cond 返回 true 时删除会话，判断与删除在会话的锁内完成。
+// 返回被删除的会话；会话不存在或 cond 返回 false 时返回 nil。
+func (s *uploadSessionStore) DeleteIf(id string, cond func(session *UploadSession) bool) (*UploadSession, error) {
+	entry, err := s.lockEntry(id)
+	if err != nil {
+		return nil, nil
+	}
+	defer entry.mu.Unlock()
+	if !cond(entry.session.snapshot()) {
+		return nil, nil
+	}
+	if err := s.removeFiles(id); err != nil {
+		return nil, err
+	}
+	entry.deleted = true
+	s.removeEntry(id, entry)
+	return entry.session.snapshot(), nil
+}
+
+// Delete 删除会话，不存在时不返回错误
+func (s *uploadSessionStore) Delete(id string) error {
+	entry, err := s.lockEntry(id)
+	if err != nil {
+		return nil
+	}
+	defer entry.mu.Unlock()
+	entry.deleted = true
+	s.removeEntry(id, entry)
+	return s.removeFiles(id)
+}
+
+// beginFinalize 登记一个正在完成的上传。返回的 context 在上传被取消或服务关闭时结束，
+// context.Cause 给出原因 (errUploadCancelled 或 errServerShutdown)，完成后须调用 done。
+func (s *uploadSessionStore) beginFinalize(id string) (ctx context.Context, done func()) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	s.mu.Lock()
+	s.finalizing[id] = cancel
+	s.mu.Unlock()
+	return ctx, func() {
+		s.mu.Lock()
+		delete(s.finalizing, id)
+		s.mu.Unlock()
+		cancel(nil)
+	}
+}
+
+// interruptFinalize 中断 id 正在进行的完成过程 (如果有)
+func (s *uploadSessionStore) interruptFinalize(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cancel, ok := s.finalizing[id]; ok {
+		cancel(errUploadCancelled)
+	}
+}
+
+// interruptAllFinalize 以 cause 中断所有正在进行的完成过程
+func (s *uploadSessionStore) interruptAllFinalize(cause error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, cancel := range s.finalizing {
+		cancel(cause)
+	}
+}
+
+// acquireChunkSlot 为 id 占用一个分片写入名额，已有 limit 个分片正在写入时返回 false；
+// 成功时须调用 releaseChunkSlot
+func (s *uploadSessionStore) acquireChunkSlot(id string, limit int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inflight[id] >= limit {
+		return false
+	}
+	s.inflight[id]++
+	return true
+}
+
+func (s *uploadSessionStore) releaseChunkSlot(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inflight[id]--; s.inflight[id] <= 0 {
+		delete(s.inflight, id)
+	}
+}
+
+// uploadStateError 表示会话当前的状态不允许请求的操作
+type uploadStateError struct {
+	State string
+}
+
+func (e *uploadStateError) Error() string {
+	return fmt.Sprintf("upload is %s", e.State)
+}
+
+// markFailed 把会话标记为失败并记录原因；已取消的上传保持 cancelled
+func (s *uploadSessionStore) markFailed(id, reason string, detail error) {
+	session, err := s.Update(id, func(session *UploadSession) error {
+		if session.State == UploadStateCancelled {
+			return &uploadStateError{State: session.State}
+		}
+		session.State = UploadStateFailed
+		session.FailureReason = reason
+		session.FailureDetail = detail.Error()
+		session.Received = nil // 失败的上传不保留已接收的分片
+		session.Chunks = nil
+		session.ReceivedBytes = 0
+		return nil
+	})
+	if err != nil {
+		uploadSessionLog.Error("Failed to record failure", "uploadId", id, "reason", reason, "detail", detail, "error", err)
+		return
+	}
+	uploadSessionLog.Warn("Upload failed", "uploadId", id, "reason", reason, "detail", detail)
+	s.events.publish(id, newUploadEvent(UploadEventFailed, session))
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func newTestUploadSession(id string) *UploadSession {
+	return &UploadSession{UploadID: id, FileName: "file.bin", FileSize: 250, ChunkSize: 100, TotalChunks: 3}
+}
+
+// reloadUploadSessions 模拟重启: 从同一目录加载一个新的 store
+func reloadUploadSessions(t *testing.T, dir string) *uploadSessionStore {
+	t.Helper()
+	store := newUploadSessionStore(dir)
+	if err := store.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	return store
+}
+
+func TestUploadSessionStatePersists(t *testing.T) {
+	dir := t.TempDir()
+	store := reloadUploadSessions(t, dir)
+	const id = "upload-1"
+	if err := store.Create(newTestUploadSession(id)); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := store.Create(newTestUploadSession(id)); err == nil {
+		t.Fatalf("Create with a duplicate uploadId succeeded")
+	}
+	if session, _ := store.Get(id); session.State != UploadStateInitialized {
+		t.Fatalf("state after Create = %q, want %q", session.State, UploadStateInitialized)
+	}
+
+	session, err := store.RecordChunk(id, 1, UploadChunk{Size: 100, SHA256: "c1"})
+	if err != nil {
+		t.Fatalf("RecordChunk: %v", err)
+	}
+	if session.State != UploadStateReceiving {
+		t.Fatalf("state after first chunk = %q, want %q", session.State, UploadStateReceiving)
+	}
+	if session, _ := reloadUploadSessions(t, dir).Get(id); session == nil || session.State != UploadStateReceiving {
+		t.Fatalf("session after reload = %+v", session)
+	}
+
+	// 离开 receiving 后不再接受分片
+	if _, err := store.Update(id, func(session *UploadSession) error {
+		session.State = UploadStateMerging
+		return nil
+	}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	var stateErr *uploadStateError
+	if _, err := store.RecordChunk(id, 2, UploadChunk{Size: 100, SHA256: "c2"}); !errors.As(err, &stateErr) || stateErr.State != UploadStateMerging {
+		t.Fatalf("RecordChunk while merging = %v, want *uploadStateError", err)
+	}
+
+	if err := store.Delete(id); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := reloadUploadSessions(t, dir).Get(id); !errors.Is(err, errUploadSessionNotFound) {
+		t.Fatalf("Get after Delete and reload = %v, want errUploadSessionNotFound", err)
+	}
+}
+
+func TestUploadSessionFailedDiscardsChunks(t *testing.T) {
+	dir := t.TempDir()
+	store := reloadUploadSessions(t, dir)
+	const id = "upload-failed"
+	if err := store.Create(newTestUploadSession(id)); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := store.RecordChunk(id, 1, UploadChunk{Size: 100, SHA256: "c1"}); err != nil {
+		t.Fatalf("RecordChunk: %v", err)
+	}
+	if _, err := store.Update(id, func(session *UploadSession) error {
+		session.State = UploadStateFailed
+		session.FailureReason = UploadFailureStorageError
+		session.Received, session.Chunks, session.ReceivedBytes = nil, nil, 0
+		return nil
+	}); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+
+	session, err := reloadUploadSessions(t, dir).Get(id)
+	if err != nil {
+		t.Fatalf("Get after reload: %v", err)
+	}
+	if session.State != UploadStateFailed || session.FailureReason != UploadFailureStorageError || session.Received.count() != 0 {
+		t.Fatalf("failed session after reload = %+v", session)
+	}
+}
+
+func TestUploadSessionResendReplacesChunk(t *testing.T) {
+	store := reloadUploadSessions(t, t.TempDir())
+	const id = "upload-resend"
+	if err := store.Create(newTestUploadSession(id)); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	for number, sum := range map[int]string{3: "c3", 1: "c1", 2: "stale"} {
+		size := int64(100)
+		if number == 3 {
+			size = 50
+		}
+		if _, err := store.RecordChunk(id, number, UploadChunk{Size: size, SHA256: sum}); err != nil {
+			t.Fatalf("RecordChunk(%d): %v", number, err)
+		}
+	}
+
+	// 撤销后重发的分片替换原来的记录，相同的重发不会重复计入字节数
+	if err := store.ClearChunk(id, 2); err != nil {
+		t.Fatalf("ClearChunk: %v", err)
+	}
+	session, _ := store.Get(id)
+	if session.hasAllChunks() || session.ReceivedBytes != 150 || !reflect.DeepEqual(session.chunkNumbers(), []int{1, 3}) {
+		t.Fatalf("session after ClearChunk: chunks %v, %d bytes", session.chunkNumbers(), session.ReceivedBytes)
+	}
+	if _, ok := store.Chunk(id, 2); ok {
+		t.Fatalf("Chunk(2) still recorded after ClearChunk")
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := store.RecordChunk(id, 2, UploadChunk{Size: 100, SHA256: "c2"}); err != nil {
+			t.Fatalf("RecordChunk(2): %v", err)
+		}
+	}
+	session, _ = store.Get(id)
+	if !session.hasAllChunks() || session.ReceivedBytes != 250 {
+		t.Fatalf("session after resend: chunks %v, %d bytes", session.chunkNumbers(), session.ReceivedBytes)
+	}
+	if chunk, ok := store.Chunk(id, 2); !ok || chunk.SHA256 != "c2" {
+		t.Fatalf("Chunk(2) = %+v, %v", chunk, ok)
+	}
+}
+
+func TestUploadSessionJournalReplay(t *testing.T) {
+	dir := t.TempDir()
+	store := reloadUploadSessions(t, dir)
+	const id = "upload-journal"
+	if err := store.Create(newTestUploadSession(id)); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	for _, number := range []int{1, 2} {
+		if _, err := store.RecordChunk(id, number, UploadChunk{Size: 100, SHA256: "c"}); err != nil {
+			t.Fatalf("RecordChunk(%d): %v", number, err)
+		}
+	}
+	if err := store.ClearChunk(id, 2); err != nil {
+		t.Fatalf("ClearChunk: %v", err)
+	}
+
+	// 分片只追加到日志，重启后按顺序重放；重放后的日志在下一次重启时不能被重复计数
+	for restart := 0; restart < 2; restart++ {
+		store = reloadUploadSessions(t, dir)
+		session, err := store.Get(id)
+		if err != nil {
+			t.Fatalf("Get after reload: %v", err)
+		}
+		if !reflect.DeepEqual(session.chunkNumbers(), []int{1}) || session.ReceivedBytes != 100 {
+			t.Fatalf("session after reload %d: chunks %v, %d bytes", restart, session.chunkNumbers(), session.ReceivedBytes)
+		}
+	}
+	if _, err := store.RecordChunk(id, 3, UploadChunk{Size: 50, SHA256: "c3"}); err != nil {
+		t.Fatalf("RecordChunk(3) after reload: %v", err)
+	}
+	if session, _ := reloadUploadSessions(t, dir).Get(id); session.ReceivedBytes != 150 {
+		t.Fatalf("ReceivedBytes after reload = %d, want 150", session.ReceivedBytes)
+	}
+}
+
+func TestUploadSessionConcurrentChunks(t *testing.T) {
+	dir := t.TempDir()
+	store := reloadUploadSessions(t, dir)
+	const chunks = 64
+	ids := []string{"upload-a", "upload-b"}
+	for _, id := range ids {
+		if err := store.Create(&UploadSession{UploadID: id, FileSize: chunks * 10, ChunkSize: 10, TotalChunks: chunks}); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		for number := 1; number <= chunks; number++ {
+			wg.Add(1)
+			go func(id string, number int) {
+				defer wg.Done()
+				if _, err := store.RecordChunk(id, number, UploadChunk{Size: 10, SHA256: fmt.Sprint(number)}); err != nil {
+					t.Errorf("RecordChunk(%s, %d): %v", id, number, err)
+				}
+			}(id, number)
+		}
+	}
+	wg.Wait()
+
+	store = reloadUploadSessions(t, dir)
+	for _, id := range ids {
+		session, err := store.Get(id)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if !session.hasAllChunks() || session.ReceivedBytes != chunks*10 {
+			t.Fatalf("session %s after reload: %d chunks, %d bytes", id, session.Received.count(), session.ReceivedBytes)
+		}
+	}
+}
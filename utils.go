@@ -1,7 +1,6 @@
 package main
 
 import (
-	"log"
 	mathRand "math/rand"
 	"mime"          // Added for MIME type detection
 	"path/filepath" // Added for getting file extension
@@ -16,7 +15,7 @@ import (
 func init() {
 	// 使用当前时间作为种子初始化 math/rand
 	mathRand.Seed(time.Now().UnixNano())
-	log.Println("Random number generator initialized")
+	serverLog.Debug("Random number generator initialized")
 }
 
 // isValidUUID checks if the provided string is a valid UUID and doesn't contain path traversal characters.
@@ -24,13 +23,13 @@ func init() {
 func IsValidUUID(id string) bool {
 	// Basic check for path traversal characters
 	if strings.Contains(id, "..") || strings.Contains(id, "/") || strings.Contains(id, "\\") {
-		log.Printf("[Validation] Invalid characters found in UUID: %s", id)
+		validationLog.Debug("Invalid characters found in UUID", "id", id)
 		return false
 	}
 	// Try parsing as UUID using the imported library
 	_, err := uuid.Parse(id)
 	if err != nil {
-		log.Printf("[Validation] Invalid UUID format: %s, Error: %v", id, err)
+		validationLog.Debug("Invalid UUID format", "id", id, "error", err)
 	}
 	return err == nil
 }
@@ -46,6 +45,12 @@ func IsValidUploadID(uploadID string) bool {
 	return match
 }
 
+// IsValidSHA256 验证是否为 SHA-256 摘要的十六进制表示 (64位小写十六进制字符)
+func IsValidSHA256(digest string) bool {
+	match, _ := regexp.MatchString("^[0-9a-f]{64}$", digest)
+	return match
+}
+
 // 更多工具函数可以根据需要添加在这里...
 
 // GetContentTypeByFilename attempts to determine the MIME type based on the filename extension.